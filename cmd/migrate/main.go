@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/cccrizzz/ccpd-gin-server/common/mongo"
+	"github.com/cccrizzz/ccpd-gin-server/pkg/invoices"
+
+	"github.com/joho/godotenv"
+)
+
+// one-off data migrations, e.g. go run ./cmd/migrate -money -times
+func main() {
+	money := flag.Bool("money", false, "rewrite invoice and credit note amounts from float dollars to integer cents")
+	times := flag.Bool("times", false, "rewrite invoice, credit note and import job time strings as dates")
+	flag.Parse()
+	if !*money && !*times {
+		flag.Usage()
+		return
+	}
+
+	// load dotenv
+	godotenv.Load()
+	if err := invoices.SetBusinessTimeZone(os.Getenv("BUSINESS_TIMEZONE")); err != nil {
+		log.Fatalf("Invalid BUSINESS_TIMEZONE: %v", err)
+	}
+
+	ctx := context.Background()
+	mongoClient := mongo.InitMongo()
+	defer mongoClient.Disconnect(ctx)
+	invoicesCollection := mongoClient.Database("CCPD").Collection("Invoices_Production")
+	creditNotesCollection := mongoClient.Database("CCPD").Collection("CreditNotes")
+	importJobsCollection := mongoClient.Database("CCPD").Collection("ImportJobs")
+
+	if *money {
+		invoiceCount, noteCount, err := invoices.MigrateMoney(ctx, invoicesCollection, creditNotesCollection)
+		if err != nil {
+			log.Fatalf("money migration stopped after %d invoices, %d credit notes: %v", invoiceCount, noteCount, err)
+		}
+		log.Printf("money migrated: %d invoices, %d credit notes", invoiceCount, noteCount)
+	}
+	if *times {
+		result, err := invoices.MigrateTimes(ctx, invoicesCollection, creditNotesCollection, importJobsCollection)
+		if err != nil {
+			log.Fatalf("time migration stopped after %+v: %v", result, err)
+		}
+		log.Printf("times migrated: %+v", result)
+	}
+}
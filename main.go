@@ -4,6 +4,8 @@ import (
 	"context"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cccrizzz/ccpd-gin-server/common/azure"
@@ -38,6 +40,14 @@ func main() {
 	// invoicesCollection := mongoClient.Database("CCPD").Collection("Invoices")
 	invoicesCollection := mongoClient.Database("CCPD").Collection("Invoices_Production")
 	remainingCollection := mongoClient.Database("CCPD").Collection("RemainingHistory")
+	importJobsCollection := mongoClient.Database("CCPD").Collection("ImportJobs")
+	creditNotesCollection := mongoClient.Database("CCPD").Collection("CreditNotes")
+	countersCollection := mongoClient.Database("CCPD").Collection("Counters")
+
+	// invoice times are stored as dates and shown in BUSINESS_TIMEZONE, America/New_York by default
+	if err := invoices.SetBusinessTimeZone(os.Getenv("BUSINESS_TIMEZONE")); err != nil {
+		log.Fatalf("Invalid BUSINESS_TIMEZONE: %v", err)
+	}
 
 	// digital ocean space object storage
 	spaceObjectStorageClient := do.InitSpaceObjectStorage()
@@ -45,6 +55,16 @@ func main() {
 	// azure service client
 	azureClient := azure.InitAzureServiceClient()
 
+	// background invoice pdf import workers
+	importWorkers, err := strconv.Atoi(os.Getenv("IMPORT_WORKERS"))
+	if err != nil {
+		importWorkers = 4
+	}
+	// pdf uploads above PDF_MAX_MEMORY bytes spill to PDF_TEMP_DIR
+	pdfMaxMemory, _ := strconv.ParseInt(os.Getenv("PDF_MAX_MEMORY"), 10, 64)
+	invoices.SetPDFBufferLimits(pdfMaxMemory, os.Getenv("PDF_TEMP_DIR"))
+	importJobRunner := invoices.StartImportJobRunner(spaceObjectStorageClient, remainingCollection, importJobsCollection, importWorkers)
+
 	// active release mode
 	if os.Getenv("MODE") == "" || os.Getenv("MODE") == "DEBUG" {
 		gin.SetMode(gin.DebugMode)
@@ -96,7 +116,29 @@ func main() {
 	// r.Use(auth.FirebaseAuthMiddleware(firebaseAuthClient))
 
 	// gorilla web socket
-	r.GET("/ws", invoices.WsHandler)
+	// browsers may open it from the server's own host or WS_ALLOWED_ORIGINS (comma separated)
+	invoices.SetWsAllowedOrigins(strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ","))
+	// dead connections are dropped after WS_PONG_WAIT, a pad may resume within WS_RESUME_WINDOW (e.g. 90s)
+	wsPongWait, _ := time.ParseDuration(os.Getenv("WS_PONG_WAIT"))
+	wsWriteWait, _ := time.ParseDuration(os.Getenv("WS_WRITE_WAIT"))
+	wsResumeWindow, _ := time.ParseDuration(os.Getenv("WS_RESUME_WINDOW"))
+	wsSendBuffer, _ := strconv.Atoi(os.Getenv("WS_SEND_BUFFER"))
+	invoices.SetWsConfig(invoices.WsConfig{
+		PongWait:     wsPongWait,
+		WriteWait:    wsWriteWait,
+		ResumeWindow: wsResumeWindow,
+		SendBuffer:   wsSendBuffer,
+	})
+	signatureStore := invoices.NewSignatureStore(spaceObjectStorageClient, invoicesCollection)
+	r.GET("/ws", invoices.WsHandler(firebaseAuthClient, signatureStore))
+	// replicas share websocket rooms through a mongodb change stream when WS_BROKER=mongo
+	if os.Getenv("WS_BROKER") == "mongo" {
+		wsBroker, err := invoices.NewMongoBroker(context.Background(), mongoClient.Database("CCPD").Collection("WsMessages"))
+		if err != nil {
+			log.Fatalf("Failed to start websocket broker: %v", err)
+		}
+		invoices.UseWsBroker(context.Background(), wsBroker, signatureStore)
+	}
 	// go invoices.HandleBroadcasts()
 
 	// contact form controller
@@ -123,20 +165,35 @@ func main() {
 
 	// invoices controller
 	r.POST("/getInvoicesByPage", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetInvoicesByPage(invoicesCollection))
-	r.POST("/getInvoicesByInvoiceNumber", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetInvoiceByInvoiceNumber(invoicesCollection))
+	r.POST("/exportInvoices", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.ExportInvoices(invoicesCollection))
+	r.POST("/getInvoicesByInvoiceNumber", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetInvoiceByInvoiceNumber(invoicesCollection, creditNotesCollection))
 	r.POST("/createInvoiceFromPdf", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.CreateInvoiceFromPDF(spaceObjectStorageClient, remainingCollection))
+	r.POST("/createImportJob", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.CreateImportJob(importJobRunner))
+	r.GET("/getImportJob/:jobId", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetImportJob(importJobsCollection))
 	r.POST("/updateInvoice", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.UpdateInvoice(invoicesCollection))
+	r.POST("/updateInvoiceStatus", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.UpdateInvoiceStatus(invoicesCollection))
 	r.POST("/createInvoice", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.CreateInvoice(invoicesCollection))
+	r.POST("/parseInvoiceFile", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.ParseInvoiceFile(remainingCollection))
+	r.POST("/previewInvoiceImport", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.PreviewInvoiceImport(invoicesCollection))
+	r.POST("/importInvoices", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.ImportInvoices(invoicesCollection))
 	r.DELETE("/deleteInvoice", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.DeleteInvoice(invoicesCollection))
-	r.PUT("/uploadSignature/:nom", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.UploadSignature(spaceObjectStorageClient, invoicesCollection))
+	r.PUT("/uploadSignature/:nom", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.UploadSignature(signatureStore))
 	r.GET("/getAllInvoiceLot", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetAllInvoiceLot(invoicesCollection))
+	r.GET("/getLotSettlement/:auctionLot", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetLotSettlement(invoicesCollection, remainingCollection))
 	r.GET("/getChartData", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetChartData(invoicesCollection))
+	r.POST("/getSalesReport", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetSalesReport(invoicesCollection))
 	r.POST("/confirmSignature", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.ConfirmSignature(invoicesCollection))
+	r.POST("/addPayment", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.AddPayment(invoicesCollection))
+	r.POST("/voidPayment", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.VoidPayment(invoicesCollection))
 	r.DELETE("/deleteSignature", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.DeleteSignature(spaceObjectStorageClient, invoicesCollection))
 	r.POST("/verifyInvoiceNumber", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.VerifyInvoiceNumber(invoicesCollection))
-	r.POST("/refundInvoice", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.RefundInvoice(invoicesCollection))
+	r.GET("/renderInvoice/:invoiceNumber", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.RenderInvoice(spaceObjectStorageClient, invoicesCollection))
+	r.POST("/calculateTax", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.CalculateTax())
+	r.POST("/refundInvoice", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.RefundInvoice(invoicesCollection, creditNotesCollection, countersCollection))
+	r.GET("/getCreditNotes", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetCreditNotes(creditNotesCollection))
+	r.GET("/getCreditNote/:creditNoteNumber", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.GetCreditNote(creditNotesCollection))
+	r.POST("/voidCreditNote", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.VoidCreditNote(creditNotesCollection))
 	r.POST("/searchSignatureByInvoice", auth.FirebaseAuthMiddleware(firebaseAuthClient), invoices.SearchSignatureByInvoice(spaceObjectStorageClient))
-	// r.POST("/convertAllTimes", invoices.ConvertAllTimes(invoicesCollection))
 
 	r.Run(":3000")
 }
@@ -0,0 +1,333 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// sales report groupings
+const (
+	GroupByDay           string = "day"
+	GroupByWeek          string = "week"
+	GroupByMonth         string = "month"
+	GroupByAuctionLot    string = "auctionLot"
+	GroupByPaymentMethod string = "paymentMethod"
+	GroupByFulfillment   string = "fulfillment"
+)
+
+// sales report metrics
+const (
+	MetricGross         string = "gross"
+	MetricRefunds       string = "refunds"
+	MetricNet           string = "net"
+	MetricHandlingFees  string = "handlingFees"
+	MetricBuyersPremium string = "buyersPremium"
+	MetricTax           string = "tax"
+	MetricInvoiceCount  string = "invoiceCount"
+)
+
+var salesMetrics = []string{MetricGross, MetricRefunds, MetricNet, MetricHandlingFees, MetricBuyersPremium, MetricTax, MetricInvoiceCount}
+
+// payment method of invoices without a payment
+const unpaidTender string = "unpaid"
+
+// periods filled with empty rows at most, e.g. 10 years of days
+const maxReportPeriods = 3700
+
+var (
+	ErrUnknownGrouping = errors.New("unknown grouping")
+	ErrUnknownMetric   = errors.New("unknown metric")
+)
+
+// dates are business days, see timeRangeFilter
+// metrics default to all of them, status to every status but void
+type SalesReportReq struct {
+	FromDate string   `json:"fromDate"`
+	ToDate   string   `json:"toDate"`
+	GroupBy  string   `json:"groupBy" binding:"required"`
+	Metrics  []string `json:"metrics"`
+	Status   []string `json:"status"`
+}
+
+// totals of one group, net is gross less refunds
+type SalesReportRow struct {
+	Key           string `json:"key" bson:"key"`
+	Gross         Money  `json:"gross" bson:"gross"`
+	Refunds       Money  `json:"refunds" bson:"refunds"`
+	Net           Money  `json:"net" bson:"net"`
+	HandlingFees  Money  `json:"handlingFees" bson:"handlingFees"`
+	BuyersPremium Money  `json:"buyersPremium" bson:"buyersPremium"`
+	Tax           Money  `json:"tax" bson:"tax"`
+	InvoiceCount  int64  `json:"invoiceCount" bson:"invoiceCount"`
+}
+
+// one metric across the labels, money in dollars
+type SalesSeries struct {
+	Metric string `json:"metric"`
+	Data   []any  `json:"data"`
+}
+
+// labels and series line up for charts, rows carry every metric per group
+type SalesReport struct {
+	GroupBy string           `json:"groupBy"`
+	Metrics []string         `json:"metrics"`
+	Labels  []string         `json:"labels"`
+	Series  []SalesSeries    `json:"series"`
+	Rows    []SalesReportRow `json:"rows"`
+}
+
+func checkSalesReport(req SalesReportReq) ([]string, error) {
+	switch req.GroupBy {
+	case GroupByDay, GroupByWeek, GroupByMonth, GroupByAuctionLot, GroupByPaymentMethod, GroupByFulfillment:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGrouping, req.GroupBy)
+	}
+	if len(req.Metrics) == 0 {
+		return salesMetrics, nil
+	}
+	for _, metric := range req.Metrics {
+		if !slices.Contains(salesMetrics, metric) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownMetric, metric)
+		}
+	}
+	return req.Metrics, nil
+}
+
+// group key expression, periods are business time
+func salesGroupKey(groupBy string) any {
+	period := func(format string) bson.M {
+		return bson.M{"$dateToString": bson.M{"format": format, "date": "$time", "timezone": businessLocation.String()}}
+	}
+	switch groupBy {
+	case GroupByDay:
+		return period("%Y-%m-%d")
+	case GroupByWeek:
+		return period("%G-W%V")
+	case GroupByMonth:
+		return period("%Y-%m")
+	case GroupByAuctionLot:
+		return "$auctionLot"
+	case GroupByPaymentMethod:
+		return "$tenders.method"
+	default:
+		return bson.M{"$cond": bson.A{"$isShipping", "shipping", "pickup"}}
+	}
+}
+
+// aggregation of invoices into report rows, sorted by key
+// expects times stored as dates, see MigrateTimes
+func salesReportPipeline(req SalesReportReq, timeFilter bson.M) mongo.Pipeline {
+	match := bson.M{"status": bson.M{"$ne": StatusVoid}}
+	if len(req.Status) > 0 {
+		match["status"] = bson.M{"$in": req.Status, "$ne": StatusVoid}
+	}
+	if len(timeFilter) > 0 {
+		match["time"] = timeFilter
+	}
+	amounts := bson.M{
+		"gross":         centsExpr("$invoiceTotal"),
+		"refunds":       centsExpr("$refundTotal"),
+		"handlingFees":  centsExpr("$totalHandlingFee"),
+		"buyersPremium": centsExpr("$buyersPremium"),
+		"tax":           centsExpr("$tax"),
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$addFields", Value: amounts}},
+	}
+
+	// one document per tender, amounts split in proportion to what each tender paid
+	// invoices from before the ledger count under their payment method
+	if req.GroupBy == GroupByPaymentMethod {
+		paid := bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$payments", bson.A{}}},
+			"as":    "p",
+			"cond":  bson.M{"$ne": bson.A{"$$p.voided", true}},
+		}}
+		legacy := bson.M{"$ifNull": bson.A{"$paymentMethod", ""}}
+		pipeline = append(pipeline,
+			bson.D{{Key: "$addFields", Value: bson.M{"tenders": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{bson.M{"$size": paid}, 0}},
+				bson.M{"$map": bson.M{"input": paid, "as": "p", "in": bson.M{"method": "$$p.method", "amount": centsExpr("$$p.amount")}}},
+				bson.A{bson.M{
+					"method": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{legacy, ""}}, unpaidTender, legacy}},
+					"amount": "$gross",
+				}},
+			}}}}},
+			bson.D{{Key: "$addFields", Value: bson.M{"tenderTotal": bson.M{"$sum": "$tenders.amount"}}}},
+			bson.D{{Key: "$unwind", Value: "$tenders"}},
+			bson.D{{Key: "$addFields", Value: bson.M{"share": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$tenderTotal", 0}},
+				bson.M{"$divide": bson.A{"$tenders.amount", "$tenderTotal"}},
+				1,
+			}}}}},
+		)
+		shares := bson.M{}
+		for field := range amounts {
+			shares[field] = bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{"$" + field, "$share"}}, 0}}}
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: shares}})
+	}
+
+	group := bson.M{"_id": salesGroupKey(req.GroupBy), "invoiceCount": bson.M{"$sum": 1}}
+	for field := range amounts {
+		group[field] = bson.M{"$sum": "$" + field}
+	}
+	return append(pipeline,
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		bson.D{{Key: "$project", Value: bson.M{
+			"_id":           0,
+			"key":           bson.M{"$toString": "$_id"},
+			"gross":         1,
+			"refunds":       1,
+			"net":           bson.M{"$subtract": bson.A{"$gross", "$refunds"}},
+			"handlingFees":  1,
+			"buyersPremium": 1,
+			"tax":           1,
+			"invoiceCount":  1,
+		}}},
+	)
+}
+
+// every period label from the day of from through the day of to, nil when unbounded or too long
+func periodLabels(groupBy string, from Timestamp, to Timestamp) []string {
+	var layout func(Timestamp) string
+	switch groupBy {
+	case GroupByDay:
+		layout = func(t Timestamp) string { return t.Format("2006-01-02") }
+	case GroupByWeek:
+		layout = func(t Timestamp) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}
+	case GroupByMonth:
+		layout = func(t Timestamp) string { return t.Format("2006-01") }
+	default:
+		return nil
+	}
+	if from.IsZero() || to.IsZero() || to.Before(from.Time) {
+		return nil
+	}
+
+	labels := []string{}
+	day := startOfDay(from)
+	end := startOfDay(to)
+	for i := 0; !day.After(end.Time); i++ {
+		if i > maxReportPeriods {
+			return nil
+		}
+		label := layout(day)
+		if len(labels) == 0 || labels[len(labels)-1] != label {
+			labels = append(labels, label)
+		}
+		day = Timestamp{Time: day.AddDate(0, 0, 1)}
+	}
+	return labels
+}
+
+func metricValue(row SalesReportRow, metric string) any {
+	switch metric {
+	case MetricGross:
+		return row.Gross
+	case MetricRefunds:
+		return row.Refunds
+	case MetricNet:
+		return row.Net
+	case MetricHandlingFees:
+		return row.HandlingFees
+	case MetricBuyersPremium:
+		return row.BuyersPremium
+	case MetricTax:
+		return row.Tax
+	default:
+		return row.InvoiceCount
+	}
+}
+
+// chart series of the rows, periods without sales are filled with zero rows when labels are given
+func buildSalesReport(groupBy string, metrics []string, rows []SalesReportRow, labels []string) SalesReport {
+	if labels != nil {
+		byKey := map[string]SalesReportRow{}
+		for _, row := range rows {
+			byKey[row.Key] = row
+		}
+		filled := []SalesReportRow{}
+		for _, label := range labels {
+			row, found := byKey[label]
+			if !found {
+				row = SalesReportRow{Key: label}
+			}
+			filled = append(filled, row)
+		}
+		rows = filled
+	}
+
+	report := SalesReport{GroupBy: groupBy, Metrics: metrics, Labels: []string{}, Series: []SalesSeries{}, Rows: rows}
+	for _, row := range rows {
+		report.Labels = append(report.Labels, row.Key)
+	}
+	for _, metric := range metrics {
+		series := SalesSeries{Metric: metric, Data: []any{}}
+		for _, row := range rows {
+			series.Data = append(series.Data, metricValue(row, metric))
+		}
+		report.Series = append(report.Series, series)
+	}
+	return report
+}
+
+// sales totals over a date range grouped by period, auction lot, payment method or fulfillment
+func GetSalesReport(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		var req SalesReportReq
+		bindErr := c.ShouldBindJSON(&req)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+		metrics, err := checkSalesReport(req)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		timeFilter, err := timeRangeFilter(req.FromDate, req.ToDate)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusBadRequest, "Invalid Date Range")
+			return
+		}
+
+		cursor, err := collection.Aggregate(ctx, salesReportPipeline(req, timeFilter))
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Sales Report")
+			return
+		}
+		rows := []SalesReportRow{}
+		if err := cursor.All(ctx, &rows); err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Sales Report")
+			return
+		}
+
+		var labels []string
+		if from, ok := timeFilter["$gte"].(Timestamp); ok {
+			if to, ok := timeFilter["$lt"].(Timestamp); ok {
+				// $lt is the midnight after the last day
+				labels = periodLabels(req.GroupBy, from, Timestamp{Time: to.Add(-time.Second)})
+			}
+		}
+		c.JSON(http.StatusOK, buildSalesReport(req.GroupBy, metrics, rows, labels))
+	}
+}
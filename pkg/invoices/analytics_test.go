@@ -0,0 +1,51 @@
+package invoices
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCheckSalesReport(t *testing.T) {
+	metrics, err := checkSalesReport(SalesReportReq{GroupBy: GroupByMonth})
+	if err != nil || !slices.Equal(metrics, salesMetrics) {
+		t.Errorf("default metrics = %v, %v", metrics, err)
+	}
+	if _, err := checkSalesReport(SalesReportReq{GroupBy: "year"}); !errors.Is(err, ErrUnknownGrouping) {
+		t.Errorf("unknown grouping: got %v", err)
+	}
+	if _, err := checkSalesReport(SalesReportReq{GroupBy: GroupByDay, Metrics: []string{MetricNet, "profit"}}); !errors.Is(err, ErrUnknownMetric) {
+		t.Errorf("unknown metric: got %v", err)
+	}
+}
+
+func TestPeriodLabels(t *testing.T) {
+	day := func(year int, month time.Month, d int) Timestamp {
+		return NewTimestamp(time.Date(year, month, d, 12, 0, 0, 0, businessLocation))
+	}
+	if got := periodLabels(GroupByWeek, day(2024, 12, 28), day(2025, 1, 7)); !slices.Equal(got, []string{"2024-W52", "2025-W01", "2025-W02"}) {
+		t.Errorf("weeks = %v", got)
+	}
+	if got := periodLabels(GroupByMonth, day(2024, 11, 30), day(2025, 1, 1)); !slices.Equal(got, []string{"2024-11", "2024-12", "2025-01"}) {
+		t.Errorf("months = %v", got)
+	}
+	if got := periodLabels(GroupByAuctionLot, day(2024, 1, 1), day(2024, 2, 1)); got != nil {
+		t.Errorf("lots have no periods, got %v", got)
+	}
+}
+
+func TestBuildSalesReport(t *testing.T) {
+	rows := []SalesReportRow{{Key: "2024-06-03", Gross: 12000, Refunds: 2000, Net: 10000, InvoiceCount: 3}}
+	report := buildSalesReport(GroupByDay, []string{MetricNet, MetricInvoiceCount}, rows, []string{"2024-06-02", "2024-06-03"})
+
+	if !slices.Equal(report.Labels, []string{"2024-06-02", "2024-06-03"}) || len(report.Rows) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(report.Series) != 2 || report.Series[0].Metric != MetricNet {
+		t.Fatalf("series = %+v", report.Series)
+	}
+	if report.Series[0].Data[0] != Money(0) || report.Series[0].Data[1] != Money(10000) || report.Series[1].Data[1] != int64(3) {
+		t.Errorf("series data = %v %v", report.Series[0].Data, report.Series[1].Data)
+	}
+}
@@ -0,0 +1,252 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// carries hub messages between instances of the server
+// a subscriber may get its own messages back, the hub skips them
+type Broker interface {
+	Publish(ctx context.Context, msg BrokerMessage) error
+	// call deliver for every published message until ctx ends or the subscription fails
+	Subscribe(ctx context.Context, deliver func(msg BrokerMessage)) error
+}
+
+// one hub message on the wire, exactly one of Room, Client or Caller says where it goes
+type BrokerMessage struct {
+	// instance that published it
+	Origin string `json:"origin" bson:"origin"`
+	// room to fan out to, with Except left out, empty with no Client or Caller for every client
+	Room   string `json:"room,omitempty" bson:"room,omitempty"`
+	Except string `json:"except,omitempty" bson:"except,omitempty"`
+	// id of the one client it is for
+	Client string `json:"client,omitempty" bson:"client,omitempty"`
+	// a client message for the instance that owns its signature session
+	Caller *wsCaller `json:"caller,omitempty" bson:"caller,omitempty"`
+	// the marshalled message, without seq
+	Payload   []byte    `json:"payload" bson:"payload"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// broker between hubs of one process, for tests and single instance runs
+type MemoryBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan BrokerMessage]bool
+}
+
+// messages buffered per memory subscriber, a subscriber further behind misses messages
+const memoryBrokerBuffer = 256
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: map[chan BrokerMessage]bool{}}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- msg:
+		default:
+			fmt.Println("memory broker subscriber too slow, message dropped")
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, deliver func(msg BrokerMessage)) error {
+	messages := make(chan BrokerMessage, memoryBrokerBuffer)
+	b.mu.Lock()
+	b.subscribers[messages] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscribers, messages)
+		b.mu.Unlock()
+	}()
+	for {
+		select {
+		case msg := <-messages:
+			deliver(msg)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// broker on a mongodb collection, published messages are inserted and read back from a change stream
+// change streams need a replica set, a single node one is enough
+type MongoBroker struct {
+	collection *mongo.Collection
+	// where a failed subscription picks up again
+	resumeToken bson.Raw
+}
+
+// time a published message is kept in the collection
+const mongoBrokerTTL = 5 * time.Minute
+
+func NewMongoBroker(ctx context.Context, collection *mongo.Collection) (*MongoBroker, error) {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(mongoBrokerTTL / time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MongoBroker{collection: collection}, nil
+}
+
+func (b *MongoBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	msg.CreatedAt = time.Now()
+	_, err := b.collection.InsertOne(ctx, msg)
+	return err
+}
+
+// server errors of a resume token the oplog no longer covers
+var staleResumeTokenCodes = []int{
+	260, // InvalidResumeToken
+	280, // ChangeStreamFatalError
+	286, // ChangeStreamHistoryLost
+}
+
+// true when a change stream cannot pick up from its resume token and has to start over
+func staleResumeToken(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	for _, code := range staleResumeTokenCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *MongoBroker) watch(ctx context.Context) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream()
+	if b.resumeToken != nil {
+		opts.SetResumeAfter(b.resumeToken)
+	}
+	return b.collection.Watch(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}},
+	}, opts)
+}
+
+// messages published while the stream could not resume are missed, clients catch up when they resume
+func (b *MongoBroker) Subscribe(ctx context.Context, deliver func(msg BrokerMessage)) error {
+	stream, err := b.watch(ctx)
+	if err != nil && staleResumeToken(err) {
+		fmt.Println("broker resume token lost, starting a new stream:", err)
+		b.resumeToken = nil
+		stream, err = b.watch(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	for stream.Next(ctx) {
+		var event struct {
+			FullDocument BrokerMessage `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			fmt.Println("broker decode:", err)
+		} else {
+			deliver(event.FullDocument)
+		}
+		b.resumeToken = stream.ResumeToken()
+	}
+	if err := stream.Err(); err != nil {
+		// the next subscription starts a new stream
+		if staleResumeToken(err) {
+			b.resumeToken = nil
+		}
+		return err
+	}
+	return nil
+}
+
+// time between attempts to subscribe again after the subscription failed
+const brokerRetryWait = time.Second
+
+// fan the hub's messages out through broker and deliver those of other instances
+// session commands from other instances go to commands, runs until ctx ends
+func (h *Hub) UseBroker(ctx context.Context, broker Broker, commands func(msg BrokerMessage)) {
+	h.mu.Lock()
+	h.broker = broker
+	h.commands = commands
+	h.mu.Unlock()
+	go func() {
+		for ctx.Err() == nil {
+			err := broker.Subscribe(ctx, h.receive)
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("broker subscribe:", err)
+			time.Sleep(brokerRetryWait)
+		}
+	}()
+}
+
+// true when other instances may hold clients and sessions
+func (h *Hub) Distributed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.broker != nil
+}
+
+// hand msg to the other instances, when there is a broker
+func (h *Hub) publish(msg BrokerMessage, payload Message) {
+	h.mu.RLock()
+	broker := h.broker
+	h.mu.RUnlock()
+	if broker == nil {
+		return
+	}
+	data, ok := marshalMessage(payload)
+	if !ok {
+		return
+	}
+	msg.Origin = h.origin
+	msg.Payload = data
+	if err := broker.Publish(context.Background(), msg); err != nil {
+		fmt.Println("broker publish:", err)
+	}
+}
+
+// deliver a message of another instance to the clients here
+func (h *Hub) receive(msg BrokerMessage) {
+	if msg.Origin == h.origin {
+		return
+	}
+	if msg.Caller != nil {
+		h.mu.RLock()
+		commands := h.commands
+		h.mu.RUnlock()
+		if commands != nil {
+			commands(msg)
+		}
+		return
+	}
+	payload, err := unmarshalMessage(msg.Payload)
+	if err != nil {
+		fmt.Println("broker payload:", err)
+		return
+	}
+	switch {
+	case msg.Client != "":
+		h.sendLocal(msg.Client, payload)
+	case msg.Room != "":
+		h.broadcastLocal(msg.Room, payload, msg.Except)
+	default:
+		h.broadcastAllLocal(payload)
+	}
+}
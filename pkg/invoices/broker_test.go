@@ -0,0 +1,93 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// two hubs sharing a memory broker, like two instances behind a load balancer
+func brokeredHubs(t *testing.T) (*Hub, *Hub, chan BrokerMessage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	broker := NewMemoryBroker()
+	commands := make(chan BrokerMessage, 1)
+	first, second := NewHub(), NewHub()
+	first.UseBroker(ctx, broker, nil)
+	second.UseBroker(ctx, broker, func(msg BrokerMessage) { commands <- msg })
+	for {
+		broker.mu.Lock()
+		subscribed := len(broker.subscribers) == 2
+		broker.mu.Unlock()
+		if subscribed {
+			return first, second, commands
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, client *Client) string {
+	select {
+	case msg := <-client.send:
+		return string(msg)
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+		return ""
+	}
+}
+
+func TestBrokerFanOut(t *testing.T) {
+	first, second, commands := brokeredHubs(t)
+	staff, pad, otherPad := hubClient(first), hubClient(second), hubClient(second)
+	first.Join(staff, counterRoom("front"))
+	second.Join(pad, counterRoom("front"))
+	second.Join(otherPad, counterRoom("back"))
+
+	if n := first.Broadcast(counterRoom("front"), Message{Type: InitSignature}, staff); n != 0 {
+		t.Errorf("delivered to %d local clients", n)
+	}
+	if msg := receive(t, pad); !strings.Contains(msg, InitSignature) || !strings.Contains(msg, `"seq":1`) {
+		t.Errorf("pad got %s", msg)
+	}
+	second.Broadcast(counterRoom("front"), Message{Type: SignatureStatus}, pad)
+	first.SendTo(pad.id, Message{Type: AckMessage})
+	if msg := receive(t, pad); !strings.Contains(msg, AckMessage) {
+		t.Errorf("pad got %s", msg)
+	}
+	// the staff client heard the other instance's status, and its own broadcasts once
+	if msg := receive(t, staff); !strings.Contains(msg, SignatureStatus) {
+		t.Errorf("staff got %s", msg)
+	}
+	first.BroadcastAll(Message{Type: ImportDone})
+	if msg := receive(t, otherPad); !strings.Contains(msg, ImportDone) || len(staff.send) != 1 || len(pad.send) != 1 {
+		t.Errorf("other pad got %s, staff %d, pad %d queued", msg, len(staff.send), len(pad.send))
+	}
+
+	caller := wsCaller{ClientID: "pad-on-first", Identity: wsIdentity{Role: RolePad}, Counters: []string{"front"}}
+	if !first.Forward(caller, Message{Type: SubmitSignature}) || NewHub().Forward(caller, Message{}) {
+		t.Error("forward with and without a broker")
+	}
+	select {
+	case msg := <-commands:
+		if msg.Caller.ClientID != caller.ClientID || msg.Caller.Counters[0] != "front" {
+			t.Errorf("forwarded %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("command not forwarded")
+	}
+}
+
+func TestStaleResumeToken(t *testing.T) {
+	lost := mongo.CommandError{Code: 286, Name: "ChangeStreamHistoryLost"}
+	if !staleResumeToken(fmt.Errorf("watch: %w", lost)) {
+		t.Error("history lost should start a new stream")
+	}
+	if staleResumeToken(mongo.CommandError{Code: 11600, Name: "InterruptedAtShutdown"}) || staleResumeToken(errors.New("network")) {
+		t.Error("other errors should resume")
+	}
+}
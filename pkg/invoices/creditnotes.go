@@ -0,0 +1,229 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// credit note status
+const (
+	CreditNoteIssued string = "issued"
+	CreditNoteVoid   string = "void"
+)
+
+// counter document numbering credit notes
+const creditNoteCounter string = "creditNote"
+
+// document handed to the buyer for refunded items, linked to its invoice by number and auction lot
+type CreditNote struct {
+	CreditNoteNumber string        `json:"creditNoteNumber" bson:"creditNoteNumber"`
+	InvoiceNumber    string        `json:"invoiceNumber" bson:"invoiceNumber"`
+	AuctionLot       int           `json:"auctionLot" bson:"auctionLot"`
+	BuyerName        string        `json:"buyerName" bson:"buyerName"`
+	BuyerEmail       string        `json:"buyerEmail" bson:"buyerEmail"`
+	Time             Timestamp     `json:"time" bson:"time"`
+	Status           string        `json:"status" bson:"status"`
+	Items            []InvoiceItem `json:"items" bson:"items"`
+	RefundIDs        []string      `json:"refundIds" bson:"refundIds"`
+	Subtotal         Money         `json:"subtotal" bson:"subtotal"`
+	TotalHandlingFee Money         `json:"totalHandlingFee" bson:"totalHandlingFee"`
+	BuyersPremium    Money         `json:"buyersPremium" bson:"buyersPremium"`
+	TaxBreakdown     []TaxLine     `json:"taxBreakdown" bson:"taxBreakdown"`
+	Total            Money         `json:"total" bson:"total"`
+	CreatedBy        string        `json:"createdBy" bson:"createdBy"`
+	VoidedBy         string        `json:"voidedBy,omitempty" bson:"voidedBy,omitempty"`
+	VoidReason       string        `json:"voidReason,omitempty" bson:"voidReason,omitempty"`
+}
+
+var ErrCreditNoteNotFound = errors.New("credit note not found")
+
+// next number of a named sequence, "CN-000042" style
+func nextSequence(ctx context.Context, counters *mongo.Collection, name string) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := counters.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Seq, err
+}
+
+// credit note content for refund records of an invoice, without a number
+func creditNoteFromRefunds(invoice Invoice, records []RefundRecord, actor string) CreditNote {
+	note := CreditNote{
+		InvoiceNumber: invoice.InvoiceNumber,
+		AuctionLot:    invoice.AuctionLot,
+		BuyerName:     invoice.BuyerName,
+		BuyerEmail:    invoice.BuyerEmail,
+		Time:          eventTime(),
+		Status:        CreditNoteIssued,
+		Items:         []InvoiceItem{},
+		RefundIDs:     []string{},
+		CreatedBy:     actor,
+	}
+	// tax components in the order they first appear
+	var taxes []TaxLine
+	for _, record := range records {
+		note.Items = append(note.Items, InvoiceItem{
+			Sku:           record.Sku,
+			ItemLot:       record.ItemLot,
+			Desc:          record.Desc,
+			Unit:          record.Quantity,
+			Bid:           record.Bid.Mul(1 / float64(record.Quantity)),
+			ExtendedPrice: record.Bid,
+			HandlingFee:   record.HandlingFee,
+		})
+		note.RefundIDs = append(note.RefundIDs, record.RefundID)
+		note.Subtotal += record.Bid
+		note.TotalHandlingFee += record.HandlingFee
+		note.BuyersPremium += record.BuyersPremium
+		for _, tax := range record.Taxes {
+			found := false
+			for i := range taxes {
+				if taxes[i].Name == tax.Name {
+					taxes[i].Amount += tax.Amount
+					found = true
+				}
+			}
+			if !found {
+				taxes = append(taxes, tax)
+			}
+		}
+		note.Total += record.Amount
+	}
+	note.TaxBreakdown = taxes
+	return note
+}
+
+// number and store a credit note
+func issueCreditNote(ctx context.Context, creditNotes *mongo.Collection, counters *mongo.Collection, note CreditNote) (CreditNote, error) {
+	seq, err := nextSequence(ctx, counters, creditNoteCounter)
+	if err != nil {
+		return note, err
+	}
+	note.CreditNoteNumber = fmt.Sprintf("CN-%06d", seq)
+	_, err = creditNotes.InsertOne(ctx, note)
+	return note, err
+}
+
+// credit notes of an invoice, oldest first
+func findCreditNotes(ctx context.Context, creditNotes *mongo.Collection, filter bson.M) ([]CreditNote, error) {
+	cursor, err := creditNotes.Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "creditNoteNumber", Value: 1}}).SetProjection(bson.M{"_id": 0}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	notes := []CreditNote{}
+	err = cursor.All(ctx, &notes)
+	return notes, err
+}
+
+// list credit notes, all or the ones of one invoice
+// query: invoiceNumber, auctionLot
+func GetCreditNotes(creditNotes *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := bson.M{}
+		if invoiceNumber := c.Query("invoiceNumber"); invoiceNumber != "" {
+			filter["invoiceNumber"] = invoiceNumber
+		}
+		if lot := c.Query("auctionLot"); lot != "" {
+			auctionLot, err := strconv.Atoi(lot)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Invalid Auction Lot")
+				return
+			}
+			filter["auctionLot"] = auctionLot
+		}
+
+		notes, err := findCreditNotes(context.Background(), creditNotes, filter)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Credit Notes")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": notes})
+	}
+}
+
+// one credit note by number
+func GetCreditNote(creditNotes *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var note CreditNote
+		err := creditNotes.FindOne(
+			context.Background(),
+			bson.M{"creditNoteNumber": c.Param("creditNoteNumber")},
+			options.FindOne().SetProjection(bson.M{"_id": 0}),
+		).Decode(&note)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.String(http.StatusNotFound, ErrCreditNoteNotFound.Error())
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Credit Note")
+			return
+		}
+		c.JSON(http.StatusOK, note)
+	}
+}
+
+type VoidCreditNoteReq struct {
+	CreditNoteNumber string `json:"creditNoteNumber" binding:"required"`
+	Reason           string `json:"reason" binding:"required"`
+}
+
+// void an issued credit note, e.g. to reissue it
+// the refunds it lists stay on the invoice
+func VoidCreditNote(creditNotes *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		var req VoidCreditNoteReq
+		bindErr := c.ShouldBindJSON(&req)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+
+		var note CreditNote
+		err := creditNotes.FindOneAndUpdate(
+			ctx,
+			bson.M{"creditNoteNumber": req.CreditNoteNumber, "status": CreditNoteIssued},
+			bson.M{"$set": bson.M{
+				"status":     CreditNoteVoid,
+				"voidedBy":   c.GetString("uid"),
+				"voidReason": req.Reason,
+			}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"_id": 0}),
+		).Decode(&note)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			count, _ := creditNotes.CountDocuments(ctx, bson.M{"creditNoteNumber": req.CreditNoteNumber})
+			if count == 0 {
+				c.String(http.StatusNotFound, ErrCreditNoteNotFound.Error())
+				return
+			}
+			c.String(http.StatusConflict, "Credit Note Already Void")
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Void Credit Note")
+			return
+		}
+		c.JSON(http.StatusOK, note)
+	}
+}
@@ -0,0 +1,25 @@
+package invoices
+
+import "testing"
+
+func TestCreditNoteFromRefunds(t *testing.T) {
+	invoice := Invoice{InvoiceNumber: "10240", AuctionLot: 64, BuyerName: "Maria Rossi"}
+	records := []RefundRecord{
+		{RefundID: "a", Sku: 1, Quantity: 2, Bid: 4000, HandlingFee: 500, BuyersPremium: 250, Tax: 325, Taxes: []TaxLine{{Name: "HST", Amount: 325}}, Amount: 5075},
+		{RefundID: "b", Sku: 2, Quantity: 1, Bid: 1000, BuyersPremium: 50, Tax: 130, Taxes: []TaxLine{{Name: "HST", Amount: 130}}, Amount: 1180},
+	}
+	note := creditNoteFromRefunds(invoice, records, "uid")
+
+	if note.InvoiceNumber != "10240" || note.AuctionLot != 64 || note.Status != CreditNoteIssued {
+		t.Errorf("credit note not linked to invoice: %+v", note)
+	}
+	if len(note.Items) != 2 || note.Items[0].Bid != 2000 || note.Items[0].Unit != 2 {
+		t.Errorf("credit note items = %+v", note.Items)
+	}
+	if note.Subtotal != 5000 || note.TotalHandlingFee != 500 || note.BuyersPremium != 300 || note.Total != 6255 {
+		t.Errorf("credit note totals = %+v", note)
+	}
+	if len(note.TaxBreakdown) != 1 || note.TaxBreakdown[0].Amount != 455 {
+		t.Errorf("credit note tax = %+v", note.TaxBreakdown)
+	}
+}
@@ -0,0 +1,116 @@
+package invoices
+
+// severity of a parse diagnostic
+const (
+	SeverityWarning string = "warning"
+	SeverityError   string = "error"
+)
+
+// overall status of one parsed invoice
+const (
+	ParseStatusOK      string = "ok"
+	ParseStatusWarning string = "warning"
+	ParseStatusError   string = "error"
+)
+
+// longest raw text kept in a diagnostic snippet
+const maxSnippetLength = 120
+
+// one problem found while extracting a field from invoice text
+type Diagnostic struct {
+	Field    string `json:"field"`
+	Snippet  string `json:"snippet"`
+	Reason   string `json:"reason"`
+	Severity string `json:"severity"`
+	// how much the extracted value can be trusted, 0 means not extracted
+	Confidence float32 `json:"confidence"`
+	// line of the import file the value came from, 0 for pdfs
+	Row int `json:"row,omitempty"`
+}
+
+type Diagnostics []Diagnostic
+
+func truncateSnippet(snippet string) string {
+	runes := []rune(snippet)
+	if len(runes) > maxSnippetLength {
+		return string(runes[:maxSnippetLength]) + "..."
+	}
+	return snippet
+}
+
+// record a value that was extracted but may be wrong
+func (d *Diagnostics) Warn(field string, snippet string, reason string, confidence float32) {
+	*d = append(*d, Diagnostic{
+		Field:      field,
+		Snippet:    truncateSnippet(snippet),
+		Reason:     reason,
+		Severity:   SeverityWarning,
+		Confidence: confidence,
+	})
+}
+
+// record a value that could not be extracted
+func (d *Diagnostics) Error(field string, snippet string, reason string) {
+	*d = append(*d, Diagnostic{
+		Field:    field,
+		Snippet:  truncateSnippet(snippet),
+		Reason:   reason,
+		Severity: SeverityError,
+	})
+}
+
+// warning about a value read from one row of an import file
+func (d *Diagnostics) RowWarn(row int, field string, snippet string, reason string, confidence float32) {
+	d.Warn(field, snippet, reason, confidence)
+	(*d)[len(*d)-1].Row = row
+}
+
+// value of one row of an import file that could not be read
+func (d *Diagnostics) RowError(row int, field string, snippet string, reason string) {
+	d.Error(field, snippet, reason)
+	(*d)[len(*d)-1].Row = row
+}
+
+// worst severity wins
+func (d Diagnostics) Status() string {
+	status := ParseStatusOK
+	for _, diag := range d {
+		if diag.Severity == SeverityError {
+			return ParseStatusError
+		}
+		status = ParseStatusWarning
+	}
+	return status
+}
+
+// parsed invoice with everything that went wrong extracting it
+type ParseResult struct {
+	Invoice     Invoice
+	Template    string
+	Diagnostics Diagnostics
+}
+
+// review summary returned with each invoice from createInvoiceFromPdf
+type ParseReport struct {
+	FileName      string      `json:"fileName"`
+	Template      string      `json:"template"`
+	InvoiceNumber string      `json:"invoiceNumber"`
+	Status        string      `json:"status"`
+	Diagnostics   Diagnostics `json:"diagnostics"`
+	// lines of the import file the invoice was built from, empty for pdfs
+	Rows []int `json:"rows,omitempty"`
+}
+
+func (r ParseResult) Report(fileName string) ParseReport {
+	diagnostics := r.Diagnostics
+	if diagnostics == nil {
+		diagnostics = Diagnostics{}
+	}
+	return ParseReport{
+		FileName:      fileName,
+		Template:      r.Template,
+		InvoiceNumber: r.Invoice.InvoiceNumber,
+		Status:        diagnostics.Status(),
+		Diagnostics:   diagnostics,
+	}
+}
@@ -0,0 +1,233 @@
+package invoices
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// export file formats
+const (
+	ExportCSV  string = "csv"
+	ExportXLSX string = "xlsx"
+)
+
+// export row layouts
+const (
+	ExportInvoiceRows string = "invoice"
+	ExportItemRows    string = "item"
+)
+
+// invoices fetched from mongodb per round trip while exporting
+const exportBatchSize int32 = 200
+
+// same filter as the paged list, rows default to one per invoice
+// timeOrder 1 is oldest first, anything else newest first
+type ExportInvoicesReq struct {
+	Filter    InvoiceFilter `json:"filter" binding:"required"`
+	Format    string        `json:"format" binding:"required,oneof=csv xlsx"`
+	Rows      string        `json:"rows" binding:"omitempty,oneof=invoice item"`
+	TimeOrder int           `json:"timeOrder"`
+}
+
+var invoiceExportHeader = []string{
+	"Invoice Number", "Auction Lot", "Time", "Status", "Buyer Name", "Buyer Email", "Buyer Phone", "Buyer Address",
+	"Fulfillment", "Shipping Address", "Items", "Handling Fees", "Buyer's Premium", "Tax", "Invoice Total",
+	"Tenders", "Paid", "Refunded", "Balance",
+}
+
+var itemExportHeader = []string{
+	"Invoice Number", "Auction Lot", "Time", "Status", "Buyer Name", "Item Lot", "Sku", "Description",
+	"Shelf Location", "Units", "Msrp", "Bid", "Extended Price", "Handling Fee", "Refunded Units",
+}
+
+// destination of export rows, csv or xlsx
+type exportWriter interface {
+	WriteRow(cells []any) error
+	Close() error
+}
+
+// csv rows with money as plain two decimal numbers
+type csvExportWriter struct {
+	csv *csv.Writer
+}
+
+func (w *csvExportWriter) WriteRow(cells []any) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		switch v := cell.(type) {
+		case float32:
+			record[i] = strconv.FormatFloat(float64(v), 'f', -1, 32)
+		case string:
+			record[i] = escapeFormula(v)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return w.csv.Write(record)
+}
+
+// quote text a spreadsheet would run as a formula, e.g. a buyer named "=HYPERLINK(...)"
+func escapeFormula(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+func (w *csvExportWriter) Close() error {
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+func newExportWriter(w io.Writer, format string, header []string) (exportWriter, error) {
+	if format == ExportXLSX {
+		return newXLSXWriter(w, "Invoices", header)
+	}
+	writer := &csvExportWriter{csv: csv.NewWriter(w)}
+	cells := make([]any, len(header))
+	for i, name := range header {
+		cells[i] = name
+	}
+	return writer, writer.WriteRow(cells)
+}
+
+// tenders of an invoice, e.g. "card 20.00; cash 5.00"
+func tenderSummary(invoice Invoice) string {
+	tenders := invoiceTenders(invoice)
+	methods := make([]string, 0, len(tenders))
+	for method := range tenders {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	parts := make([]string, len(methods))
+	for i, method := range methods {
+		parts[i] = method + " " + tenders[method].String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+func fulfillment(invoice Invoice) string {
+	if invoice.IsShipping {
+		return "shipping"
+	}
+	return "pickup"
+}
+
+// export rows of one invoice in the requested layout
+func exportRows(invoice Invoice, rows string) [][]any {
+	if rows != ExportItemRows {
+		return [][]any{{
+			invoice.InvoiceNumber, invoice.AuctionLot, invoice.Time.String(), string(invoice.Status),
+			invoice.BuyerName, invoice.BuyerEmail, invoice.BuyerPhone, invoice.BuyerAddress,
+			fulfillment(invoice), invoice.ShippingAddress, len(invoice.Items), invoice.TotalHandlingFee,
+			invoice.BuyersPremium, invoice.Tax, invoice.InvoiceTotal,
+			tenderSummary(invoice), invoice.PaidAmount(), invoice.RefundTotal, invoice.RemainingBalance,
+		}}
+	}
+
+	records := [][]any{}
+	for _, item := range invoice.Items {
+		records = append(records, []any{
+			invoice.InvoiceNumber, invoice.AuctionLot, invoice.Time.String(), string(invoice.Status),
+			invoice.BuyerName, item.ItemLot, item.Sku, item.Desc,
+			item.ShelfLocation, itemUnits(item), item.Msrp, item.Bid, item.ExtendedPrice, item.HandlingFee,
+			refundedUnits(invoice, item.ItemLot),
+		})
+	}
+	return records
+}
+
+// stream every invoice of the cursor as rows, returns the number of invoices written
+func writeExport(ctx context.Context, cursor *mongo.Cursor, writer exportWriter, rows string) (int, error) {
+	count := 0
+	for cursor.Next(ctx) {
+		var invoice Invoice
+		if err := cursor.Decode(&invoice); err != nil {
+			return count, err
+		}
+		for _, record := range exportRows(invoice, rows) {
+			if err := writer.WriteRow(record); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+	return count, writer.Close()
+}
+
+// download the filtered invoice list as csv or xlsx
+// rows are streamed as the cursor is read, the response status is sent before the first row
+func ExportInvoices(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		var req ExportInvoicesReq
+		bindErr := c.ShouldBindJSON(&req)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+		fil, err := invoiceListFilter(req.Filter)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		order := -1
+		if req.TimeOrder == 1 {
+			order = 1
+		}
+		cursor, err := collection.Find(
+			ctx,
+			fil,
+			options.Find().
+				SetSort(bson.D{{Key: "time", Value: order}}).
+				SetProjection(bson.M{"_id": 0, "invoiceEvent": 0}).
+				SetBatchSize(exportBatchSize),
+		)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get From Database")
+			return
+		}
+		defer cursor.Close(ctx)
+
+		header := invoiceExportHeader
+		if req.Rows == ExportItemRows {
+			header = itemExportHeader
+		}
+		contentType := "text/csv; charset=utf-8"
+		if req.Format == ExportXLSX {
+			contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		}
+		fileName := fmt.Sprintf("invoices-%s.%s", time.Now().In(businessLocation).Format("20060102-150405"), req.Format)
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+		c.Status(http.StatusOK)
+
+		writer, err := newExportWriter(c.Writer, req.Format, header)
+		if err == nil {
+			_, err = writeExport(ctx, cursor, writer, req.Rows)
+		}
+		// headers are gone, a cut off file is all the client can get
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Println("export stopped:", err.Error())
+		}
+	}
+}
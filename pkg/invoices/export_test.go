@@ -0,0 +1,105 @@
+package invoices
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strings"
+	"testing"
+)
+
+func exportTestInvoice() Invoice {
+	return Invoice{
+		InvoiceNumber: "10240",
+		AuctionLot:    64,
+		BuyerName:     `Maria "Mia" Rossi`,
+		Status:        StatusPaid,
+		InvoiceTotal:  3051,
+		Payments:      []Payment{{Method: TenderCash, Amount: 1051}, {Method: TenderCard, Amount: 2000}},
+		Items: []InvoiceItem{
+			{ItemLot: 1, Sku: 120001, Desc: "Drill & bits", Unit: 2, Bid: 1000},
+			{ItemLot: 2, Sku: 120002, Desc: "Lamp", Unit: 1, Bid: 500},
+		},
+		Refunds: []RefundRecord{{Sku: 120001, ItemLot: 1, Quantity: 1}},
+	}
+}
+
+func TestCSVExport(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := newExportWriter(&out, ExportCSV, itemExportHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range exportRows(exportTestInvoice(), ExportItemRows) {
+		writer.WriteRow(record)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0][0] != "Invoice Number" {
+		t.Fatalf("records = %v", records)
+	}
+	// name, units, bid and refunded units of the first item
+	if got := records[1]; got[4] != `Maria "Mia" Rossi` || got[9] != "2" || got[11] != "10.00" || got[14] != "1" {
+		t.Errorf("item row = %v", got)
+	}
+
+	rows := exportRows(exportTestInvoice(), ExportInvoiceRows)
+	if len(rows) != 1 || rows[0][15] != "card 20.00; cash 10.51" || rows[0][16] != Money(3051) {
+		t.Errorf("invoice row = %v", rows)
+	}
+
+	// text a spreadsheet would run is quoted, negative amounts are not
+	out.Reset()
+	writer = &csvExportWriter{csv: csv.NewWriter(&out)}
+	writer.WriteRow([]any{"=HYPERLINK(A1)", "+1 416", "@SUM(A1)", "-x", "Ann", Money(-500)})
+	writer.Close()
+	if got := out.String(); got != "'=HYPERLINK(A1),'+1 416,'@SUM(A1),'-x,Ann,-5.00\n" {
+		t.Errorf("escaped row = %q", got)
+	}
+}
+
+func TestXLSXExport(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := newExportWriter(&out, ExportXLSX, invoiceExportHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range exportRows(exportTestInvoice(), ExportInvoiceRows) {
+		writer.WriteRow(record)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sheet string
+	for _, f := range archive.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			r, _ := f.Open()
+			data, _ := io.ReadAll(r)
+			sheet = string(data)
+		}
+	}
+	for _, want := range []string{
+		`<c r="A1" t="inlineStr" s="2"><is><t xml:space="preserve">Invoice Number</t></is></c>`,
+		`<t xml:space="preserve">Maria &#34;Mia&#34; Rossi</t>`,
+		`<c r="O2" s="1"><v>30.51</v></c>`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("sheet missing %s", want)
+		}
+	}
+	if xlsxColumn(0) != "A" || xlsxColumn(25) != "Z" || xlsxColumn(26) != "AA" || xlsxColumn(701) != "ZZ" {
+		t.Error("column names")
+	}
+}
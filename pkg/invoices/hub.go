@@ -0,0 +1,470 @@
+package invoices
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// websocket keepalive, queue and resume settings
+type WsConfig struct {
+	// a connection that sends no pong or message for this long is dead
+	PongWait time.Duration
+	// time between pings, below PongWait
+	PingPeriod time.Duration
+	// time allowed to write one message to a client
+	WriteWait time.Duration
+	// messages queued per connection, a client that falls further behind is evicted
+	SendBuffer int
+	// time a disconnected client may come back with its resume token
+	ResumeWindow time.Duration
+	// last messages kept per client and replayed on resume
+	ResumeBuffer int
+}
+
+func DefaultWsConfig() WsConfig {
+	return WsConfig{
+		PongWait:     60 * time.Second,
+		PingPeriod:   54 * time.Second,
+		WriteWait:    10 * time.Second,
+		SendBuffer:   32,
+		ResumeWindow: 2 * time.Minute,
+		ResumeBuffer: 64,
+	}
+}
+
+// time allowed to write the close or auth error frame
+const wsWriteWait = 10 * time.Second
+
+// room every staff client is in, server side events like import progress go there
+const staffRoom = "staff"
+
+// room of the signature pad at a store counter
+func counterRoom(counter string) string {
+	return "counter:" + counter
+}
+
+// room of the staff following one invoice's signature
+func invoiceRoom(invoiceNumber string) string {
+	return "invoice:" + invoiceNumber
+}
+
+// a message queued for a client, seq orders every message of the hub
+type queuedMessage struct {
+	seq  uint64
+	data []byte
+}
+
+// one client of the hub, it outlives its connection for the resume window
+// the connection, its queue and the backlog are guarded by the hub
+type Client struct {
+	id          string
+	identity    wsIdentity
+	resumeToken string
+	// current connection, only its writePump writes to it
+	conn *websocket.Conn
+	// queue of the current connection, nil while detached
+	send chan []byte
+	// rooms the client is in
+	rooms map[string]bool
+	// last messages queued for the client, oldest first
+	backlog []queuedMessage
+	// seq of the newest message that fell out of the backlog
+	lost uint64
+	// unregisters a detached client once the resume window is over
+	expiry *time.Timer
+}
+
+func newClient(conn *websocket.Conn, identity wsIdentity) *Client {
+	return &Client{
+		id:          uuid.NewString(),
+		identity:    identity,
+		resumeToken: uuid.NewString(),
+		conn:        conn,
+		rooms:       map[string]bool{},
+	}
+}
+
+// connected and recently disconnected clients and the rooms they joined
+// sends never block, a client whose queue is full is evicted and may resume
+// with a broker, room messages also reach the clients of the other instances
+type Hub struct {
+	mu      sync.RWMutex
+	config  WsConfig
+	seq     uint64
+	clients map[*Client]bool
+	rooms   map[string]map[*Client]bool
+	// clients by resume token
+	resumable map[string]*Client
+	// id of this instance on the broker
+	origin   string
+	broker   Broker
+	commands func(msg BrokerMessage)
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		origin:    uuid.NewString(),
+		config:    DefaultWsConfig(),
+		clients:   map[*Client]bool{},
+		rooms:     map[string]map[*Client]bool{},
+		resumable: map[string]*Client{},
+	}
+}
+
+// hub behind /ws
+var wsHub = NewHub()
+
+// change the hub settings, zero fields keep the current value
+// connections opened before keep their queue size
+func (h *Hub) SetConfig(cfg WsConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cfg.PongWait > 0 {
+		h.config.PongWait = cfg.PongWait
+	}
+	if cfg.PingPeriod > 0 {
+		h.config.PingPeriod = cfg.PingPeriod
+	}
+	if h.config.PingPeriod >= h.config.PongWait {
+		h.config.PingPeriod = h.config.PongWait * 9 / 10
+	}
+	if cfg.WriteWait > 0 {
+		h.config.WriteWait = cfg.WriteWait
+	}
+	if cfg.SendBuffer > 0 {
+		h.config.SendBuffer = cfg.SendBuffer
+	}
+	if cfg.ResumeWindow > 0 {
+		h.config.ResumeWindow = cfg.ResumeWindow
+	}
+	if cfg.ResumeBuffer > 0 {
+		h.config.ResumeBuffer = cfg.ResumeBuffer
+	}
+}
+
+// configure the /ws hub, zero fields keep the default
+func SetWsConfig(cfg WsConfig) {
+	wsHub.SetConfig(cfg)
+}
+
+func (h *Hub) Config() WsConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config
+}
+
+// add a client with its connection, returns the queue its writePump drains
+func (h *Hub) Register(client *Client) <-chan []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client.send = make(chan []byte, h.config.SendBuffer)
+	h.clients[client] = true
+	h.resumable[client.resumeToken] = client
+	return client.send
+}
+
+// give a detached, or not yet detached, client a new connection
+// returns the messages after lastSeq to write before the queue, false when the token is unknown,
+// belongs to someone else or messages after lastSeq were already lost
+func (h *Hub) Resume(token string, lastSeq uint64, identity wsIdentity, conn *websocket.Conn) (*Client, <-chan []byte, [][]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.resumable[token]
+	if !ok || client.identity != identity || lastSeq < client.lost || lastSeq > h.seq {
+		return nil, nil, nil, false
+	}
+	// the old connection may not have noticed it is gone yet
+	h.detach(client)
+	if client.expiry != nil {
+		client.expiry.Stop()
+		client.expiry = nil
+	}
+	var replay [][]byte
+	for _, queued := range client.backlog {
+		if queued.seq > lastSeq {
+			replay = append(replay, queued.data)
+		}
+	}
+	client.conn = conn
+	client.send = make(chan []byte, h.config.SendBuffer)
+	return client, client.send, replay, true
+}
+
+// the connection is gone, keep the client for the resume window
+// does nothing when the client already moved to another connection
+func (h *Hub) Detach(client *Client, conn *websocket.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.clients[client] || client.conn != conn {
+		return
+	}
+	h.detach(client)
+}
+
+// caller holds the write lock
+func (h *Hub) detach(client *Client) {
+	if client.send == nil {
+		return
+	}
+	close(client.send)
+	client.send = nil
+	client.conn = nil
+	var expiry *time.Timer
+	expiry = time.AfterFunc(h.config.ResumeWindow, func() {
+		h.mu.RLock()
+		// still this detach's timer, the client did not resume since
+		expired := client.expiry == expiry
+		h.mu.RUnlock()
+		if expired {
+			h.Unregister(client)
+		}
+	})
+	client.expiry = expiry
+}
+
+// leave every room and close the send queue, safe to call more than once
+func (h *Hub) Unregister(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.clients[client] {
+		return
+	}
+	for room := range client.rooms {
+		h.removeFromRoom(client, room)
+	}
+	if client.send != nil {
+		close(client.send)
+		client.send = nil
+	}
+	if client.expiry != nil {
+		client.expiry.Stop()
+	}
+	delete(h.clients, client)
+	delete(h.resumable, client.resumeToken)
+}
+
+// caller holds the write lock
+func (h *Hub) removeFromRoom(client *Client, room string) {
+	delete(client.rooms, room)
+	delete(h.rooms[room], client)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// false when the client is no longer registered
+func (h *Hub) Join(client *Client, room string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.clients[client] {
+		return false
+	}
+	if h.rooms[room] == nil {
+		h.rooms[room] = map[*Client]bool{}
+	}
+	h.rooms[room][client] = true
+	client.rooms[room] = true
+	return true
+}
+
+func (h *Hub) Leave(client *Client, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if client.rooms[room] {
+		h.removeFromRoom(client, room)
+	}
+}
+
+func (h *Hub) InRoom(client *Client, room string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rooms[room][client]
+}
+
+// number of clients in a room, detached ones included
+func (h *Hub) RoomSize(room string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms[room])
+}
+
+// queue msg for every client of the room but except, on every instance
+// returns how many clients of this instance got it
+func (h *Hub) Broadcast(room string, msg Message, except *Client) int {
+	exceptID := ""
+	if except != nil {
+		exceptID = except.id
+	}
+	delivered := h.broadcastLocal(room, msg, exceptID)
+	h.publish(BrokerMessage{Room: room, Except: exceptID}, msg)
+	return delivered
+}
+
+func (h *Hub) broadcastLocal(room string, msg Message, exceptID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queued, ok := h.stamp(msg)
+	if !ok {
+		return 0
+	}
+	delivered := 0
+	for client := range h.rooms[room] {
+		if client.id == exceptID {
+			continue
+		}
+		h.enqueue(client, queued)
+		delivered++
+	}
+	return delivered
+}
+
+// queue msg for every client, on every instance
+func (h *Hub) BroadcastAll(msg Message) {
+	h.broadcastAllLocal(msg)
+	h.publish(BrokerMessage{}, msg)
+}
+
+func (h *Hub) broadcastAllLocal(msg Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	queued, ok := h.stamp(msg)
+	if !ok {
+		return
+	}
+	for client := range h.clients {
+		h.enqueue(client, queued)
+	}
+}
+
+// queue msg for one client, false when it is gone
+func (h *Hub) Send(client *Client, msg Message) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.clients[client] {
+		return false
+	}
+	queued, ok := h.stamp(msg)
+	if ok {
+		h.enqueue(client, queued)
+	}
+	return ok
+}
+
+// queue msg for a client by id, which may be on another instance
+func (h *Hub) SendTo(clientID string, msg Message) {
+	if !h.sendLocal(clientID, msg) {
+		h.publish(BrokerMessage{Client: clientID}, msg)
+	}
+}
+
+// false when no client of this instance has the id
+func (h *Hub) sendLocal(clientID string, msg Message) bool {
+	h.mu.RLock()
+	var found *Client
+	for client := range h.clients {
+		if client.id == clientID {
+			found = client
+			break
+		}
+	}
+	h.mu.RUnlock()
+	return found != nil && h.Send(found, msg)
+}
+
+// hand a client message to the other instances, for the one that owns its session
+// false when there are none
+func (h *Hub) Forward(caller wsCaller, msg Message) bool {
+	if !h.Distributed() {
+		return false
+	}
+	h.publish(BrokerMessage{Caller: &caller}, msg)
+	return true
+}
+
+// counter rooms a client is in
+func (h *Hub) Counters(client *Client) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	counters := []string{}
+	for room := range client.rooms {
+		if counter, ok := strings.CutPrefix(room, "counter:"); ok {
+			counters = append(counters, counter)
+		}
+	}
+	return counters
+}
+
+// number and marshal the next message, caller holds the write lock
+func (h *Hub) stamp(msg Message) (queuedMessage, bool) {
+	h.seq++
+	msg.Seq = h.seq
+	data, ok := marshalMessage(msg)
+	return queuedMessage{seq: h.seq, data: data}, ok
+}
+
+// keep msg for a resume and queue it on the connection, caller holds the write lock
+// a detached client only keeps it, a client whose queue is full is evicted
+func (h *Hub) enqueue(client *Client, msg queuedMessage) {
+	client.backlog = append(client.backlog, msg)
+	if over := len(client.backlog) - h.config.ResumeBuffer; over > 0 {
+		client.lost = client.backlog[over-1].seq
+		client.backlog = append([]queuedMessage(nil), client.backlog[over:]...)
+	}
+	if client.send == nil {
+		return
+	}
+	select {
+	case client.send <- msg.data:
+	default:
+		fmt.Println("ws client too slow, evicted:", client.id)
+		h.detach(client)
+	}
+}
+
+// read deadline of a connection, renewed by every pong and message
+func (h *Hub) keepAlive(conn *websocket.Conn) {
+	pongWait := h.Config().PongWait
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+// write the replay then queued messages until the hub closes send, pinging in between
+func (h *Hub) writePump(conn *websocket.Conn, send <-chan []byte, replay [][]byte) {
+	config := h.Config()
+	ticker := time.NewTicker(config.PingPeriod)
+	defer ticker.Stop()
+	defer conn.Close()
+	for _, msg := range replay {
+		conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			fmt.Println("ws write:", err)
+			return
+		}
+	}
+	for {
+		select {
+		case msg, open := <-send:
+			conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if !open {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				fmt.Println("ws write:", err)
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package invoices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// a registered client without a connection, messages stay in its queue
+func hubClient(hub *Hub) *Client {
+	client := newClient(nil, wsIdentity{})
+	hub.Register(client)
+	return client
+}
+
+func TestHubRooms(t *testing.T) {
+	hub := NewHub()
+	pad, otherPad, staff := hubClient(hub), hubClient(hub), hubClient(hub)
+	hub.Join(pad, counterRoom("front"))
+	hub.Join(otherPad, counterRoom("back"))
+	hub.Join(staff, counterRoom("front"))
+
+	if n := hub.Broadcast(counterRoom("front"), Message{Type: "sign"}, staff); n != 1 {
+		t.Errorf("delivered to %d clients", n)
+	}
+	if len(pad.send) != 1 || len(otherPad.send) != 0 || len(staff.send) != 0 {
+		t.Errorf("queued pad %d, other pad %d, staff %d", len(pad.send), len(otherPad.send), len(staff.send))
+	}
+
+	hub.Leave(staff, counterRoom("front"))
+	send := pad.send
+	hub.Unregister(pad)
+	hub.Unregister(pad)
+	if size := hub.RoomSize(counterRoom("front")); size != 0 {
+		t.Errorf("front room has %d clients", size)
+	}
+	if hub.Join(pad, counterRoom("front")) || hub.Send(pad, Message{Type: "late"}) {
+		t.Error("unregistered client joined or got a message")
+	}
+	if msg, open := <-send; !open || !strings.Contains(string(msg), `"seq":1`) {
+		t.Errorf("queued message %s lost on unregister", msg)
+	}
+	if _, open := <-send; open {
+		t.Error("send queue not closed")
+	}
+}
+
+func TestHubEvictsSlowClient(t *testing.T) {
+	hub := NewHub()
+	hub.SetConfig(WsConfig{SendBuffer: 2, ResumeBuffer: 3})
+	slow := hubClient(hub)
+	hub.Join(slow, staffRoom)
+	for i := 0; i < 2; i++ {
+		hub.BroadcastAll(Message{Type: ImportProgress})
+	}
+	if slow.send == nil {
+		t.Fatal("client evicted before its queue was full")
+	}
+	hub.BroadcastAll(Message{Type: ImportProgress})
+	if slow.send != nil || !hub.clients[slow] {
+		t.Fatal("slow client not evicted, or forgotten")
+	}
+	// messages while detached are kept for a resume
+	hub.Broadcast(staffRoom, Message{Type: ImportDone}, nil)
+
+	if _, _, _, ok := hub.Resume(slow.resumeToken, 2, wsIdentity{UID: "someone else"}, nil); ok {
+		t.Error("resumed with another identity")
+	}
+	client, send, replay, ok := hub.Resume(slow.resumeToken, 2, wsIdentity{}, nil)
+	if !ok || client != slow || send == nil || len(replay) != 2 {
+		t.Fatalf("resume after seq 2: ok %v, replay %d", ok, len(replay))
+	}
+	if !strings.Contains(string(replay[0]), `"seq":3`) || !strings.Contains(string(replay[1]), ImportDone) {
+		t.Errorf("replay %s", replay)
+	}
+	// seq 1 fell out of the backlog
+	if _, _, _, ok := hub.Resume(slow.resumeToken, 0, wsIdentity{}, nil); ok {
+		t.Error("resumed past lost messages")
+	}
+}
+
+func TestHubResumeWindow(t *testing.T) {
+	hub := NewHub()
+	hub.SetConfig(WsConfig{ResumeWindow: 10 * time.Millisecond})
+	client := hubClient(hub)
+	hub.Join(client, staffRoom)
+	hub.Detach(client, nil)
+	if hub.RoomSize(staffRoom) != 1 {
+		t.Fatal("detached client left its rooms")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, _, _, ok := hub.Resume(client.resumeToken, 0, wsIdentity{}, nil); ok || hub.RoomSize(staffRoom) != 0 {
+		t.Error("client kept after the resume window")
+	}
+}
+
+// tokens are "staff", "pad" or "pad:<counter>"
+type fakeVerifier struct{}
+
+func (fakeVerifier) VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error) {
+	role, counter, _ := strings.Cut(idToken, ":")
+	switch role {
+	case RoleStaff:
+		return &auth.Token{UID: "staff-uid", Claims: map[string]interface{}{}}, nil
+	case RolePad:
+		return &auth.Token{UID: "pad-uid", Claims: map[string]interface{}{"role": RolePad, "counter": counter}}, nil
+	}
+	return nil, errors.New("bad token")
+}
+
+// stores nothing, invoice "fail" cannot be signed and invoice "missing" does not exist
+type fakeSignatureStore struct{}
+
+func (fakeSignatureStore) CheckSignature(ctx context.Context, upload SignatureUpload) error {
+	if strings.HasPrefix(upload.FileName, "missing_") {
+		return ErrInvoiceNotFound
+	}
+	return nil
+}
+
+func (fakeSignatureStore) StoreSignature(ctx context.Context, upload SignatureUpload) (string, error) {
+	if strings.HasPrefix(upload.FileName, "fail_") {
+		return "", ErrInvalidTransition
+	}
+	return "https://cdn.example/" + upload.FileName + "_" + upload.AuctionLot + "_sig.png", nil
+}
+
+func wsTestServer(t *testing.T) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", WsHandler(fakeVerifier{}, fakeSignatureStore{}))
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func wsURL(server *httptest.Server, query string) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws" + query
+}
+
+func TestWsAuth(t *testing.T) {
+	server := wsTestServer(t)
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL(server, ""), http.Header{"Authorization": {"Bearer nobody"}}); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad header token: %v", err)
+	}
+	header := http.Header{"Origin": {"https://elsewhere.example"}, "Authorization": {"Bearer staff"}}
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL(server, ""), header); err == nil {
+		t.Error("foreign origin accepted")
+	}
+
+	// token in the first message
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(server, ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Message{Type: AuthMessage, Data: map[string]string{"token": "pad:front"}})
+	// a pad may not follow invoices
+	conn.WriteJSON(Message{Type: JoinRoom, Data: map[string]string{"invoiceNumber": "1001"}})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != WsConnected {
+		t.Errorf("first message: %+v %v", msg, err)
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != WsError {
+		t.Errorf("join invoice as pad: %+v %v", msg, err)
+	}
+
+	// anything but an auth message first closes the connection, a token in the query does not count
+	conn2, _, err := websocket.DefaultDialer.Dial(wsURL(server, "?token=staff"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.WriteJSON(Message{Type: JoinRoom, Data: map[string]string{"counter": "front"}})
+	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn2.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("unauthenticated connection: %v", err)
+	}
+}
+
+func TestWsSignatureSession(t *testing.T) {
+	server := wsTestServer(t)
+	dial := func(token string, query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL(server, query), http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// skip messages until one of the type arrives
+	read := func(conn *websocket.Conn, msgType string) Message {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("waiting for %s: %v", msgType, err)
+			}
+			if msg.Type == msgType {
+				return msg
+			}
+		}
+	}
+	session := func(msg Message) SignatureSession {
+		var session SignatureSession
+		data, _ := json.Marshal(msg.Data)
+		json.Unmarshal(data, &session)
+		return session
+	}
+
+	pad := dial("pad:front", "?counter=front")
+	defer pad.Close()
+	otherPad := dial("pad", "?counter=back")
+	defer otherPad.Close()
+	staff := dial("staff", "")
+	defer staff.Close()
+	// the handler registers the pads before reading, wait for both
+	for wsHub.RoomSize(counterRoom("front")) == 0 || wsHub.RoomSize(counterRoom("back")) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	staff.WriteJSON(Message{ID: "s1", Type: InitSignature, Data: map[string]string{"counter": "front", "invoiceNumber": "1001", "auctionLot": "12", "buyerName": "Ann"}})
+	ack := read(staff, AckMessage)
+	opened := session(ack)
+	if ack.ReplyTo != "s1" || opened.State != SignatureRequested || opened.Action != "pickup" {
+		t.Fatalf("init ack %+v", ack)
+	}
+	request := read(pad, InitSignature)
+	if data, _ := json.Marshal(request.Data); request.ID == "" || !strings.Contains(string(data), `"buyerName":"Ann"`) || !strings.Contains(string(data), opened.ID) {
+		t.Errorf("pad got %+v", request)
+	}
+	staff.WriteJSON(Message{ID: "s2", Type: InitSignature, Data: map[string]string{"counter": "front", "invoiceNumber": "1001", "auctionLot": "12"}})
+	if msg := read(staff, WsError); msg.ReplyTo != "s2" {
+		t.Errorf("second session for an invoice: got %+v", msg)
+	}
+
+	// the pad acks the request once it shows it
+	pad.WriteJSON(Message{Type: AckMessage, ReplyTo: request.ID})
+	if state := session(read(staff, SignatureStatus)).State; state != SignatureDisplayed {
+		t.Errorf("after pad ack: %s", state)
+	}
+	// only the session's pad can sign
+	otherPad.WriteJSON(Message{ID: "o1", Type: SubmitSignature, Data: map[string]string{"sessionId": opened.ID, "image": "cG5n"}})
+	if msg := read(otherPad, WsError); msg.ReplyTo != "o1" {
+		t.Errorf("submit from the other pad: got %+v", msg)
+	}
+	pad.WriteJSON(Message{ID: "p1", Type: SubmitSignature, Data: map[string]string{"sessionId": opened.ID, "image": "cG5n"}})
+	stored := session(read(pad, AckMessage))
+	if stored.State != SignatureStored || stored.CdnURL != "https://cdn.example/1001_pickup_12_sig.png" {
+		t.Errorf("submit ack %+v", stored)
+	}
+	if state := session(read(staff, SignatureStatus)).State; state != SignatureSigned {
+		t.Errorf("after submit: %s", state)
+	}
+	if state := session(read(staff, SignatureStatus)).State; state != SignatureStored {
+		t.Errorf("after store: %s", state)
+	}
+
+	staff.WriteJSON(Message{ID: "s3", Type: ConfirmSession, Data: map[string]string{"sessionId": opened.ID}})
+	if msg := read(staff, AckMessage); session(msg).State != SignatureConfirmed {
+		t.Errorf("confirm ack %+v", msg)
+	}
+	// the session is closed once confirmed
+	pad.WriteJSON(Message{ID: "p2", Type: SubmitSignature, Data: map[string]string{"invoiceNumber": "1001", "image": "cG5n"}})
+	if msg := read(pad, WsError); msg.ReplyTo != "p2" {
+		t.Errorf("second submit: got %+v", msg)
+	}
+
+	// a failed store goes back to the signature screen
+	staff.WriteJSON(Message{Type: InitSignature, Data: map[string]string{"counter": "front", "invoiceNumber": "fail", "auctionLot": "12"}})
+	request = read(pad, InitSignature)
+	pad.WriteJSON(Message{Type: AckMessage, ReplyTo: request.ID})
+	pad.WriteJSON(Message{ID: "p3", Type: SubmitSignature, Data: map[string]string{"invoiceNumber": "fail", "auctionLot": "12", "image": "cG5n"}})
+	// the ack shows the request first, the failed store shows it again with the reason
+	failed := session(read(pad, SignatureStatus))
+	for failed.Reason == "" {
+		failed = session(read(pad, SignatureStatus))
+	}
+	if msg := read(pad, WsError); msg.ReplyTo != "p3" || failed.State != SignatureDisplayed {
+		t.Errorf("failed store: got %+v, session %+v", msg, failed)
+	}
+	pad.WriteJSON(Message{ID: "p4", Type: CancelSession, Data: map[string]string{"sessionId": failed.ID, "reason": "customer left"}})
+	if cancelled := session(read(pad, AckMessage)); cancelled.State != SignatureCancelled || cancelled.Reason != "customer left" {
+		t.Errorf("cancel ack %+v", cancelled)
+	}
+
+	staff.WriteJSON(Message{Type: InitSignature, Data: map[string]string{"counter": "side", "invoiceNumber": "1002", "auctionLot": "12"}})
+	if msg := read(staff, WsError); msg.Type != WsError {
+		t.Errorf("init to an empty counter: got %+v", msg)
+	}
+	staff.WriteJSON(Message{ID: "s4", Type: InitSignature, Data: map[string]string{"counter": "front", "invoiceNumber": "missing", "auctionLot": "12"}})
+	if msg := read(staff, WsError); msg.ReplyTo != "s4" || msg.Data != ErrInvoiceNotFound.Error() {
+		t.Errorf("init for a missing invoice: got %+v", msg)
+	}
+
+	// the other pad heard none of the sessions
+	otherPad.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := otherPad.ReadMessage(); err == nil {
+		t.Errorf("other pad got %s", data)
+	}
+}
+
+func TestWsHeartbeatAndResume(t *testing.T) {
+	SetWsConfig(WsConfig{PongWait: 300 * time.Millisecond, PingPeriod: 50 * time.Millisecond})
+	defer SetWsConfig(DefaultWsConfig())
+	server := wsTestServer(t)
+	dial := func(token string, query string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL(server, query), http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	read := func(conn *websocket.Conn) Message {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// a client that never answers pings is closed
+	silent := dial("staff", "")
+	defer silent.Close()
+	silent.SetPingHandler(func(string) error { return nil })
+	silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := silent.ReadMessage(); err != nil {
+			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+				t.Fatal("silent client kept open")
+			}
+			break
+		}
+	}
+
+	// reading answers pings, the pad outlives the pong wait
+	pad := dial("pad:kiosk", "?counter=kiosk")
+	connected := read(pad)
+	time.Sleep(400 * time.Millisecond)
+	token, _ := connected.Data.(map[string]interface{})["resumeToken"].(string)
+	if connected.Type != WsConnected || token == "" {
+		t.Fatalf("first message %+v", connected)
+	}
+	pad.Close()
+	for {
+		wsHub.mu.RLock()
+		detached := wsHub.resumable[token].send == nil
+		wsHub.mu.RUnlock()
+		if detached {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the request sent while the pad was away is replayed when it comes back
+	staff := dial("staff", "")
+	defer staff.Close()
+	staff.WriteJSON(Message{ID: "s1", Type: InitSignature, Data: map[string]string{"counter": "kiosk", "invoiceNumber": "2001", "auctionLot": "12"}})
+	for msg := read(staff); msg.ReplyTo != "s1"; msg = read(staff) {
+	}
+	pad = dial("pad:kiosk", fmt.Sprintf("?resume=%s&lastSeq=%d", token, connected.Seq))
+	defer pad.Close()
+	var request Message
+	for msg := read(pad); msg.Type != WsConnected; msg = read(pad) {
+		if msg.Type == InitSignature {
+			request = msg
+		}
+	}
+	if request.ID == "" {
+		t.Fatal("missed request not replayed")
+	}
+	pad.WriteJSON(Message{ID: "p1", Type: CancelSession, Data: request.Data})
+	msg := read(pad)
+	for msg.ReplyTo != "p1" {
+		msg = read(pad)
+	}
+	if msg.Type != AckMessage {
+		t.Errorf("cancel after resume: %+v", msg)
+	}
+}
+
+func TestWsReadLimit(t *testing.T) {
+	server := wsTestServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(server, "?counter=front"), http.Header{"Authorization": {"Bearer pad:front"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	image := strings.Repeat("A", int(wsReadLimit))
+	conn.WriteJSON(Message{Type: SubmitSignature, Data: map[string]string{"invoiceNumber": "1001", "image": image}})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("oversized message: %v", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package invoices
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// largest csv or json export accepted by parseInvoiceFile
+const maxImportFileSize = 20 * 1024 * 1024
+
+var (
+	ErrUnknownImportField = errors.New("unknown import field")
+	ErrMissingColumn      = errors.New("column not found")
+)
+
+// invoice fields an import column can fill, repeated on every item row of the invoice
+var importInvoiceFields = []string{
+	"invoiceNumber", "time", "buyerName", "buyerEmail", "buyerPhone", "buyerAddress", "shippingAddress",
+	"auctionLot", "isShipping", "status", "invoiceTotal", "tax", "buyersPremium", "paymentMethod",
+}
+
+// item fields an import column can fill, one item per row
+var importItemFields = []string{
+	"itemLot", "sku", "desc", "shelfLocation", "unit", "msrp", "bid", "extendedPrice", "handlingFee",
+}
+
+// header names matched besides the field name itself, the item export headers match as they are
+var importColumnAliases = map[string][]string{
+	"desc":       {"description", "lead"},
+	"unit":       {"units", "quantity", "qty"},
+	"isShipping": {"fulfillment", "shipping"},
+	"buyerEmail": {"email"},
+	"buyerPhone": {"phone"},
+}
+
+// lower case letters and digits only, "Buyer's Premium" matches buyersPremium
+func normalizeColumn(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// column index of each import field
+// mapping is field name to header name, fields left out are matched by name or alias
+func resolveImportColumns(header []string, mapping map[string]string) (map[string]int, error) {
+	fields := append(append([]string{}, importInvoiceFields...), importItemFields...)
+	for field := range mapping {
+		if !slices.Contains(fields, field) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownImportField, field)
+		}
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		key := normalizeColumn(name)
+		if _, seen := index[key]; !seen {
+			index[key] = i
+		}
+	}
+
+	columns := map[string]int{}
+	for _, field := range fields {
+		if source, mapped := mapping[field]; mapped {
+			i, found := index[normalizeColumn(source)]
+			if !found {
+				return nil, fmt.Errorf("%w: %q", ErrMissingColumn, source)
+			}
+			columns[field] = i
+			continue
+		}
+		for _, name := range append([]string{field}, importColumnAliases[field]...) {
+			if i, found := index[normalizeColumn(name)]; found {
+				columns[field] = i
+				break
+			}
+		}
+	}
+
+	// one row per item, the item lot is what the remaining record is searched by
+	for _, field := range []string{"invoiceNumber", "itemLot"} {
+		if _, found := columns[field]; !found {
+			return nil, fmt.Errorf("%w: %s", ErrMissingColumn, field)
+		}
+	}
+	return columns, nil
+}
+
+// one row of an import file, values keyed by import field
+type importRow struct {
+	Line   int
+	Values map[string]string
+}
+
+func rowValues(record []string, columns map[string]int) map[string]string {
+	values := map[string]string{}
+	for field, i := range columns {
+		if i < len(record) {
+			values[field] = strings.TrimSpace(record[i])
+		}
+	}
+	return values
+}
+
+func blankRecord(record []string) bool {
+	for _, cell := range record {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// read a csv export, the first row is the header
+func readCSVRows(r io.Reader, mapping map[string]string) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	columns, err := resolveImportColumns(header, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []importRow{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if blankRecord(record) {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, importRow{Line: line, Values: rowValues(record, columns)})
+	}
+	return rows, nil
+}
+
+// read a json export, an array of flat objects with one object per item
+// line is the position of the object in the array, counting from 1
+func readJSONRows(r io.Reader, mapping map[string]string) ([]importRow, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var objects []map[string]any
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, fmt.Errorf("cannot read json: %w", err)
+	}
+
+	// every key of every object is a column
+	keys := map[string]bool{}
+	for _, object := range objects {
+		for key := range object {
+			keys[key] = true
+		}
+	}
+	header := make([]string, 0, len(keys))
+	for key := range keys {
+		header = append(header, key)
+	}
+	sort.Strings(header)
+	columns, err := resolveImportColumns(header, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []importRow{}
+	for i, object := range objects {
+		record := make([]string, len(header))
+		for j, key := range header {
+			switch v := object[key].(type) {
+			case nil:
+			case string:
+				record[j] = v
+			default:
+				record[j] = fmt.Sprint(v)
+			}
+		}
+		if blankRecord(record) {
+			continue
+		}
+		rows = append(rows, importRow{Line: i + 1, Values: rowValues(record, columns)})
+	}
+	return rows, nil
+}
+
+// "shipping", "yes", "true" or "1" ship, "pickup", "no", "false" or "0" are picked up
+func parseFulfillment(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "shipping", "ship", "shipped", "yes", "y", "true", "1":
+		return true, nil
+	case "pickup", "pick up", "no", "n", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown fulfillment %q", s)
+}
+
+func setImportInvoiceField(invoice *Invoice, field string, value string) error {
+	var err error
+	switch field {
+	case "invoiceNumber":
+		invoice.InvoiceNumber = value
+	case "time":
+		invoice.Time, err = ParseTimestamp(value)
+	case "buyerName":
+		invoice.BuyerName = value
+	case "buyerEmail":
+		invoice.BuyerEmail = value
+	case "buyerPhone":
+		invoice.BuyerPhone = value
+	case "buyerAddress":
+		invoice.BuyerAddress = value
+	case "shippingAddress":
+		invoice.ShippingAddress = value
+	case "auctionLot":
+		invoice.AuctionLot, err = strconv.Atoi(value)
+	case "isShipping":
+		invoice.IsShipping, err = parseFulfillment(value)
+	case "status":
+		// "Picked Up" reads as pickedup, an unknown status leaves the invoice unpaid
+		var status InvoiceStatus
+		if status, err = ParseInvoiceStatus(normalizeColumn(value)); err == nil {
+			invoice.Status = status
+		}
+	case "invoiceTotal":
+		invoice.InvoiceTotal, err = ParseMoney(value)
+	case "tax":
+		invoice.Tax, err = ParseMoney(value)
+	case "buyersPremium":
+		invoice.BuyersPremium, err = ParseMoney(value)
+	case "paymentMethod":
+		method := strings.ToLower(value)
+		if err = checkTender(method); err == nil {
+			invoice.PaymentMethod = method
+		}
+	}
+	return err
+}
+
+func setImportItemField(item *InvoiceItem, field string, value string) error {
+	var err error
+	switch field {
+	case "itemLot":
+		item.ItemLot, err = strconv.Atoi(value)
+	case "sku":
+		item.Sku, err = strconv.Atoi(value)
+	case "desc":
+		item.Desc = value
+	case "shelfLocation":
+		item.ShelfLocation = value
+	case "unit":
+		item.Unit, err = parseFloat32(value)
+	case "msrp":
+		item.Msrp, err = ParseMoney(value)
+	case "bid":
+		item.Bid, err = ParseMoney(value)
+	case "extendedPrice":
+		item.ExtendedPrice, err = ParseMoney(value)
+	case "handlingFee":
+		item.HandlingFee, err = ParseMoney(value)
+	}
+	return err
+}
+
+// one invoice built from import rows, with the problems of its rows
+type importedInvoice struct {
+	Result ParseResult
+	Rows   []int
+	// raw invoice values of the first row that had them
+	values map[string]string
+}
+
+// group rows into invoices by invoice number and buyer, the same key importInvoices matches on
+// rows without an invoice number cannot belong anywhere and come back as row errors
+func groupImportRows(rows []importRow, template string) ([]*importedInvoice, []string) {
+	groups := []*importedInvoice{}
+	byKey := map[string]*importedInvoice{}
+	rowErrors := []string{}
+	for _, row := range rows {
+		number := row.Values["invoiceNumber"]
+		if number == "" {
+			rowErrors = append(rowErrors, fmt.Sprintf("row %d: missing invoice number", row.Line))
+			continue
+		}
+		key := number + "\x00" + row.Values["buyerName"]
+		group, found := byKey[key]
+		if !found {
+			group = &importedInvoice{
+				Result: ParseResult{Invoice: Invoice{Status: StatusUnpaid}, Template: template},
+				values: map[string]string{},
+			}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.addRow(row)
+	}
+	return groups, rowErrors
+}
+
+// invoice values are taken from the first row that has them, later rows may only repeat them
+func (g *importedInvoice) addRow(row importRow) {
+	g.Rows = append(g.Rows, row.Line)
+	invoice := &g.Result.Invoice
+	diag := &g.Result.Diagnostics
+
+	for _, field := range importInvoiceFields {
+		value := row.Values[field]
+		if value == "" {
+			continue
+		}
+		if first, seen := g.values[field]; seen {
+			if first != value {
+				diag.RowWarn(row.Line, field, value, "differs from an earlier row of the invoice, "+first+" kept", 0.5)
+			}
+			continue
+		}
+		g.values[field] = value
+		if err := setImportInvoiceField(invoice, field, value); err != nil {
+			diag.RowError(row.Line, field, value, err.Error())
+		}
+	}
+
+	var item InvoiceItem
+	for _, field := range importItemFields {
+		if value := row.Values[field]; value != "" {
+			if err := setImportItemField(&item, field, value); err != nil {
+				diag.RowError(row.Line, field, value, err.Error())
+			}
+		}
+	}
+	if item.ItemLot == 0 {
+		diag.RowError(row.Line, "itemLot", row.Values["itemLot"], "missing item lot")
+		return
+	}
+	invoice.Items = append(invoice.Items, item)
+}
+
+// fields importInvoices cannot do without
+func (g *importedInvoice) validate() {
+	invoice := g.Result.Invoice
+	diag := &g.Result.Diagnostics
+	if invoice.BuyerName == "" {
+		diag.Error("buyerName", "", "missing buyer name")
+	}
+	if invoice.Time.IsZero() && g.values["time"] == "" {
+		diag.Error("time", "", "missing invoice time")
+	}
+	if invoice.AuctionLot == 0 && g.values["auctionLot"] == "" {
+		diag.Error("auctionLot", "", "missing auction lot")
+	}
+	if len(invoice.Items) == 0 {
+		diag.Error("items", "", "no items")
+	}
+}
+
+// keep the values the file gave over the remaining record, fill in the rest from it
+// recorded is keyed by the index of the imported item, items without a record keep what the file gave
+func mergeImportedItems(imported []InvoiceItem, recorded map[int]InvoiceItem, diag *Diagnostics) []InvoiceItem {
+	items := make([]InvoiceItem, len(imported))
+	for i, item := range imported {
+		if record, ok := recorded[i]; ok {
+			if item.Bid != 0 && item.Bid != record.Bid {
+				diag.Warn(fmt.Sprintf("items[%d].bid", i), item.Bid.String(), "differs from remaining record bid "+record.Bid.String(), 0.5)
+			}
+			if item.Bid == 0 {
+				item.Bid = record.Bid
+			}
+			if item.Desc == "" {
+				item.Desc = record.Desc
+			}
+			if item.ShelfLocation == "" {
+				item.ShelfLocation = record.ShelfLocation
+			}
+			if item.Sku == 0 {
+				item.Sku = record.Sku
+			}
+		}
+		if item.ExtendedPrice == 0 {
+			item.ExtendedPrice = item.Bid.Mul(float64(itemUnits(item)))
+		}
+		items[i] = item
+	}
+	return items
+}
+
+// totals, taxes and the opening ledger of an imported invoice
+// a tax from the file is checked against the computed one, a missing tax is computed
+func finishImportedInvoice(invoice *Invoice, taxGiven bool, actor string, diag *Diagnostics) {
+	invoice.TotalHandlingFee = 0
+	for _, item := range invoice.Items {
+		invoice.TotalHandlingFee += item.HandlingFee
+	}
+	if taxGiven {
+		reconcileTax(invoice, diag)
+	} else {
+		applyCalculatedTax(invoice)
+	}
+
+	switch invoice.Status {
+	case StatusPaid, StatusPickedUp, StatusShipped:
+		if invoice.PaymentMethod == "" {
+			diag.Warn("paymentMethod", "", "paid invoice without a payment method, no payment recorded", 0.5)
+			break
+		}
+		invoice.Payments = append(invoice.Payments, Payment{
+			PaymentID: "import-" + invoice.InvoiceNumber,
+			Method:    invoice.PaymentMethod,
+			Amount:    invoice.InvoiceTotal,
+			Reference: "import",
+			Time:      invoice.Time,
+		})
+	}
+	invoice.RemainingBalance = ledgerBalance(*invoice)
+	invoice.InvoiceEvent = append(invoice.InvoiceEvent, InvoiceEvent{
+		Title: "Invoice Imported",
+		Desc:  fmt.Sprintf("Invoice imported as %s", invoice.Status),
+		Time:  eventTime(),
+		Actor: actor,
+	})
+}
+
+// read and group the rows of a csv or json export
+func parseImportFile(r io.Reader, format string, mapping map[string]string) ([]*importedInvoice, []string, error) {
+	var rows []importRow
+	var err error
+	if format == "json" {
+		rows, err = readJSONRows(r, mapping)
+	} else {
+		rows, err = readCSVRows(r, mapping)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, rowErrors := groupImportRows(rows, format)
+	for _, group := range groups {
+		group.validate()
+	}
+	return groups, rowErrors, nil
+}
+
+// turn a csv or json export into invoices for review, nothing is written
+// form fields: file (.csv or .json), mapping (optional json object of field name to column name)
+// the reviewed invoices are committed through previewInvoiceImport and importInvoices
+func ParseInvoiceFile(remainingCollection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.String(http.StatusBadRequest, "No File Passed")
+			return
+		}
+		if fileHeader.Size > maxImportFileSize {
+			c.String(http.StatusBadRequest, "File Size Must Not Exceed 20 MB")
+			return
+		}
+		format := strings.TrimPrefix(strings.ToLower(filepath.Ext(fileHeader.Filename)), ".")
+		if format != "csv" && format != "json" {
+			c.String(http.StatusBadRequest, "Please Only Upload CSV or JSON File")
+			return
+		}
+
+		mapping := map[string]string{}
+		if raw := c.Request.FormValue("mapping"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+				c.String(http.StatusBadRequest, "Invalid Column Mapping")
+				return
+			}
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.String(http.StatusBadRequest, "Cannot Read File")
+			return
+		}
+		defer file.Close()
+		groups, rowErrors, err := parseImportFile(file, format, mapping)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		invoices := []Invoice{}
+		reports := []ParseReport{}
+		for _, group := range groups {
+			result := &group.Result
+			if result.Invoice.AuctionLot != 0 && len(result.Invoice.Items) > 0 {
+				// fill the items with data from database, same as the pdf import
+				// a lot missing from the remaining record only loses its own row
+				recorded := map[int]InvoiceItem{}
+				for i, item := range result.Invoice.Items {
+					record, fillErr := recordedItem(context.Background(), remainingCollection, result.Invoice.AuctionLot, item)
+					if fillErr != nil {
+						result.Diagnostics.Warn(fmt.Sprintf("items[%d]", i), strconv.Itoa(item.ItemLot), fillErr.Error(), 0.5)
+						continue
+					}
+					recorded[i] = record
+				}
+				result.Invoice.Items = mergeImportedItems(result.Invoice.Items, recorded, &result.Diagnostics)
+				for i, item := range result.Invoice.Items {
+					if item.Bid == 0 {
+						result.Diagnostics.Error(fmt.Sprintf("items[%d].bid", i), strconv.Itoa(item.ItemLot), "no bid in file or remaining record")
+					}
+				}
+			}
+			_, taxGiven := group.values["tax"]
+			finishImportedInvoice(&result.Invoice, taxGiven, c.GetString("uid"), &result.Diagnostics)
+
+			report := result.Report(fileHeader.Filename)
+			report.Rows = group.Rows
+			invoices = append(invoices, result.Invoice)
+			reports = append(reports, report)
+		}
+
+		fileErrors := []FileError{}
+		for _, rowErr := range rowErrors {
+			fileErrors = append(fileErrors, FileError{FileName: fileHeader.Filename, Error: rowErr})
+		}
+
+		// same shape as createInvoiceFromPdf, diagnostics are in the same order as data
+		c.JSON(http.StatusOK, gin.H{
+			"data":        invoices,
+			"diagnostics": reports,
+			"errors":      fileErrors,
+		})
+	}
+}
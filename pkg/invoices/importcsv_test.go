@@ -0,0 +1,135 @@
+package invoices
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResolveImportColumns(t *testing.T) {
+	header := []string{"Invoice Number", "Item Lot", "Description", "Buyer's Premium", "Lot #"}
+	columns, err := resolveImportColumns(header, map[string]string{"auctionLot": "lot #"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns["invoiceNumber"] != 0 || columns["itemLot"] != 1 || columns["desc"] != 2 || columns["buyersPremium"] != 3 || columns["auctionLot"] != 4 {
+		t.Errorf("columns = %v", columns)
+	}
+
+	if _, err := resolveImportColumns(header, map[string]string{"profit": "Lot #"}); !errors.Is(err, ErrUnknownImportField) {
+		t.Errorf("unknown field: got %v", err)
+	}
+	if _, err := resolveImportColumns(header, map[string]string{"bid": "Hammer"}); !errors.Is(err, ErrMissingColumn) {
+		t.Errorf("missing mapped column: got %v", err)
+	}
+	if _, err := resolveImportColumns([]string{"Invoice Number"}, nil); !errors.Is(err, ErrMissingColumn) {
+		t.Errorf("missing item lot: got %v", err)
+	}
+}
+
+func TestParseImportFileCSV(t *testing.T) {
+	file := "\ufeffInvoice Number,Auction Lot,Time,Status,Buyer Name,Item Lot,Bid,Units,Fulfillment,Payment Method\n" +
+		"1001,64,2024-06-03 10:00:00,Paid,Ann Lee,1,12.50,1,pickup,Card\n" +
+		"1001,64,2024-06-03 10:00:00,paid,Ann Lee,2,$5.00,2,pickup,card\n" +
+		",,,,,,,,,\n" +
+		"1002,64,,unpaid,Bo Chan,x,1.00,1,shipping,\n" +
+		",64,2024-06-03,unpaid,Cy,3,1.00,1,pickup,\n" +
+		"1003,64,2024-06-04,mailed,Di,4,2.00,1,pickup,cash\n"
+
+	groups, rowErrors, err := parseImportFile(strings.NewReader(file), "csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowErrors) != 1 || rowErrors[0] != "row 6: missing invoice number" {
+		t.Errorf("row errors = %v", rowErrors)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("got %d invoices", len(groups))
+	}
+
+	first := groups[0]
+	invoice := first.Result.Invoice
+	if len(first.Rows) != 2 || first.Rows[0] != 2 || first.Rows[1] != 3 {
+		t.Errorf("rows = %v", first.Rows)
+	}
+	if invoice.Status != StatusPaid || invoice.PaymentMethod != TenderCard || invoice.AuctionLot != 64 || invoice.IsShipping {
+		t.Errorf("invoice = %+v", invoice)
+	}
+	if len(invoice.Items) != 2 || invoice.Items[0].Bid != 1250 || invoice.Items[1].Bid != 500 || invoice.Items[1].Unit != 2 {
+		t.Errorf("items = %+v", invoice.Items)
+	}
+	// "paid" on the second row is not written as "Paid" on the first
+	if first.Result.Diagnostics.Status() != ParseStatusWarning {
+		t.Errorf("diagnostics = %+v", first.Result.Diagnostics)
+	}
+
+	// bad item lot and no time
+	second := groups[1].Result
+	if second.Diagnostics.Status() != ParseStatusError || len(second.Invoice.Items) != 0 {
+		t.Errorf("second = %+v", second)
+	}
+	var badRow bool
+	for _, diag := range second.Diagnostics {
+		if diag.Field == "itemLot" && diag.Row == 5 {
+			badRow = true
+		}
+	}
+	if !badRow {
+		t.Errorf("no item lot error on row 5: %+v", second.Diagnostics)
+	}
+
+	// unknown status is an error and leaves the invoice unpaid
+	third := groups[2].Result
+	if third.Invoice.Status != StatusUnpaid || third.Diagnostics.Status() != ParseStatusError {
+		t.Errorf("third = %+v", third)
+	}
+}
+
+func TestReadJSONRows(t *testing.T) {
+	file := `[{"invoiceNumber": "7", "itemLot": 3, "bid": 4.5, "isShipping": true}, {}]`
+	rows, err := readJSONRows(strings.NewReader(file), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Line != 1 {
+		t.Fatalf("rows = %+v", rows)
+	}
+	values := rows[0].Values
+	if values["invoiceNumber"] != "7" || values["itemLot"] != "3" || values["bid"] != "4.5" || values["isShipping"] != "true" {
+		t.Errorf("values = %v", values)
+	}
+}
+
+func TestFinishImportedInvoice(t *testing.T) {
+	var diag Diagnostics
+	// the third lot is missing from the remaining record and keeps what the file gave
+	items := mergeImportedItems(
+		[]InvoiceItem{{ItemLot: 1, Bid: 1000, Unit: 2, HandlingFee: 200}, {ItemLot: 2}, {ItemLot: 3, Bid: 700, Desc: "rug"}},
+		map[int]InvoiceItem{0: {ItemLot: 1, Bid: 900, Desc: "lamp"}, 1: {ItemLot: 2, Bid: 300, Sku: 55}},
+		&diag,
+	)
+	if items[2].Bid != 700 || items[2].Desc != "rug" || items[2].ExtendedPrice != 700 {
+		t.Errorf("unrecorded item = %+v", items[2])
+	}
+	if items[0].Bid != 1000 || items[0].Desc != "lamp" || items[0].ExtendedPrice != 2000 {
+		t.Errorf("first item = %+v", items[0])
+	}
+	if items[1].Bid != 300 || items[1].Sku != 55 || items[1].ExtendedPrice != 300 {
+		t.Errorf("second item = %+v", items[1])
+	}
+	if len(diag) != 1 || diag[0].Field != "items[0].bid" {
+		t.Errorf("diagnostics = %+v", diag)
+	}
+
+	invoice := Invoice{InvoiceNumber: "9", Status: StatusPaid, PaymentMethod: TenderCash, Items: items}
+	finishImportedInvoice(&invoice, false, "uid-1", &diag)
+	if invoice.TotalHandlingFee != 200 || invoice.Tax == 0 || invoice.InvoiceTotal == 0 {
+		t.Errorf("totals = %+v", invoice)
+	}
+	if len(invoice.Payments) != 1 || invoice.Payments[0].Amount != invoice.InvoiceTotal || invoice.RemainingBalance != 0 {
+		t.Errorf("ledger = %+v, balance %s", invoice.Payments, invoice.RemainingBalance)
+	}
+	if len(invoice.InvoiceEvent) != 1 || invoice.InvoiceEvent[0].Actor != "uid-1" {
+		t.Errorf("events = %+v", invoice.InvoiceEvent)
+	}
+}
@@ -0,0 +1,369 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// import job status
+const (
+	ImportJobQueued  string = "queued"
+	ImportJobRunning string = "running"
+	ImportJobDone    string = "done"
+	// the server stopped before every file was parsed, uploads are not kept so the files have to be sent again
+	ImportJobFailed string = "failed"
+)
+
+// websocket message types emitted while a job runs
+const (
+	ImportProgress string = "importProgress"
+	ImportDone     string = "importDone"
+)
+
+// outcome of one file in an import job
+type ImportJobResult struct {
+	FileName string       `json:"fileName" bson:"fileName"`
+	Invoice  *Invoice     `json:"invoice,omitempty" bson:"invoice,omitempty"`
+	Report   *ParseReport `json:"report,omitempty" bson:"report,omitempty"`
+	Error    string       `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// a batch of invoice pdfs parsed in the background
+type ImportJob struct {
+	JobID     string            `json:"jobId" bson:"jobId"`
+	Status    string            `json:"status" bson:"status"`
+	CreatedBy string            `json:"createdBy" bson:"createdBy"`
+	CreatedAt Timestamp         `json:"createdAt" bson:"createdAt"`
+	UpdatedAt Timestamp         `json:"updatedAt" bson:"updatedAt"`
+	Template  string            `json:"template" bson:"template"`
+	UploadPDF bool              `json:"uploadPDF" bson:"uploadPDF"`
+	Total     int               `json:"total" bson:"total"`
+	Processed int               `json:"processed" bson:"processed"`
+	Failed    int               `json:"failed" bson:"failed"`
+	Error     string            `json:"error,omitempty" bson:"error,omitempty"`
+	Results   []ImportJobResult `json:"results" bson:"results"`
+}
+
+// progress event pushed to websocket clients
+type ImportJobProgress struct {
+	JobID     string `json:"jobId"`
+	FileName  string `json:"fileName"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Processed int    `json:"processed"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+// one file of a job waiting for a worker
+type importTask struct {
+	JobID     string
+	Template  string
+	UploadPDF bool
+	Source    pdfSource
+}
+
+// bounded worker pool parsing queued import job files
+type ImportJobRunner struct {
+	storageClient       *minio.Client
+	remainingCollection *mongo.Collection
+	jobCollection       *mongo.Collection
+	tasks               chan importTask
+	// files of accepted jobs waiting to be fed to the workers, one entry per job
+	jobs chan []importTask
+}
+
+// jobs that may wait for the workers, further uploads are turned away until one starts
+const importJobBacklog = 16
+
+var ErrImportInterrupted = errors.New("import interrupted by a server restart, upload the files again")
+
+// start the worker pool, workers run for the lifetime of the process
+func StartImportJobRunner(
+	storageClient *minio.Client,
+	remainingCollection *mongo.Collection,
+	jobCollection *mongo.Collection,
+	workers int,
+) *ImportJobRunner {
+	if workers < 1 {
+		workers = 1
+	}
+	runner := &ImportJobRunner{
+		storageClient:       storageClient,
+		remainingCollection: remainingCollection,
+		jobCollection:       jobCollection,
+		tasks:               make(chan importTask, workers*4),
+		jobs:                make(chan []importTask, importJobBacklog),
+	}
+	// uploads only live in memory, jobs a previous run left behind cannot finish
+	if err := failInterruptedImportJobs(context.Background(), jobCollection); err != nil {
+		fmt.Println("cannot fail interrupted import jobs:", err)
+	}
+	for i := 0; i < workers; i++ {
+		go runner.work()
+	}
+	go runner.feed()
+	return runner
+}
+
+// fail queued and running jobs, the files not parsed yet count as failed
+func failInterruptedImportJobs(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.UpdateMany(
+		ctx,
+		bson.M{"status": bson.M{"$in": bson.A{ImportJobQueued, ImportJobRunning}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"status":    ImportJobFailed,
+			"error":     ErrImportInterrupted.Error(),
+			"failed":    bson.M{"$add": bson.A{"$failed", bson.M{"$subtract": bson.A{"$total", "$processed"}}}},
+			"processed": "$total",
+			"updatedAt": eventTime(),
+		}}}},
+	)
+	return err
+}
+
+// hand the files of accepted jobs to the workers, one job after the other
+func (r *ImportJobRunner) feed() {
+	for tasks := range r.jobs {
+		for _, task := range tasks {
+			r.tasks <- task
+		}
+	}
+}
+
+func (r *ImportJobRunner) work() {
+	for task := range r.tasks {
+		r.process(task)
+	}
+}
+
+// parse the file of a task, a panic in a parser is logged with its stack and fails only this file
+// without it one bad template would stop the worker and the whole server
+func (r *ImportJobRunner) parse(ctx context.Context, task importTask) (result ParseResult, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			fmt.Printf("PANIC parsing %s of import job %s: %v\n%s\n", task.Source.FileName, task.JobID, p, debug.Stack())
+			err = fmt.Errorf("parser crashed: %v", p)
+		}
+	}()
+	return parseInvoicePDF(ctx, r.storageClient, task.Source, task.UploadPDF, task.Template)
+}
+
+// parse one file and record its result on the job
+func (r *ImportJobRunner) process(task importTask) {
+	ctx := context.Background()
+	defer task.Source.Buffer.Close()
+
+	r.jobCollection.UpdateOne(
+		ctx,
+		bson.M{"jobId": task.JobID, "status": ImportJobQueued},
+		bson.M{"$set": bson.M{"status": ImportJobRunning}},
+	)
+
+	jobResult := ImportJobResult{FileName: task.Source.FileName}
+	result, parseErr := r.parse(ctx, task)
+	if parseErr != nil {
+		jobResult.Error = parseErr.Error()
+	} else {
+		// fill the inventories with data from database
+		fixedInvoice, fillErr := FillItemDataFromDB(result.Invoice, r.remainingCollection)
+		if fillErr != nil {
+			result.Diagnostics.Warn("items", "", fillErr.Error(), 0.5)
+		} else {
+			reconcileTax(&fixedInvoice, &result.Diagnostics)
+		}
+		report := result.Report(task.Source.FileName)
+		jobResult.Invoice = &fixedInvoice
+		jobResult.Report = &report
+	}
+
+	// push the result and bump counters in one update
+	inc := bson.M{"processed": 1}
+	if jobResult.Error != "" {
+		inc["failed"] = 1
+	}
+	var job ImportJob
+	err := r.jobCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"jobId": task.JobID},
+		bson.M{
+			"$push": bson.M{"results": jobResult},
+			"$inc":  inc,
+			"$set":  bson.M{"updatedAt": eventTime()},
+		},
+		options.FindOneAndUpdate().
+			SetReturnDocument(options.After).
+			SetProjection(bson.M{"results": 0}),
+	).Decode(&job)
+	if err != nil {
+		fmt.Println("cannot record import result:", err)
+		return
+	}
+
+	progress := ImportJobProgress{
+		JobID:     job.JobID,
+		FileName:  task.Source.FileName,
+		Status:    job.Status,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Failed:    job.Failed,
+		Error:     jobResult.Error,
+	}
+	broadcastMessage(Message{Type: ImportProgress, Data: progress})
+
+	// last file finishes the job
+	if job.Processed >= job.Total {
+		r.jobCollection.UpdateOne(
+			ctx,
+			bson.M{"jobId": task.JobID},
+			bson.M{"$set": bson.M{"status": ImportJobDone}},
+		)
+		progress.Status = ImportJobDone
+		progress.FileName = ""
+		progress.Error = ""
+		broadcastMessage(Message{Type: ImportDone, Data: progress})
+	}
+}
+
+// queue every uploaded pdf as a background import job, returns the job id
+func CreateImportJob(runner *ImportJobRunner) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		// get files from form
+		form, err := c.MultipartForm()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// parse upload pdf option from form value
+		toUpload, err := strconv.ParseBool(c.Request.FormValue("uploadPDF"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "No Upload PDF Option Passed")
+			return
+		}
+		templateName := c.Request.FormValue("template")
+
+		// check if bucket exist before queueing anything
+		if toUpload {
+			exists, existErr := runner.storageClient.BucketExists(ctx, invoiceBucket)
+			if existErr != nil || !exists {
+				c.String(http.StatusInternalServerError, "No Such Bucket")
+				return
+			}
+		}
+
+		now := eventTime()
+		job := ImportJob{
+			JobID:     uuid.NewString(),
+			Status:    ImportJobQueued,
+			CreatedBy: c.GetString("uid"),
+			CreatedAt: now,
+			UpdatedAt: now,
+			Template:  templateName,
+			UploadPDF: toUpload,
+			Results:   []ImportJobResult{},
+		}
+
+		// rejected files are recorded as failed results right away
+		var tasks []importTask
+		for _, files := range form.File {
+			for _, fileHeader := range files {
+				if checkErr := checkPDFUpload(fileHeader); checkErr != nil {
+					job.Results = append(job.Results, ImportJobResult{FileName: fileHeader.Filename, Error: checkErr.Error()})
+					continue
+				}
+				// buffered copy outlives the request, multipart temp files do not
+				buf, bufErr := bufferUpload(fileHeader)
+				if bufErr != nil {
+					job.Results = append(job.Results, ImportJobResult{FileName: fileHeader.Filename, Error: bufErr.Error()})
+					continue
+				}
+
+				task := importTask{
+					JobID:     job.JobID,
+					Template:  templateName,
+					UploadPDF: toUpload,
+					Source: pdfSource{
+						FileName:    fileHeader.Filename,
+						ContentType: fileHeader.Header.Get("Content-Type"),
+						Buffer:      buf,
+					},
+				}
+				tasks = append(tasks, task)
+			}
+		}
+		job.Total = len(job.Results) + len(tasks)
+		job.Processed = len(job.Results)
+		job.Failed = len(job.Results)
+		if job.Total == 0 {
+			c.String(http.StatusBadRequest, "No Files Uploaded")
+			return
+		}
+		if len(tasks) == 0 {
+			job.Status = ImportJobDone
+		}
+
+		_, insertErr := runner.jobCollection.InsertOne(ctx, job)
+		if insertErr != nil {
+			for _, task := range tasks {
+				task.Source.Buffer.Close()
+			}
+			c.String(http.StatusInternalServerError, "Cannot Insert Import Job")
+			return
+		}
+
+		// feed the pool without holding the request, a full backlog fails the job
+		if len(tasks) > 0 {
+			select {
+			case runner.jobs <- tasks:
+			default:
+				for _, task := range tasks {
+					task.Source.Buffer.Close()
+				}
+				runner.jobCollection.UpdateOne(
+					ctx,
+					bson.M{"jobId": job.JobID},
+					bson.M{"$set": bson.M{"status": ImportJobFailed, "error": "import queue full", "updatedAt": eventTime()}},
+				)
+				c.String(http.StatusServiceUnavailable, "Import Queue Full")
+				return
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"jobId": job.JobID, "total": job.Total})
+	}
+}
+
+// import job status with results parsed so far
+func GetImportJob(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var job ImportJob
+		err := collection.FindOne(
+			context.Background(),
+			bson.M{"jobId": c.Param("jobId")},
+			options.FindOne().SetProjection(bson.M{"_id": 0}),
+		).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			c.String(http.StatusNotFound, "Import Job Not Found")
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Import Job")
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
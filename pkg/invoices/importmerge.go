@@ -0,0 +1,410 @@
+package invoices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// how an incoming invoice compares to the stored one
+const (
+	ImportNew       string = "new"
+	ImportIdentical string = "identical"
+	ImportChanged   string = "changed"
+)
+
+// what to do with an incoming invoice that already exists
+const (
+	ImportSkip      string = "skip"
+	ImportOverwrite string = "overwrite"
+	ImportMerge     string = "merge"
+)
+
+// fields written after import (signatures, events), never diffed or merged
+var importManagedFields = map[string]bool{
+	"_id":          true,
+	"invoiceEvent": true,
+	// the ledger is recorded by staff, the balance is derived from it
+	"payments":         true,
+	"remainingBalance": true,
+	"refunds":          true,
+	"refundTotal":      true,
+	"signatureCdn":     true,
+	"pickupTime":       true,
+	"returnSigCdn":     true,
+	"returnTime":       true,
+}
+
+var (
+	ErrDuplicateImport = errors.New("invoice appears more than once in the import")
+	ErrImportChanged   = errors.New("invoice changed while importing, preview again")
+)
+
+// one field that differs between the stored and the incoming invoice
+type FieldDiff struct {
+	Field    string `json:"field"`
+	Existing any    `json:"existing"`
+	Incoming any    `json:"incoming"`
+}
+
+// classification of one incoming invoice
+type ImportPreview struct {
+	InvoiceNumber  string      `json:"invoiceNumber"`
+	BuyerName      string      `json:"buyerName"`
+	Classification string      `json:"classification"`
+	Diff           []FieldDiff `json:"diff"`
+	// stored invoice, kept to check status changes on import
+	existing Invoice
+}
+
+// an incoming invoice and what to do with it if it exists
+type ImportEntry struct {
+	Invoice Invoice `json:"invoice" binding:"required"`
+	// skip, overwrite or merge, required when the invoice is changed
+	Action string `json:"action"`
+}
+
+type ImportOutcome struct {
+	InvoiceNumber  string `json:"invoiceNumber"`
+	BuyerName      string `json:"buyerName"`
+	Classification string `json:"classification"`
+	Action         string `json:"action"`
+}
+
+// invoices are identified by invoice number and buyer name
+func invoiceKey(invoice Invoice) bson.M {
+	return bson.M{
+		"buyerName":     invoice.BuyerName,
+		"invoiceNumber": invoice.InvoiceNumber,
+	}
+}
+
+// invoice as a plain map keyed by the json (and bson) field names
+func invoiceFieldMap(invoice Invoice) (map[string]any, error) {
+	raw, err := json.Marshal(invoice)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	err = json.Unmarshal(raw, &fields)
+	return fields, err
+}
+
+// field level differences, managed fields ignored
+func diffInvoices(existing Invoice, incoming Invoice) ([]FieldDiff, error) {
+	existingFields, err := invoiceFieldMap(existing)
+	if err != nil {
+		return nil, err
+	}
+	incomingFields, err := invoiceFieldMap(incoming)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(incomingFields))
+	for key := range incomingFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	diff := []FieldDiff{}
+	for _, key := range keys {
+		if importManagedFields[key] {
+			continue
+		}
+		if !reflect.DeepEqual(existingFields[key], incomingFields[key]) {
+			diff = append(diff, FieldDiff{Field: key, Existing: existingFields[key], Incoming: incomingFields[key]})
+		}
+	}
+	return diff, nil
+}
+
+// zero json values are treated as "not in the pdf" when merging
+func isZeroField(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// $set document writing the changed, non-zero incoming fields
+func mergeUpdate(incoming Invoice, diff []FieldDiff) (bson.M, error) {
+	raw, err := bson.Marshal(incoming)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	for _, field := range diff {
+		if isZeroField(field.Incoming) {
+			continue
+		}
+		set[field.Field] = bson.Raw(raw).Lookup(field.Field)
+	}
+	return set, nil
+}
+
+// $set document writing every incoming field but the managed ones
+func overwriteUpdate(incoming Invoice) (bson.M, error) {
+	raw, err := bson.Marshal(incoming)
+	if err != nil {
+		return nil, err
+	}
+	elements, err := bson.Raw(raw).Elements()
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	for _, element := range elements {
+		if !importManagedFields[element.Key()] {
+			set[element.Key()] = element.Value()
+		}
+	}
+	return set, nil
+}
+
+// compare every incoming invoice with the database, an invoice may only appear once
+func classifyInvoices(ctx context.Context, collection *mongo.Collection, incoming []Invoice) ([]ImportPreview, error) {
+	previews := make([]ImportPreview, 0, len(incoming))
+	seen := map[[2]string]bool{}
+	for _, invoice := range incoming {
+		key := [2]string{invoice.InvoiceNumber, invoice.BuyerName}
+		if seen[key] {
+			return nil, fmt.Errorf("%w: %s %s", ErrDuplicateImport, invoice.InvoiceNumber, invoice.BuyerName)
+		}
+		seen[key] = true
+		preview := ImportPreview{
+			InvoiceNumber: invoice.InvoiceNumber,
+			BuyerName:     invoice.BuyerName,
+			Diff:          []FieldDiff{},
+		}
+
+		var existing Invoice
+		err := collection.FindOne(ctx, invoiceKey(invoice)).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			preview.Classification = ImportNew
+			previews = append(previews, preview)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		diff, err := diffInvoices(existing, invoice)
+		if err != nil {
+			return nil, err
+		}
+		preview.existing = existing
+		preview.Diff = diff
+		if len(diff) == 0 {
+			preview.Classification = ImportIdentical
+		} else {
+			preview.Classification = ImportChanged
+		}
+		previews = append(previews, preview)
+	}
+	return previews, nil
+}
+
+// run fn in a transaction, everything it wrote is rolled back on error
+func withTransaction(ctx context.Context, collection *mongo.Collection, fn func(sessCtx mongo.SessionContext) error) error {
+	session, err := collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (any, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
+
+// classify incoming invoices as new, identical or changed without writing anything
+func PreviewInvoiceImport(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var incoming []Invoice
+		bindErr := c.ShouldBindJSON(&incoming)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+
+		previews, err := classifyInvoices(context.Background(), collection, incoming)
+		if errors.Is(err, ErrDuplicateImport) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Compare Invoices")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": previews})
+	}
+}
+
+// insert, skip, overwrite or merge every invoice, the batch lands fully or not at all
+func ImportInvoices(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		var entries []ImportEntry
+		bindErr := c.ShouldBindJSON(&entries)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+
+		incoming := make([]Invoice, len(entries))
+		for i, entry := range entries {
+			status, err := ParseInvoiceStatus(string(entry.Invoice.Status))
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			entries[i].Invoice.Status = status
+			entries[i].Invoice.RemainingBalance = derivedBalance(entries[i].Invoice, entries[i].Invoice.RemainingBalance)
+			incoming[i] = entries[i].Invoice
+		}
+		previews, err := classifyInvoices(ctx, collection, incoming)
+		if errors.Is(err, ErrDuplicateImport) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Compare Invoices")
+			return
+		}
+
+		// every changed invoice needs a decision before anything is written
+		outcomes := make([]ImportOutcome, len(entries))
+		for i, preview := range previews {
+			action := entries[i].Action
+			switch preview.Classification {
+			case ImportNew:
+				action = "insert"
+			case ImportIdentical:
+				action = ImportSkip
+			case ImportChanged:
+				if action != ImportSkip && action != ImportOverwrite && action != ImportMerge {
+					c.JSON(http.StatusConflict, gin.H{
+						"error": "Changed Invoices Need An Action",
+						"data":  previews,
+					})
+					return
+				}
+				// a status change from the pdf still has to follow the lifecycle
+				if action != ImportSkip && preview.existing.Status != entries[i].Invoice.Status {
+					if err := CanTransition(preview.existing, entries[i].Invoice.Status); err != nil {
+						c.String(transitionErrorCode(err), err.Error())
+						return
+					}
+				}
+			}
+			outcomes[i] = ImportOutcome{
+				InvoiceNumber:  preview.InvoiceNumber,
+				BuyerName:      preview.BuyerName,
+				Classification: preview.Classification,
+				Action:         action,
+			}
+		}
+
+		err = withTransaction(ctx, collection, func(sessCtx mongo.SessionContext) error {
+			for i, outcome := range outcomes {
+				invoice := entries[i].Invoice
+				if outcome.Action == ImportSkip {
+					continue
+				}
+				// the classification may be stale, another import could have written the invoice since
+				var existing Invoice
+				findErr := collection.FindOne(sessCtx, invoiceKey(invoice)).Decode(&existing)
+				if outcome.Action == "insert" && findErr == nil {
+					return fmt.Errorf("%w: %s", ErrImportChanged, invoice.InvoiceNumber)
+				}
+				if outcome.Action != "insert" && errors.Is(findErr, mongo.ErrNoDocuments) {
+					return fmt.Errorf("%w: %s", ErrImportChanged, invoice.InvoiceNumber)
+				}
+				if findErr != nil && !errors.Is(findErr, mongo.ErrNoDocuments) {
+					return findErr
+				}
+				switch outcome.Action {
+				case "insert":
+					if _, err := collection.InsertOne(sessCtx, invoice); err != nil {
+						return err
+					}
+				case ImportOverwrite:
+					// overwrite keeps the history, the ledger, the refunds and the signatures of the stored invoice
+					set, err := overwriteUpdate(invoice)
+					if err != nil {
+						return err
+					}
+					existing.InvoiceTotal = invoice.InvoiceTotal
+					set["remainingBalance"] = derivedBalance(existing, existing.RemainingBalance)
+					update := bson.M{"$set": set}
+					if existing.Status != invoice.Status {
+						update["$push"] = bson.M{
+							"invoiceEvent": transitionEvent(existing.Status, invoice.Status, c.GetString("uid"), "Status changed by import"),
+						}
+					}
+					if _, err := collection.UpdateOne(sessCtx, invoiceKey(invoice), update); err != nil {
+						return err
+					}
+				case ImportMerge:
+					set, err := mergeUpdate(invoice, previews[i].Diff)
+					if err != nil {
+						return err
+					}
+					if len(set) == 0 {
+						continue
+					}
+					update := bson.M{"$set": set}
+					if _, changed := set["invoiceTotal"]; changed {
+						existing.InvoiceTotal = invoice.InvoiceTotal
+						set["remainingBalance"] = derivedBalance(existing, existing.RemainingBalance)
+					}
+					if _, changed := set["status"]; changed {
+						update["$push"] = bson.M{
+							"invoiceEvent": transitionEvent(existing.Status, invoice.Status, c.GetString("uid"), "Status changed by import"),
+						}
+					}
+					if _, err := collection.UpdateOne(sessCtx, invoiceKey(invoice), update); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, ErrImportChanged) {
+			c.String(http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Import Invoices")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": outcomes})
+	}
+}
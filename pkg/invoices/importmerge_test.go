@@ -0,0 +1,71 @@
+package invoices
+
+import (
+	"testing"
+)
+
+func TestDiffInvoices(t *testing.T) {
+	existing := Invoice{
+		InvoiceNumber: "10234",
+		BuyerName:     "Jane Doe",
+		BuyerPhone:    "4165550134",
+		InvoiceTotal:  4972,
+		SignatureCdn:  "https://cdn/sig.png",
+		Items:         []InvoiceItem{{ItemLot: 1, Bid: 2500}},
+	}
+
+	same := existing
+	same.SignatureCdn = ""
+	diff, err := diffInvoices(existing, same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Errorf("managed fields should not be diffed, got %+v", diff)
+	}
+
+	changed := same
+	changed.InvoiceTotal = 5210
+	changed.BuyerPhone = ""
+	changed.Items = []InvoiceItem{{ItemLot: 1, Bid: 2700}}
+	diff, err = diffInvoices(existing, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]bool{}
+	for _, d := range diff {
+		fields[d.Field] = true
+	}
+	for _, want := range []string{"invoiceTotal", "buyerPhone", "items"} {
+		if !fields[want] {
+			t.Errorf("missing diff for %s in %+v", want, diff)
+		}
+	}
+
+	// merge keeps the stored phone because the incoming one is empty
+	set, err := mergeUpdate(changed, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := set["buyerPhone"]; ok {
+		t.Error("merge should not clear buyerPhone")
+	}
+	if _, ok := set["invoiceTotal"]; !ok {
+		t.Error("merge should set invoiceTotal")
+	}
+}
+
+func TestOverwriteUpdateKeepsManagedFields(t *testing.T) {
+	set, err := overwriteUpdate(Invoice{InvoiceNumber: "10234", BuyerPhone: "", SignatureCdn: "https://cdn/sig.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field := range importManagedFields {
+		if _, ok := set[field]; ok {
+			t.Errorf("overwrite sets managed field %s", field)
+		}
+	}
+	if _, ok := set["buyerPhone"]; !ok {
+		t.Error("overwrite should clear buyerPhone")
+	}
+}
@@ -7,19 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
-	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
-	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/dslipak/pdf"
 	"github.com/gin-gonic/gin"
 	"github.com/minio/minio-go/v7"
 	"go.mongodb.org/mongo-driver/bson"
@@ -34,53 +27,57 @@ var invoiceTimeFormat string = "2006-01-02 15:04:05 -0700 MST"
 var signatureBucket string = "258-signatures"
 var invoiceBucket string = "258-invoices"
 
-func roundFloat(val float64, precision uint) float64 {
-	ratio := math.Pow(10, float64(precision))
-	return math.Round(val*ratio) / ratio
-}
-
 type Invoice struct {
 	InvoiceNumber    string         `json:"invoiceNumber" bson:"invoiceNumber" binding:"required" validate:"required"`
-	Time             string         `json:"time" bson:"time" validate:"required"`
+	Time             Timestamp      `json:"time" bson:"time" validate:"required"`
 	BuyerName        string         `json:"buyerName" bson:"buyerName" validate:"required"`
 	BuyerEmail       string         `json:"buyerEmail" bson:"buyerEmail" validate:"required"`
 	BuyerAddress     string         `json:"buyerAddress" bson:"buyerAddress"`
 	ShippingAddress  string         `json:"shippingAddress" bson:"shippingAddress"`
 	BuyerPhone       string         `json:"buyerPhone" bson:"buyerPhone"`
 	AuctionLot       int            `json:"auctionLot" bson:"auctionLot"`
-	InvoiceTotal     float32        `json:"invoiceTotal" bson:"invoiceTotal"`
-	RemainingBalance float32        `json:"remainingBalance" bson:"remainingBalance"`
-	Tax              float64        `json:"tax" bson:"tax"`
-	Status           string         `json:"status" bson:"status"`
-	TotalHandlingFee float32        `json:"totalHandlingFee" bson:"totalHandlingFee"`
+	InvoiceTotal     Money          `json:"invoiceTotal" bson:"invoiceTotal"`
+	RemainingBalance Money          `json:"remainingBalance" bson:"remainingBalance"`
+	Tax              Money          `json:"tax" bson:"tax"`
+	TaxProvince      string         `json:"taxProvince" bson:"taxProvince"`
+	TaxBreakdown     []TaxLine      `json:"taxBreakdown" bson:"taxBreakdown"`
+	Status           InvoiceStatus  `json:"status" bson:"status"`
+	TotalHandlingFee Money          `json:"totalHandlingFee" bson:"totalHandlingFee"`
 	PaymentMethod    string         `json:"paymentMethod" bson:"paymentMethod"`
 	InvoiceEvent     []InvoiceEvent `json:"invoiceEvent" bson:"invoiceEvent"`
+	Payments         []Payment      `json:"payments" bson:"payments"`
+	Refunds          []RefundRecord `json:"refunds" bson:"refunds"`
+	RefundTotal      Money          `json:"refundTotal" bson:"refundTotal"`
 	Items            []InvoiceItem  `json:"items" bson:"items"`
 	IsShipping       bool           `json:"isShipping" bson:"isShipping"`
-	BuyersPremium    float32        `json:"buyersPremium" bson:"buyersPremium"`
+	BuyersPremium    Money          `json:"buyersPremium" bson:"buyersPremium"`
 	SignatureCdn     string         `json:"signatureCdn" bson:"signatureCdn"`
-	PickupTime       string         `json:"pickupTime" bson:"pickupTime"`
+	PickupTime       Timestamp      `json:"pickupTime" bson:"pickupTime"`
 	ReturnSigCdn     string         `json:"returnSigCdn" bson:"returnSigCdn"`
-	ReturnTime       string         `json:"returnTime" bson:"returnTime"`
+	ReturnTime       Timestamp      `json:"returnTime" bson:"returnTime"`
 	InvoiceCdn       string         `json:"invoiceCdn" bson:"invoiceCdn"`
 }
 
 type InvoiceEvent struct {
-	Title string `json:"title" bson:"title"`
-	Desc  string `json:"desc" bson:"desc"`
-	Time  string `json:"time" bson:"time"`
+	Title string    `json:"title" bson:"title"`
+	Desc  string    `json:"desc" bson:"desc"`
+	Time  Timestamp `json:"time" bson:"time"`
+	// firebase uid of the staff member, empty for events from the pdf
+	Actor string        `json:"actor,omitempty" bson:"actor,omitempty"`
+	From  InvoiceStatus `json:"from,omitempty" bson:"from,omitempty"`
+	To    InvoiceStatus `json:"to,omitempty" bson:"to,omitempty"`
 }
 
 type InvoiceItem struct {
 	Sku           int     `json:"sku" bson:"sku"`
-	Msrp          float32 `json:"msrp" bson:"msrp"`
+	Msrp          Money   `json:"msrp" bson:"msrp"`
 	ShelfLocation string  `json:"shelfLocation" bson:"shelfLocation"`
 	ItemLot       int     `json:"itemLot" bson:"itemLot"`
 	Desc          string  `json:"desc" bson:"desc"`
-	Bid           float32 `json:"bid" bson:"bid"`
+	Bid           Money   `json:"bid" bson:"bid"`
 	Unit          float32 `json:"unit" bson:"unit"`
-	ExtendedPrice float32 `json:"extendedPrice" bson:"extendedPrice"` // unit * unitPrice
-	HandlingFee   float32 `json:"handlingFee" bson:"handlingFee"`
+	ExtendedPrice Money   `json:"extendedPrice" bson:"extendedPrice"` // unit * unitPrice
+	HandlingFee   Money   `json:"handlingFee" bson:"handlingFee"`
 }
 
 func getCDN(bucket string, fileName string) string {
@@ -94,18 +91,20 @@ func UploadToSpace(
 	ctx context.Context,
 	storageClient *minio.Client,
 	bucket string,
-	file multipart.File,
-	header *multipart.FileHeader,
+	file io.Reader,
+	fileName string,
+	size int64,
+	contentType string,
 ) string {
 	// upload pdf file to space object storage
 	uploaded, uploadErr := storageClient.PutObject(
 		ctx,
 		bucket,
-		header.Filename,
+		fileName,
 		file,
-		header.Size,
+		size,
 		minio.PutObjectOptions{
-			ContentType: header.Header.Get("Content-Type"),
+			ContentType: contentType,
 			UserMetadata: map[string]string{
 				"x-amz-acl": "public-read",
 			},
@@ -137,413 +136,44 @@ func FillItemDataFromDB(invoice Invoice, collection *mongo.Collection) (Invoice,
 	// loop all invoice items
 	var newItemArr []InvoiceItem
 	for _, item := range invoice.Items {
-		// construct mongo db filter
-		fil := bson.M{
-			"lot":                  invoice.AuctionLot,
-			"soldItems.clotNumber": item.ItemLot,
-		}
-
-		// find item in remaining record
-		var res struct{ SoldItems []SoldItem }
-		err := collection.FindOne(
-			ctx,
-			fil,
-			options.FindOne().SetProjection(bson.M{"soldItems.$": 1}),
-		).Decode(&res)
+		filled, err := recordedItem(ctx, collection, invoice.AuctionLot, item)
 		if err != nil {
-			return invoice, errors.New("cannot find invoice item in remaining record")
+			return invoice, err
 		}
-
-		// unpack and set datas
-		inv := res.SoldItems[0]
-		item.Desc = inv.Lead
-		item.Bid = float32(inv.Bid)
-		item.ShelfLocation = inv.ShelfLocation
-		item.Sku = inv.Sku
-		newItemArr = append(newItemArr, item)
+		newItemArr = append(newItemArr, filled)
 	}
 	invoice.Items = newItemArr
 	return invoice, nil
 }
 
-// split the invoice text into parts
-// header, items rows, footer
-func splitInvoice(text string) (map[string]any, error) {
-	var invoiceInfo = map[string]any{}
-
-	// this split the body and header
-	re := regexp.MustCompile(`PRICEEXTENDEDPRICE`)
-
-	// get index of `PRICEEXTENDEDPRICE`
-	index := re.FindStringIndex(text)
-
-	// if found, store first part and rest in array
-	var rest string
-	if index != nil {
-		header := text[:index[1]]
-		invoiceInfo["header"] = header
-		rest = text[index[1]:]
-	} else {
-		return invoiceInfo, errors.New("cannot find PRICEEXTENDEDPRICE to split the header")
-	}
-
-	// split the items and footer
-	itemRe := regexp.MustCompile(`MSRP:(.*?)Item handling`)
-	matches := itemRe.FindAllStringSubmatch(rest, -1)
-
-	// store all items in an array
-	var invoiceItems []string
-	for _, match := range matches {
-		if len(match) > 1 {
-			invoiceItems = append(invoiceItems, strings.TrimSpace(match[1]))
-		}
-	}
-	invoiceInfo["items"] = invoiceItems
-
-	// get handling fee for all items
-	handlingFeePattern := regexp.MustCompile(`Item handling fee\s*-\s*(.*?)\s*T`)
-	handlingFeeMatches := handlingFeePattern.FindAllStringSubmatch(rest, -1)
-	var handlingFees []string
-	for _, match := range handlingFeeMatches {
-		if len(match) > 1 {
-			handlingFees = append(handlingFees, strings.TrimSpace(match[1]))
-		}
-	}
-	invoiceInfo["itemHandlingFees"] = handlingFees
-
-	// get unit for all items
-	unitPattern := regexp.MustCompile(`(\d+)\s*x\s*\d+\.\d{2}`)
-	unitMatches := unitPattern.FindAllStringSubmatch(rest, -1)
-	var unit []float32
-	for _, match := range unitMatches {
-		f, err := strconv.ParseFloat(strings.TrimSpace(match[1]), 32)
-		if err != nil {
-			fmt.Println(err.Error())
-		}
-		unit = append(unit, float32(f))
-	}
-	invoiceInfo["unitsArr"] = unit
-	fmt.Println(unit)
-
-	// get footer
-	pattern := `\d+\.\d{2}\s*Total Extended Price:`
-	footerRe := regexp.MustCompile(pattern)
-	matchIndex := footerRe.FindStringIndex(rest)
-	if matchIndex != nil {
-		after := rest[matchIndex[0]:]
-		invoiceInfo["footer"] = after
-	}
-
-	fmt.Println(text)
-	return invoiceInfo, nil
-}
-
-func processSplitInvoice(result map[string]any) Invoice {
-	var newInvoice Invoice
-
-	//  header items footer
-	header := result["header"].(string)
-	items := result["items"].([]string)
-	footer := result["footer"].(string)
-
-	// get auction lot
-	auctionLotPattern := regexp.MustCompile(`Auction Sale - (\d+)`)
-	auctionLotMatch := auctionLotPattern.FindStringSubmatch(header)
-	if len(auctionLotMatch) > 1 {
-		newInvoice.AuctionLot, _ = strconv.Atoi(auctionLotMatch[1])
-	}
-
-	// get invoice number
-	invoiceNumberPattern := regexp.MustCompile(`\s+1\s+(\d+)\s*Auction Sale`)
-	invoiceNumberMatch := invoiceNumberPattern.FindStringSubmatch(header)
-	if len(invoiceNumberMatch) > 1 {
-		newInvoice.InvoiceNumber = strings.TrimSpace(invoiceNumberMatch[1])
-	}
-
-	// get buyer name, address, shipping address, email
-	// check if invoice is shipping
-	isShipping := strings.Contains(header, "SHIP TO:")
-	if isShipping {
-		// set invoice status
-		newInvoice.IsShipping = true
-
-		// email will be in between "ship to:" and "lot #"
-		buyerEmailPattern := regexp.MustCompile(`SHIP TO:\s*(.*?)Lot#`)
-		buyerEmailMatch := buyerEmailPattern.FindStringSubmatch(header)
-		if len(buyerEmailMatch) > 1 {
-			newInvoice.BuyerEmail = strings.TrimSpace(buyerEmailMatch[1])
-		}
-
-		// buyer name and shipping address
-		buyerNameAddressPattern := regexp.MustCompile(`SOLD TO:\s*(.*?)SHIP TO:`)
-		buyerNameAddressPatternMatch := buyerNameAddressPattern.FindStringSubmatch(header)
-		if len(buyerNameAddressPatternMatch) > 1 {
-			buyerInfo := strings.TrimSpace(buyerNameAddressPatternMatch[1])
-
-			// split buyer name and shipping address
-			re := regexp.MustCompile(`\d`)
-			firstNumberIndex := re.FindStringIndex(buyerInfo)
-			if firstNumberIndex != nil {
-				newInvoice.BuyerName = strings.TrimSpace(buyerInfo[:firstNumberIndex[0]])
-				newInvoice.ShippingAddress = strings.TrimSpace(buyerInfo[firstNumberIndex[0]:])
-			}
-		}
-	} else {
-		// email will be in between "sold to:" and "lot #"
-		buyerEmailPattern := regexp.MustCompile(`SOLD TO:\s*(.*?)Lot#`)
-		buyerEmailMatch := buyerEmailPattern.FindStringSubmatch(header)
-		if len(buyerEmailMatch) > 1 {
-			newInvoice.BuyerEmail = strings.TrimSpace(buyerEmailMatch[1])
-		}
-	}
-
-	// get invoice total and remaining balance
-	invoiceBalancePattern := regexp.MustCompile(`Default:\s*(.*?)\s*Invoice Total:`)
-	invoiceBalanceMatch := invoiceBalancePattern.FindStringSubmatch(footer)
-	// flag to check if match is float
-	var isFloat bool = true
-	if len(invoiceBalanceMatch) > 1 {
-		res := strings.TrimSpace(invoiceBalanceMatch[1])
-		// repace $ with space
-		clean := strings.ReplaceAll(res, "$", " ")
-
-		// split into array
-		parts := strings.Fields(clean)
-
-		// parse float
-		total, totalErr := strconv.ParseFloat(parts[0], 32)
-		if totalErr != nil {
-			isFloat = false
-			fmt.Println(totalErr)
-		}
-		remaining, remainingErr := strconv.ParseFloat(parts[1], 32)
-		if remainingErr != nil {
-			isFloat = false
-			fmt.Println(remainingErr)
-		}
-
-		// if they are float set them to invoice
-		if isFloat {
-			newInvoice.InvoiceTotal = float32(total)
-			newInvoice.RemainingBalance = float32(remaining)
-		}
-	}
-
-	if len(invoiceBalanceMatch) < 1 || !isFloat {
-		invoiceBalancePattern2 := regexp.MustCompile(`PAID IN FULL\s*(.*?)\s*Invoice Total:`)
-		invoiceBalanceMatch2 := invoiceBalancePattern2.FindStringSubmatch(footer)
-		match := strings.TrimSpace(invoiceBalanceMatch2[1])
-		// repace $ with space
-		clean := strings.ReplaceAll(match, "$", " ")
-
-		// split into array
-		parts := strings.Fields(clean)
-
-		// parse float
-		total, totalErr := strconv.ParseFloat(parts[0], 32)
-		if totalErr != nil {
-			fmt.Println(totalErr)
-		}
-		remaining, remainingErr := strconv.ParseFloat(parts[1], 32)
-		if remainingErr != nil {
-			fmt.Println(remainingErr)
-		}
-		newInvoice.InvoiceTotal = float32(total)
-		newInvoice.RemainingBalance = float32(remaining)
-	}
-
-	// get invoice time
-	timePattern1 := regexp.MustCompile(`\)\s*(.*?)\s*Invoice #:`)
-	timePattern2 := regexp.MustCompile(`(\d{1,2}/\d{1,2}/\d{4} \d{1,2}:\d{2}:\d{2})`)
-	timeMatch1 := timePattern1.FindStringSubmatch(header)
-	timeMatch2 := timePattern2.FindStringSubmatch(header)
-	var timeStr string = ""
-	if len(timeMatch1) > 1 {
-		timeStr = strings.TrimSpace(timeMatch1[1])
-	} else if len(timeMatch2) > 1 {
-		timeStr = strings.TrimSpace(timeMatch2[1])
-	}
-	if timeStr != "" {
-		var parsedTime, err = time.ParseInLocation(
-			"2006-01-02 15:04:05",
-			timeStr,
-			time.Now().Location(),
-		)
-		if err != nil {
-			parsedTime, err = time.ParseInLocation(
-				"1/2/2006 3:04:05",
-				timeStr,
-				time.Now().Location(),
-			)
-			if err != nil {
-				fmt.Println("cannot parse time")
-			}
-		}
-		newInvoice.Time = parsedTime.String()
-	}
-
-	// get buyer address and name
-	// if paid invoice the buyer address regex is different
-	invoicePaid := strings.Contains(header, "PAID IN FULL")
-	var buyerAddressPattern *regexp.Regexp
-	if !invoicePaid {
-		newInvoice.Status = "unpaid"
-		buyerAddressPattern = regexp.MustCompile(`\*\*\d{4}(.*?)Phone`)
-		newInvoice.InvoiceEvent = append(
-			newInvoice.InvoiceEvent,
-			InvoiceEvent{
-				Title: "Invoice Unpaid",
-				Desc:  "Invoice unpaid on issue",
-				Time:  newInvoice.Time,
-			},
-		)
-	} else {
-		newInvoice.Status = "paid"
-		newInvoice.PaymentMethod = "card"
-		newInvoice.InvoiceEvent = append(
-			newInvoice.InvoiceEvent,
-			InvoiceEvent{
-				Title: "Invoice Paid",
-				Desc:  "Invoice paid on issue",
-				Time:  newInvoice.Time,
-			},
-		)
-		buyerAddressPattern = regexp.MustCompile(`PAID IN FULL(.*?)Phone`)
-	}
-
-	buyerAddressPatternMatch := buyerAddressPattern.FindStringSubmatch(header)
-	if len(buyerAddressPatternMatch) > 1 {
-		nameAddress := strings.TrimSpace(buyerAddressPatternMatch[1])
-		// split buyer name and shipping address
-		re := regexp.MustCompile(`\d`)
-		firstNumberIndex := re.FindStringIndex(nameAddress)
-		if firstNumberIndex != nil {
-			if newInvoice.BuyerName == "" {
-				newInvoice.BuyerName = strings.TrimSpace(nameAddress[:firstNumberIndex[0]])
-			}
-			newInvoice.BuyerAddress = strings.TrimSpace(nameAddress[firstNumberIndex[0]:])
-		}
-	}
-
-	// buyer phone
-	buyerPhonePattern := regexp.MustCompile(`Phone:\s*(.*?)\s*#`)
-	buyerPhoneMatch := buyerPhonePattern.FindStringSubmatch(header)
-	var buyerPhone string
-	if len(buyerPhoneMatch) > 1 {
-		buyerPhone = strings.TrimSpace(buyerPhoneMatch[1])
-		buyerPhone = strings.ReplaceAll(buyerPhone, "-", "")
-		buyerPhone = strings.ReplaceAll(buyerPhone, " ", "")
-		newInvoice.BuyerPhone = buyerPhone
-	}
+var ErrItemNotRecorded = errors.New("cannot find invoice item in remaining record")
 
-	unitsArr := result["unitsArr"].([]float32)
-	var itemsArr []InvoiceItem
-	for index, value := range items {
-		var invoiceItem InvoiceItem
-
-		// get rid of dollar sign and T
-		item := strings.ReplaceAll(value, "$", "")
-		item = strings.ReplaceAll(item, "T", " ")
-		item = strings.TrimSpace(item)
-		// split into string array by space
-		datas := strings.Fields(item)
-
-		// set unit amount by units array
-		invoiceItem.Unit = float32(unitsArr[index])
-
-		// if check for error case
-		// example error case $ 10.98Y17 43430T651 => 10.98Y17 43430 651 (len<4)
-		// example error case $ 27.53 G1043239T563 => 27.53 G1043239 563 (len<4)
-		if len(datas) == 4 {
-			f, err := strconv.ParseFloat(datas[0], 32)
-			if err != nil {
-				fmt.Println(err)
-			}
-			invoiceItem.Msrp = float32(f)
-			invoiceItem.ShelfLocation = datas[1]
-			sku, convertErr := strconv.Atoi(datas[2])
-			if convertErr == nil {
-				invoiceItem.Sku = sku
-			} else {
-				fmt.Println(convertErr.Error())
-			}
-			itemLot, convertErr2 := strconv.Atoi(datas[3])
-			if convertErr2 == nil {
-				invoiceItem.ItemLot = itemLot
-			} else {
-				fmt.Println(convertErr.Error())
-			}
-		} else {
-			// find the msrp by regex
-			msrpPattern := regexp.MustCompile(`\$(.*?)[A-Za-z]`)
-			msrpMatch := msrpPattern.FindStringSubmatch(value)
-			if len(msrpMatch) > 1 {
-				trimmed := strings.TrimSpace(msrpMatch[1])
-				msrp, convertErr := strconv.ParseFloat(trimmed, 32)
-				if convertErr != nil {
-					fmt.Println(convertErr.Error())
-				}
-				invoiceItem.Msrp = float32(msrp)
-			}
-
-			// split it by T and take the lot number
-			itemLot, convertErr := strconv.Atoi(datas[len(datas)-1])
-			if convertErr == nil {
-				invoiceItem.ItemLot = itemLot
-			} else {
-				fmt.Println(convertErr.Error())
-			}
-		}
-		itemsArr = append(itemsArr, invoiceItem)
-	}
-
-	// get handling fees for each item and calculate total
-	var totalHandlingFee float32
-	itemsHandlingFees := result["itemHandlingFees"].([]string)
-	for index, val := range itemsHandlingFees {
-		f, err := strconv.ParseFloat(val, 32)
-		if err != nil {
-			fmt.Println(err.Error())
-		}
-		itemsArr[index].HandlingFee = float32(f)
-		totalHandlingFee += float32(f)
-	}
-
-	// set total handling fee
-	newInvoice.TotalHandlingFee = totalHandlingFee
-
-	// set items array
-	newInvoice.Items = itemsArr
-
-	// get tax
-	totalTaxPattern := regexp.MustCompile(`Quantity:\s*(.*?)\s*Tax1`)
-	totalTaxMatch := totalTaxPattern.FindStringSubmatch(footer)
-	if len(totalTaxMatch) > 1 {
-		float, parseErr := strconv.ParseFloat(totalTaxMatch[1], 32)
-		if parseErr != nil {
-			fmt.Println(parseErr.Error())
-		}
-		newInvoice.Tax = float
+// item with description, bid, shelf and sku from the remaining record of its lot
+func recordedItem(ctx context.Context, collection *mongo.Collection, auctionLot int, item InvoiceItem) (InvoiceItem, error) {
+	// construct mongo db filter
+	fil := bson.M{
+		"lot":                  auctionLot,
+		"soldItems.clotNumber": item.ItemLot,
 	}
 
-	// get buyer premium if there is any
-	isBuyerPremium := strings.Contains(footer, "Premium:")
-	if isBuyerPremium {
-		buyersPremiumPattern := regexp.MustCompile(`(.*)Total Extended Price:`)
-		buyersPremiumMatch := buyersPremiumPattern.FindStringSubmatch(footer)
-		if len(buyersPremiumMatch) > 1 {
-			float, parseErr := strconv.ParseFloat(buyersPremiumMatch[1], 64)
-			if parseErr != nil {
-				fmt.Println(parseErr.Error())
-			}
-			fl := roundFloat(float, 2)
-			newInvoice.BuyersPremium = float32(fl)
-		}
-	} else {
-		newInvoice.BuyersPremium = 0
+	// find item in remaining record
+	var res struct{ SoldItems []SoldItem }
+	err := collection.FindOne(
+		ctx,
+		fil,
+		options.FindOne().SetProjection(bson.M{"soldItems.$": 1}),
+	).Decode(&res)
+	if err != nil || len(res.SoldItems) == 0 {
+		return item, ErrItemNotRecorded
 	}
 
-	return newInvoice
+	// unpack and set datas
+	inv := res.SoldItems[0]
+	item.Desc = inv.Lead
+	item.Bid = MoneyFromFloat(inv.Bid)
+	item.ShelfLocation = inv.ShelfLocation
+	item.Sku = inv.Sku
+	return item, nil
 }
 
 // this one only process UNPAID invoice pdf
@@ -565,132 +195,67 @@ func CreateInvoiceFromPDF(storageClient *minio.Client, collection *mongo.Collect
 			return
 		}
 
-		// remove header and footer
-		textToRemoveArr := []string{
-			"Monday: CloseTuesday - Saturday: 12:00pm - 6:30pm",
-			"CC Power Deals240 Bartor Road, Unit 4, North York, ON, M9M 2W6+1 416-740-2333",
-			"READ NEW TERMS OF USE BEFORE YOU BID!",
-			"READ EMAIL FOR PICK-UP & SHIPPING INSTRUCTIONS",
-			"Sunday: CloseWe Asked All Items Should Check at Our Location",
-			"NO RETURN AND REFUND",
-			"#:Date:Page:UNPAIDLot#DESCRIPTIONUNIT PRICEEXTENDEDPRICE",
-			"Monday & Sunday: CloseTuesday - Saturday: 12:00pm - 6:30pmWe Asked All Items Should Check at Our Location",
+		// invoice template name, empty or "auto" to detect from text
+		templateName := c.Request.FormValue("template")
+
+		// check if bucket exist before uploading anything
+		if toUpload {
+			exists, existErr := storageClient.BucketExists(ctx, invoiceBucket)
+			if existErr != nil || !exists {
+				c.String(http.StatusInternalServerError, "No Such Bucket")
+				return
+			}
 		}
 
 		var invoices []Invoice
-		// multiple pdf
-		for name, files := range form.File {
-			// open every file and upload
+		var reports []ParseReport
+		var fileErrors []FileError
+		// multiple pdf, a bad file is reported and skipped without failing the batch
+		for _, files := range form.File {
 			for _, fileHeader := range files {
-				// chekc file size
-				if fileHeader.Size > 10*1024*1024 {
-					c.String(http.StatusBadRequest, "File Size Must Not Exceed 10 MB")
-					break
-				}
-
-				// open file from file handler
-				file, err := fileHeader.Open()
-				if err != nil {
-					c.String(http.StatusBadRequest, "Cannot Read File")
-					return
-				}
-				defer file.Close()
-
-				// Check the file extension
-				if filepath.Ext(name) != ".pdf" {
-					c.String(http.StatusBadRequest, "Please Only Upload PDF File")
-					return
-				}
-
-				var cdnLink string = ""
-				// upload invoice to space object storage if uploadPDF in form is true
-				if toUpload {
-					// check if bucket exist
-					exists, existErr := storageClient.BucketExists(ctx, invoiceBucket)
-					if existErr != nil || !exists {
-						c.String(http.StatusInternalServerError, "No Such Bucket")
-						return
-					}
-					cdnLink = UploadToSpace(ctx, storageClient, invoiceBucket, file, fileHeader)
-				}
-
-				// create temp file from buffer
-				tmp, createErr := os.CreateTemp("./pdf", "*.pdf")
-				if createErr != nil {
-					c.String(http.StatusInternalServerError, "Error Creating Temp File: %v", createErr.Error())
-					return
-				}
-				defer func() {
-					closeErr := tmp.Close()
-					if closeErr != nil {
-						fmt.Println(closeErr.Error())
-					}
-					removeErr := os.Remove(tmp.Name())
-					if removeErr != nil {
-						fmt.Println(removeErr.Error())
-					}
-				}()
-
-				// write data into tmp file
-				var _, copyErr = io.Copy(tmp, file)
-				if copyErr != nil {
-					c.String(http.StatusInternalServerError, "Error Writing Temp File: %v", copyErr.Error())
-					return
-				}
-
-				// get file size
-				tmpFileInformation, fileInfoErr := tmp.Stat()
-				if fileInfoErr != nil {
-					tmp.Close()
-					c.String(http.StatusInternalServerError, fileInfoErr.Error())
-				}
-
-				// make reader
-				pdfObj, readerErr := pdf.NewReader(tmp, tmpFileInformation.Size())
-				if readerErr != nil {
-					tmp.Close()
-					c.String(http.StatusInternalServerError, readerErr.Error())
+				// check file size and extension
+				if checkErr := checkPDFUpload(fileHeader); checkErr != nil {
+					fileErrors = append(fileErrors, FileError{FileName: fileHeader.Filename, Error: checkErr.Error()})
+					continue
 				}
 
-				// read plain text into buffer
-				var buf bytes.Buffer
-				reader, textErr := pdfObj.GetPlainText()
-				if textErr != nil {
-					fmt.Println(textErr.Error())
-					c.String(http.StatusInternalServerError, textErr.Error())
-					return
+				// read the upload once, shared by the upload and the parser
+				buf, bufErr := bufferUpload(fileHeader)
+				if bufErr != nil {
+					fileErrors = append(fileErrors, FileError{FileName: fileHeader.Filename, Error: bufErr.Error()})
+					continue
 				}
-
-				// remove unwanted text
-				buf.ReadFrom(reader)
-				extractedText := buf.String()
-				for _, val := range textToRemoveArr {
-					extractedText = strings.ReplaceAll(extractedText, val, "")
+				src := pdfSource{
+					FileName:    fileHeader.Filename,
+					ContentType: fileHeader.Header.Get("Content-Type"),
+					Buffer:      buf,
 				}
-
-				// splite invoice text into 3 parts (header, items, footer)
-				re, splitErr := splitInvoice(extractedText)
-				if splitErr != nil {
-					fmt.Println(splitErr.Error())
-					c.String(http.StatusInternalServerError, splitErr.Error())
-					return
+				result, parseErr := parseInvoicePDF(ctx, storageClient, src, toUpload, templateName)
+				buf.Close()
+				if parseErr != nil {
+					fmt.Println(parseErr.Error())
+					fileErrors = append(fileErrors, FileError{FileName: fileHeader.Filename, Error: parseErr.Error()})
+					continue
 				}
 
-				// split and extract data with regex
-				invoice := processSplitInvoice(re)
 				// fill the inventories with data from database
-				fixedInvoice, err1 := FillItemDataFromDB(invoice, collection)
+				fixedInvoice, err1 := FillItemDataFromDB(result.Invoice, collection)
 				if err1 != nil {
-					fmt.Println(err1)
+					result.Diagnostics.Warn("items", "", err1.Error(), 0.5)
+				} else {
+					reconcileTax(&fixedInvoice, &result.Diagnostics)
 				}
-				fixedInvoice.InvoiceCdn = cdnLink
 				invoices = append(invoices, fixedInvoice)
+				reports = append(reports, result.Report(fileHeader.Filename))
 			}
 		}
 
-		// return invoice object
+		// return invoice object, diagnostics are in the same order as data
+		// files that could not be parsed at all are listed in errors
 		c.JSON(http.StatusOK, gin.H{
-			"data": invoices,
+			"data":        invoices,
+			"diagnostics": reports,
+			"errors":      fileErrors,
 		})
 	}
 }
@@ -709,36 +274,76 @@ func UpdateInvoice(collection *mongo.Collection) gin.HandlerFunc {
 			return
 		}
 
-		fmt.Println(newInvoice)
-
 		// in, err := strconv.ParseInt(newInvoice.InvoiceNumber, 0, 32)
 		// if err != nil {
 		// 	c.String(400, "Cannot Convert Invoice Number to Int")
 		// }
 
-		// invNum, err := strconv.Atoi(newInvoice.InvoiceNumber)
-		// if err != nil {
-		// 	c.String(http.StatusBadRequest, "Invalid Body, %s", err.Error())
-		// 	return
-		// }
+		filter := bson.M{
+			"auctionLot": newInvoice.AuctionLot,
+			// "buyerName":  newInvoice.BuyerName,
+			// "time":       newInvoice.Time,
+			"invoiceNumber": newInvoice.InvoiceNumber,
+		}
 
-		// find and update
+		// status can only move along the lifecycle
+		var existing Invoice
+		findErr := collection.FindOne(ctx, filter).Decode(&existing)
+		if findErr != nil {
+			c.String(http.StatusNotFound, "Invoice Not Found")
+			return
+		}
+		if newInvoice.Status != existing.Status {
+			next, err := ParseInvoiceStatus(string(newInvoice.Status))
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := CanTransition(existing, next); err != nil {
+				c.String(transitionErrorCode(err), err.Error())
+				return
+			}
+			newInvoice.Status = next
+		}
+
+		// the ledger only changes through payments, refunds through refundInvoice
+		newInvoice.Payments = existing.Payments
+		newInvoice.Refunds = existing.Refunds
+		newInvoice.RefundTotal = existing.RefundTotal
+		newInvoice.RemainingBalance = derivedBalance(newInvoice, existing.RemainingBalance)
+
+		// the audit trail is only appended to, whatever events the client sent
+		raw, err := bson.Marshal(newInvoice)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+		var set bson.M
+		if err := bson.Unmarshal(raw, &set); err != nil {
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+		delete(set, "invoiceEvent")
+		update := bson.M{"$set": set}
+		if newInvoice.Status != existing.Status {
+			update["$push"] = bson.M{"invoiceEvent": transitionEvent(existing.Status, newInvoice.Status, c.GetString("uid"), "")}
+		}
+
+		// find and update, only if nobody changed the status meanwhile
+		filter["status"] = existing.Status
 		res := collection.FindOneAndUpdate(
 			ctx,
-			bson.M{
-				"auctionLot": newInvoice.AuctionLot,
-				// "buyerName":  newInvoice.BuyerName,
-				// "time":       newInvoice.Time,
-				"invoiceNumber": newInvoice.InvoiceNumber,
-			},
-			bson.M{"$set": newInvoice},
+			filter,
+			update,
 			options.FindOneAndUpdate().SetReturnDocument(options.After),
 		)
 		var result bson.M
 		decodeErr := res.Decode(&result)
-		if result != nil && decodeErr != nil {
-			c.String(200, "Update Success")
+		if decodeErr != nil {
+			c.String(http.StatusConflict, ErrStatusChanged.Error())
+			return
 		}
+		c.String(200, "Update Success")
 	}
 }
 
@@ -755,40 +360,55 @@ func CreateInvoice(collection *mongo.Collection) gin.HandlerFunc {
 			return
 		}
 
-		// loop all invoices
-		for _, invoice := range newInvoice {
-			count, err := collection.CountDocuments(
-				ctx,
-				bson.M{
-					"buyerName":     invoice.BuyerName,
-					"invoiceNumber": invoice.InvoiceNumber,
-				},
-			)
+		// every invoice starts from a known status
+		for i := range newInvoice {
+			status, err := ParseInvoiceStatus(string(newInvoice[i].Status))
 			if err != nil {
-				c.String(500, "Cannot Count Documents")
+				c.String(http.StatusBadRequest, err.Error())
 				return
 			}
+			newInvoice[i].Status = status
+			applyCalculatedTax(&newInvoice[i])
+			newInvoice[i].RemainingBalance = derivedBalance(newInvoice[i], newInvoice[i].RemainingBalance)
+		}
 
-			// if not found, insert it into db
-			if count == 0 {
-				_, err := collection.InsertOne(ctx, invoice)
+		// insert all invoices in one transaction, an existing one aborts the whole batch
+		errExists := errors.New("documents exists")
+		err := withTransaction(ctx, collection, func(sessCtx mongo.SessionContext) error {
+			for _, invoice := range newInvoice {
+				count, err := collection.CountDocuments(sessCtx, invoiceKey(invoice))
 				if err != nil {
-					c.String(500, "Cannot Insert Documents")
-					return
+					return err
+				}
+				if count != 0 {
+					return errExists
+				}
+				if _, err := collection.InsertOne(sessCtx, invoice); err != nil {
+					return err
 				}
-			} else {
-				c.String(500, "Documents Exists")
-				return
 			}
+			return nil
+		})
+		if errors.Is(err, errExists) {
+			c.String(500, "Documents Exists")
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(500, "Cannot Insert Documents")
+			return
 		}
 		c.String(200, "Invoices Uploaded")
 	}
 }
 
+// invoice number and buyer name are the invoice key, time is accepted from older clients but not matched
+// since invoices not migrated yet still store it as a string
 type DeleteRequest struct {
-	InvoiceNumber string `json:"invoiceNumber" bson:"invoiceNumber"`
-	BuyerName     string `json:"buyerName" bson:"buyerName"`
-	Time          string `json:"time" bson:"time"`
+	InvoiceNumber string    `json:"invoiceNumber" bson:"invoiceNumber" binding:"required"`
+	BuyerName     string    `json:"buyerName" bson:"buyerName"`
+	AuctionLot    int       `json:"auctionLot" bson:"auctionLot"`
+	Time          Timestamp `json:"time" bson:"time"`
 }
 
 // delete invoice from database
@@ -803,21 +423,20 @@ func DeleteInvoice(collection *mongo.Collection) gin.HandlerFunc {
 			return
 		}
 
-		res, err := collection.DeleteOne(
-			ctx,
-			bson.M{
-				"invoiceNumber": request.InvoiceNumber,
-				"buyerName":     request.BuyerName,
-				"time":          request.Time,
-			},
-		)
+		filter := invoiceKey(Invoice{InvoiceNumber: request.InvoiceNumber, BuyerName: request.BuyerName})
+		if request.AuctionLot != 0 {
+			filter["auctionLot"] = request.AuctionLot
+		}
+		res, err := collection.DeleteOne(ctx, filter)
 		if err != nil {
 			c.String(500, "Cannot Delete From Database")
 			return
 		}
-		if res != nil {
-			c.String(200, "Successfully Deleted")
+		if res.DeletedCount == 0 {
+			c.String(http.StatusNotFound, "Invoice Not Found")
+			return
 		}
+		c.String(200, "Successfully Deleted")
 	}
 }
 
@@ -827,7 +446,171 @@ var requestBody struct {
 	NewLot string `json:"newLot"`
 }
 
-func UploadSignature(storageClient *minio.Client, collection *mongo.Collection) gin.HandlerFunc {
+var ErrInvalidSignatureName = errors.New("invalid signature name")
+
+// a signature image to store against an invoice
+type SignatureUpload struct {
+	// {invoiceNumber}_{action}, action is pickup or return
+	FileName   string
+	AuctionLot string
+	// png bytes
+	Image []byte
+	Actor string
+}
+
+// stores signature images, both /uploadSignature and the websocket session store through it
+type SignatureStore interface {
+	// check the invoice exists and may take the signature, nothing is stored
+	CheckSignature(ctx context.Context, upload SignatureUpload) error
+	StoreSignature(ctx context.Context, upload SignatureUpload) (string, error)
+}
+
+// signatures in the space bucket, linked on the invoice
+type spaceSignatureStore struct {
+	storageClient *minio.Client
+	collection    *mongo.Collection
+}
+
+func NewSignatureStore(storageClient *minio.Client, collection *mongo.Collection) SignatureStore {
+	return spaceSignatureStore{storageClient: storageClient, collection: collection}
+}
+
+// the invoice a signature is for, the status it moves to and whether it keeps its status instead
+// fails when the invoice is missing or cannot move to picked up or refunded
+func (s spaceSignatureStore) signatureInvoice(ctx context.Context, upload SignatureUpload) (Invoice, InvoiceStatus, bool, error) {
+	// split the file name for invoice number and action ({invoiceNumber}_{action})
+	split := strings.Split(upload.FileName, "_")
+	if len(split) < 2 {
+		return Invoice{}, "", false, ErrInvalidSignatureName
+	}
+	isPickup := split[1] == "pickup"
+
+	// convert lot to number
+	floatLot, err := strconv.ParseFloat(upload.AuctionLot, 64)
+	if err != nil {
+		return Invoice{}, "", false, ErrInvalidAuctionLot
+	}
+
+	var invoice Invoice
+	findErr := s.collection.FindOne(
+		ctx,
+		bson.M{
+			"invoiceNumber": split[0],
+			"auctionLot":    floatLot,
+		},
+	).Decode(&invoice)
+	if findErr != nil {
+		return Invoice{}, "", false, ErrInvoiceNotFound
+	}
+	next := StatusPickedUp
+	if !isPickup {
+		next = StatusRefunded
+	}
+	// signing again, or a return after an itemized refund, keeps the status
+	keepStatus := invoice.Status == next || (!isPickup && invoice.Status == StatusPartiallyRefunded)
+	if !keepStatus {
+		if err := CanTransition(invoice, next); err != nil {
+			return Invoice{}, next, false, err
+		}
+	}
+	return invoice, next, keepStatus, nil
+}
+
+func (s spaceSignatureStore) CheckSignature(ctx context.Context, upload SignatureUpload) error {
+	_, _, _, err := s.signatureInvoice(ctx, upload)
+	return err
+}
+
+// upload the image, link it on the invoice and move the invoice to picked up or refunded
+// returns the cdn url of the image
+func (s spaceSignatureStore) StoreSignature(ctx context.Context, upload SignatureUpload) (string, error) {
+	// check the status change before storing anything
+	invoice, next, keepStatus, err := s.signatureInvoice(ctx, upload)
+	if err != nil {
+		return "", err
+	}
+	isPickup := next == StatusPickedUp
+
+	// create buffer for decoded image data
+	imageBuffer := bytes.NewBuffer(upload.Image)
+	uploadName := upload.FileName + "_" + upload.AuctionLot + "_sig.png"
+	// put object into digital ocean space storage
+	uploaded, uploadErr := s.storageClient.PutObject(
+		ctx,
+		signatureBucket,
+		uploadName,
+		imageBuffer,
+		int64(imageBuffer.Len()),
+		minio.PutObjectOptions{
+			ContentType: "image/png",
+			UserMetadata: map[string]string{
+				"x-amz-acl": "public-read",
+			},
+		},
+	)
+	if uploadErr != nil {
+		fmt.Println(uploadErr)
+		return "", uploadErr
+	}
+
+	// construct CDN url
+	cdnURL := fmt.Sprintf("https://%s.%s/%s", signatureBucket, "nyc3.digitaloceanspaces.com", uploaded.Key)
+
+	// current business time
+	formattedTime := eventTime()
+
+	// if return add return else add signature
+	updateBson := bson.M{}
+	if isPickup {
+		updateBson["signatureCdn"] = cdnURL
+		updateBson["pickupTime"] = formattedTime
+	} else {
+		updateBson["returnSigCdn"] = cdnURL
+		updateBson["returnTime"] = formattedTime
+	}
+
+	// push to db
+	if keepStatus {
+		newEvent := InvoiceEvent{
+			Title: "Return Signature",
+			Desc:  "Customer returned",
+			Time:  formattedTime,
+			Actor: upload.Actor,
+		}
+		if isPickup {
+			newEvent.Title = "Pickup Signature"
+			newEvent.Desc = "Customer signed again"
+		}
+		_, err = s.collection.UpdateOne(
+			ctx,
+			bson.M{
+				"invoiceNumber": invoice.InvoiceNumber,
+				"buyerName":     invoice.BuyerName,
+			},
+			bson.M{
+				"$set":  updateBson,
+				"$push": bson.M{"invoiceEvent": newEvent},
+			},
+		)
+	} else {
+		desc := "Customer signed and picked up"
+		if !isPickup {
+			desc = "Customer returned"
+		}
+		_, err = applyTransition(ctx, s.collection, invoice, StatusChange{
+			To:    next,
+			Actor: upload.Actor,
+			Desc:  desc,
+			Set:   updateBson,
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	return cdnURL, nil
+}
+
+func UploadSignature(signatures SignatureStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 
@@ -846,105 +629,25 @@ func UploadSignature(storageClient *minio.Client, collection *mongo.Collection)
 			return
 		}
 
-		// create buffer for decoded image data
-		imageBuffer := bytes.NewBuffer(imageData)
-		// fmt.Println("BUF LEN:")
-		// fmt.Println(int64(imageBuffer.Len()))
-
 		// get filename from path parameters
-		fileName := c.Param("nom")
-
-		// split the file name for invoice number and action ({invoiceNumber}_{action})
-		split := strings.Split(fileName, "_")
-		// fmt.Printf("Invoice: %s", split[0])
-
-		uploadName := fileName + "_" + requestBody.NewLot + "_sig.png"
-		// put object into digital ocean space storage
-		uploaded, uploadErr := storageClient.PutObject(
-			ctx,
-			signatureBucket,
-			uploadName,
-			imageBuffer,
-			int64(imageBuffer.Len()),
-			minio.PutObjectOptions{
-				ContentType: "image/png",
-				UserMetadata: map[string]string{
-					"x-amz-acl": "public-read",
-				},
-			},
-		)
-		if uploadErr != nil {
-			fmt.Println(uploadErr)
-		}
-
-		// construct CDN url
-		cdnURL := fmt.Sprintf("https://%s.%s/%s", signatureBucket, "nyc3.digitaloceanspaces.com", uploaded.Key)
-
-		// convert time to local time (eastern)
-		location, err := time.LoadLocation("America/New_York")
-		if err != nil {
-			fmt.Println("Error loading location:", err)
-			c.String(200, "Error loading location")
+		cdnURL, err := signatures.StoreSignature(ctx, SignatureUpload{
+			FileName:   c.Param("nom"),
+			AuctionLot: requestBody.NewLot,
+			Image:      imageData,
+			Actor:      c.GetString("uid"),
+		})
+		switch {
+		case errors.Is(err, ErrInvalidSignatureName):
+			c.String(http.StatusBadRequest, "Invalid Signature Name")
 			return
-		}
-		now := time.Now()
-		easternTime := now.In(location)
-		formattedTime := easternTime.Format(invoiceTimeFormat)
-
-		// custome invoice event to pickup or return
-		// var newEvent InvoiceEvent
-		// if requestBody.NewNum != "" {
-		// 	newEvent = InvoiceEvent{
-		// 		Title: "Pickup Signature",
-		// 		Desc:  "Customer signed and picked up",
-		// 		Time:  formattedTime,
-		// 	}
-		// } else {
-		// 	newEvent = InvoiceEvent{
-		// 		Title: "Return Signature",
-		// 		Desc:  "Customer returned",
-		// 		Time:  formattedTime,
-		// 	}
-		// }
-
-		// upsert information to database
-		updateOptions := options.Update().SetUpsert(true)
-		updateBson := bson.M{}
-
-		// if return add return else add signature
-		if split[1] == "pickup" {
-			updateBson["signatureCdn"] = cdnURL
-			updateBson["status"] = "pickedup"
-			updateBson["pickupTime"] = formattedTime
-		} else {
-			updateBson["returnSigCdn"] = cdnURL
-			updateBson["status"] = "refund"
-			updateBson["returnTime"] = formattedTime
-		}
-
-		// convert lot to number
-		floatLot, err := strconv.ParseFloat(requestBody.NewLot, 64)
-		if err != nil {
+		case errors.Is(err, ErrInvalidAuctionLot):
 			c.String(200, "Cannot Convert Lot Number To Float")
 			return
+		case err != nil:
+			c.String(transitionErrorCode(err), err.Error())
+			return
 		}
 
-		// push to db
-		collection.UpdateOne(
-			ctx,
-			bson.M{
-				"invoiceNumber": split[0],
-				"auctionLot":    floatLot,
-			},
-			bson.M{
-				// "$push": bson.M{
-				// 	"invoiceEvent": newEvent,
-				// },
-				"$set": updateBson,
-			},
-			updateOptions,
-		)
-
 		c.String(200, cdnURL)
 	}
 }
@@ -1023,10 +726,7 @@ func DeleteSignature(storageClient *minio.Client, collection *mongo.Collection)
 
 // confirms the signature and deduct paid amount
 func ConfirmSignature(collection *mongo.Collection) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// ctx := context.Background()
-
-	}
+	return AddPayment(collection)
 }
 
 type Range struct {
@@ -1054,6 +754,151 @@ type GetInvoiceRequest struct {
 	TimeOrder    *int           `json:"timeOrder"`
 }
 
+var (
+	ErrInvalidDateRange  = errors.New("invalid date range")
+	ErrInvalidAuctionLot = errors.New("invalid auction lot")
+)
+
+// mongodb query of an invoice list filter, shared by the paged list and exports
+func invoiceListFilter(filter InvoiceFilter) (bson.D, error) {
+	// make date range filter
+	timeFilter, err := timeRangeFilter(filter.FromDate, filter.ToDate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDateRange, err)
+	}
+	dateRangeFilter := bson.D{{
+		Key:   "time",
+		Value: timeFilter,
+	}}
+
+	// multiple payment method choices
+	paymentMethodFilter := bson.D{{
+		Key:   "$or",
+		Value: nil,
+	}}
+	if len(filter.PaymentMethod) > 0 {
+		// loop all payment method, populate $or filter
+		var tempArr = bson.A{}
+		for _, val := range filter.PaymentMethod {
+			tempArr = append(tempArr, bson.M{"paymentMethod": val})
+			tempArr = append(tempArr, bson.M{"payments": bson.M{"$elemMatch": bson.M{"method": val, "voided": false}}})
+		}
+		paymentMethodFilter[0].Value = tempArr
+	}
+
+	// invoice status filter
+	statusFilter := bson.D{{
+		Key:   "$or",
+		Value: nil,
+	}}
+	if len(filter.Status) > 0 {
+		var tempArr = bson.A{}
+		for _, val := range filter.Status {
+			tempArr = append(tempArr, bson.M{"status": val})
+		}
+		statusFilter[0].Value = tempArr
+	}
+
+	// construct shipping filter
+	shippingFilter := bson.D{{}}
+	isShipping := *filter.Shipping
+	// all selection will exclude shipping from request body
+	if isShipping != "" {
+		// set key
+		shippingFilter[0].Key = "isShipping"
+		// set filter value
+		if isShipping == "pickup" {
+			shippingFilter[0].Value = false
+		} else if isShipping == "shipping" {
+			shippingFilter[0].Value = true
+		}
+	}
+
+	// construct payment method filter
+	// compared in cents, stored totals can still be dollars from before the migration
+	totalFilter := bson.M{}
+	minInvoiceTotal := filter.InvoiceTotalRange.Min
+	if minInvoiceTotal != 0 {
+		totalFilter["$gte"] = bson.A{centsExpr("$invoiceTotal"), MoneyFromFloat(minInvoiceTotal)}
+	}
+	maxInvoiceTotal := filter.InvoiceTotalRange.Max
+	if maxInvoiceTotal != 999999 {
+		totalFilter["$lte"] = bson.A{centsExpr("$invoiceTotal"), MoneyFromFloat(maxInvoiceTotal)}
+	}
+	totalConds := bson.A{}
+	for op, cond := range totalFilter {
+		totalConds = append(totalConds, bson.M{op: cond})
+	}
+	invoiceTotalFilter := bson.D{{
+		Key:   "$expr",
+		Value: bson.M{"$and": totalConds},
+	}}
+
+	// keyword filter
+	kwFilter := bson.D{{
+		Key:   "$or",
+		Value: nil,
+	}}
+	words := strings.Fields(*filter.Keyword)
+	if len(words) > 0 {
+		var tempArr = bson.A{}
+		for _, val := range words {
+			tempArr = append(tempArr, bson.M{"buyerAddress": bson.M{"$regex": val}})
+			tempArr = append(tempArr, bson.M{"buyerEmail": bson.M{"$regex": val}})
+			tempArr = append(tempArr, bson.M{"buyerName": bson.M{"$regex": val}})
+		}
+		kwFilter[0].Value = tempArr
+	}
+
+	// invoice number
+	invoiceNumberFilter := bson.M{}
+	// number, convertErr := strconv.Atoi(filter.InvoiceNumber)
+	if filter.InvoiceNumber != "" {
+		invoiceNumberFilter["invoiceNumber"] = filter.InvoiceNumber
+	}
+
+	// auction lot
+	auctionLotFilter := bson.M{}
+	if filter.AuctionLot != "" {
+		intLot, err := strconv.ParseInt(filter.AuctionLot, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidAuctionLot, filter.AuctionLot)
+		}
+		auctionLotFilter["auctionLot"] = intLot
+	}
+
+	// make mongodb query filter
+	andFilters := bson.A{
+		shippingFilter,
+		invoiceNumberFilter,
+		auctionLotFilter,
+	}
+	// if payment method passed in, append payment method filter
+	if paymentMethodFilter[0].Value != nil {
+		andFilters = append(andFilters, paymentMethodFilter)
+	}
+	// same with invoice status
+	if statusFilter[0].Value != nil {
+		andFilters = append(andFilters, statusFilter)
+	}
+	if kwFilter[0].Value != nil {
+		andFilters = append(andFilters, kwFilter)
+	}
+	// if one of the date range passed in, append the date filter
+	if timeFilter["$gte"] != nil || timeFilter["$lt"] != nil {
+		andFilters = append(andFilters, dateRangeFilter)
+	}
+	if totalFilter["$gte"] != nil || totalFilter["$lte"] != nil {
+		andFilters = append(andFilters, invoiceTotalFilter)
+	}
+	return bson.D{
+		{
+			Key:   "$and",
+			Value: andFilters,
+		},
+	}, nil
+}
+
 func GetInvoicesByPage(collection *mongo.Collection) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.TODO()
@@ -1065,149 +910,15 @@ func GetInvoicesByPage(collection *mongo.Collection) gin.HandlerFunc {
 			return
 		}
 
-		// make date range filter
-		timeFilter := bson.M{}
-		if body.Filter.FromDate != "" {
-			timeFilter["$gte"] = body.Filter.FromDate
-		}
-		if body.Filter.ToDate != "" {
-			timeFilter["$lte"] = body.Filter.ToDate
-		} else if body.Filter.FromDate != "" {
-			// if only fromdate input and no todate
-			// set todate to next day of fromdate
-			dateObj, err := time.Parse(time.RFC3339, body.Filter.FromDate)
-			if err != nil {
-				fmt.Println("Error Parsing toDate:", err)
-				return
-			}
-			newDate := dateObj.Add(24 * time.Hour)
-			timeFilter["$lte"] = newDate.Format(time.RFC3339)
-		}
-		dateRangeFilter := bson.D{{
-			Key:   "time",
-			Value: timeFilter,
-		}}
-
-		// multiple payment method choices
-		paymentMethodFilter := bson.D{{
-			Key:   "$or",
-			Value: nil,
-		}}
-		if len(body.Filter.PaymentMethod) > 0 {
-			// loop all payment method, populate $or filter
-			var tempArr = bson.A{}
-			for _, val := range body.Filter.PaymentMethod {
-				tempArr = append(tempArr, bson.M{"paymentMethod": val})
-			}
-			paymentMethodFilter[0].Value = tempArr
-		}
-
-		// invoice status filter
-		statusFilter := bson.D{{
-			Key:   "$or",
-			Value: nil,
-		}}
-		if len(body.Filter.Status) > 0 {
-			var tempArr = bson.A{}
-			for _, val := range body.Filter.Status {
-				tempArr = append(tempArr, bson.M{"status": val})
-			}
-			statusFilter[0].Value = tempArr
-		}
-
-		// construct shipping filter
-		shippingFilter := bson.D{{}}
-		isShipping := *body.Filter.Shipping
-		// all selection will exclude shipping from request body
-		if isShipping != "" {
-			// set key
-			shippingFilter[0].Key = "isShipping"
-			// set filter value
-			if isShipping == "pickup" {
-				shippingFilter[0].Value = false
-			} else if isShipping == "shipping" {
-				shippingFilter[0].Value = true
-			}
-		}
-
-		// construct payment method filter
-		totalFilter := bson.M{}
-		minInvoiceTotal := body.Filter.InvoiceTotalRange.Min
-		if minInvoiceTotal != 0 {
-			totalFilter["$gte"] = minInvoiceTotal
-		}
-		maxInvoiceTotal := body.Filter.InvoiceTotalRange.Max
-		if maxInvoiceTotal != 999999 {
-			totalFilter["$lte"] = maxInvoiceTotal
-		}
-		invoiceTotalFilter := bson.D{{
-			Key:   "invoiceTotal",
-			Value: totalFilter,
-		}}
-
-		// keyword filter
-		kwFilter := bson.D{{
-			Key:   "$or",
-			Value: nil,
-		}}
-		words := strings.Fields(*body.Filter.Keyword)
-		if len(words) > 0 {
-			var tempArr = bson.A{}
-			for _, val := range words {
-				tempArr = append(tempArr, bson.M{"buyerAddress": bson.M{"$regex": val}})
-				tempArr = append(tempArr, bson.M{"buyerEmail": bson.M{"$regex": val}})
-				tempArr = append(tempArr, bson.M{"buyerName": bson.M{"$regex": val}})
-			}
-			kwFilter[0].Value = tempArr
-		}
-
-		// invoice number
-		invoiceNumberFilter := bson.M{}
-		// number, convertErr := strconv.Atoi(body.Filter.InvoiceNumber)
-		if body.Filter.InvoiceNumber != "" {
-			invoiceNumberFilter["invoiceNumber"] = body.Filter.InvoiceNumber
-		}
-
-		// auction lot
-		auctionLotFilter := bson.M{}
-		if body.Filter.AuctionLot != "" {
-			intLot, err := strconv.ParseInt(body.Filter.AuctionLot, 0, 32)
-			if err != nil {
-				c.String(500, "Cannot Parse Auction Lot")
-				return
-			}
-			auctionLotFilter["auctionLot"] = intLot
-		}
-
-		// make mongodb query filter
-		andFilters := bson.A{
-			shippingFilter,
-			invoiceNumberFilter,
-			auctionLotFilter,
-		}
-		// if payment method passed in, append payment method filter
-		if paymentMethodFilter[0].Value != nil {
-			andFilters = append(andFilters, paymentMethodFilter)
-		}
-		// same with invoice status
-		if statusFilter[0].Value != nil {
-			andFilters = append(andFilters, statusFilter)
-		}
-		if kwFilter[0].Value != nil {
-			andFilters = append(andFilters, kwFilter)
-		}
-		// if one of the date range passed in, append the date filter
-		if timeFilter["$gte"] != nil || timeFilter["$lte"] != nil {
-			andFilters = append(andFilters, dateRangeFilter)
-		}
-		if totalFilter["$gte"] != nil || totalFilter["$lte"] != nil {
-			andFilters = append(andFilters, invoiceTotalFilter)
+		fil, err := invoiceListFilter(*body.Filter)
+		if errors.Is(err, ErrInvalidDateRange) {
+			fmt.Println(err.Error())
+			c.String(http.StatusBadRequest, "Invalid Date Range")
+			return
 		}
-		fil := bson.D{
-			{
-				Key:   "$and",
-				Value: andFilters,
-			},
+		if err != nil {
+			c.String(500, "Cannot Parse Auction Lot")
+			return
 		}
 
 		// new query options setting sort and skip
@@ -1233,15 +944,12 @@ func GetInvoicesByPage(collection *mongo.Collection) gin.HandlerFunc {
 			return
 		}
 
-		// store all result in array of objects
-		var itemsArr []bson.M
-		for cursor.Next(ctx) {
-			var result bson.M
-			err := cursor.Decode(&result)
-			if err != nil {
-				c.String(http.StatusInternalServerError, "Database Error!")
-			}
-			itemsArr = append(itemsArr, result)
+		// decoded as invoices so money and times read the same as every other endpoint
+		var itemsArr []Invoice
+		if err := cursor.All(ctx, &itemsArr); err != nil {
+			fmt.Println(err)
+			c.String(http.StatusInternalServerError, "Database Error!")
+			return
 		}
 
 		// return the item info as json
@@ -1256,7 +964,13 @@ type InvoiceNumberRequest struct {
 	InvoiceNumber string `json:"invoiceNumber"`
 }
 
-func GetInvoiceByInvoiceNumber(collection *mongo.Collection) gin.HandlerFunc {
+// invoice with the credit notes issued against it
+type InvoiceDetail struct {
+	Invoice
+	CreditNotes []CreditNote `json:"creditNotes"`
+}
+
+func GetInvoiceByInvoiceNumber(collection *mongo.Collection, creditNotes *mongo.Collection) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 		var request InvoiceNumberRequest
@@ -1281,23 +995,35 @@ func GetInvoiceByInvoiceNumber(collection *mongo.Collection) gin.HandlerFunc {
 			},
 			opt,
 		).Decode(&inv)
-
 		if res != nil {
-			c.JSON(200, inv)
+			c.String(http.StatusNotFound, "Invoice Not Found")
+			return
+		}
+
+		// credit notes are linked by invoice number and auction lot
+		notes, err := findCreditNotes(ctx, creditNotes, bson.M{
+			"invoiceNumber": inv.InvoiceNumber,
+			"auctionLot":    inv.AuctionLot,
+		})
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Credit Notes")
+			return
 		}
+		c.JSON(200, InvoiceDetail{Invoice: inv, CreditNotes: notes})
 	}
 }
 
 type BarChartData struct {
 	Month     string
-	Cash      float32
-	Card      float32
-	Etransfer float32
+	Cash      Money
+	Card      Money
+	Etransfer Money
 }
 
 type LineChartData struct {
 	Lot    int32
-	Amount float32
+	Amount Money
 }
 
 // convert numeric month to string
@@ -1346,18 +1072,18 @@ func GetChartData(collection *mongo.Collection) gin.HandlerFunc {
 		// 	{ month: 'June', Cash: 750, Card: 600, "E-transfer": 1000 },
 		//   ]
 
-		// get 6 month before
-		now := time.Now()
-		start := now.AddDate(0, -6, 0)
-		// start.Month()
+		// this month and the 5 before, from the 1st in business time
+		start := startOfDay(eventTime())
+		start = Timestamp{Time: start.AddDate(0, -5, 1-start.Day())}
 
 		// find all document where payment method not null
 		fil := bson.M{
 			"time": bson.M{
-				"$gte": start.Format(time.RFC3339),
+				"$gte": start,
 			},
-			"paymentMethod": bson.M{
-				"$ne": nil,
+			"$or": bson.A{
+				bson.M{"payments.0": bson.M{"$exists": true}},
+				bson.M{"paymentMethod": bson.M{"$nin": bson.A{nil, ""}}},
 			},
 		}
 
@@ -1366,7 +1092,7 @@ func GetChartData(collection *mongo.Collection) gin.HandlerFunc {
 		// lineChartData := []LineChartData{}
 
 		// find all
-		curs, err := collection.Find(ctx, fil, nil)
+		curs, err := collection.Find(ctx, fil, options.Find().SetSort(bson.D{{Key: "time", Value: 1}}))
 		if err != nil {
 			fmt.Print(err.Error())
 			c.String(500, "Cannot Find Records")
@@ -1374,12 +1100,9 @@ func GetChartData(collection *mongo.Collection) gin.HandlerFunc {
 		}
 		defer curs.Close(ctx)
 
-		var cashData map[string]float32 = map[string]float32{}
-		var cardData map[string]float32 = map[string]float32{}
-		var etransferData map[string]float32 = map[string]float32{}
-
-		// key: auction lot, val: auction total
-		var auctionLotTotal map[int32]float32 = map[int32]float32{}
+		// one bar per month, in the order months are first seen
+		var barData []BarChartData
+		var monthIndex map[string]int = map[string]int{}
 
 		// loop cursor
 		for curs.Next(ctx) {
@@ -1390,84 +1113,29 @@ func GetChartData(collection *mongo.Collection) gin.HandlerFunc {
 				return
 			}
 
-			// determine invoice month
-			t, err := time.Parse(invoiceTimeFormat, result.Time)
-			if err != nil {
-				fmt.Println("Error parsing date:", err)
-				return
-			}
-
-			// convert month to string
-			month := numberToMonth(int64(t.Month()))
-			fmt.Println(month)
-
-			// add invoice total to totals
-			switch result.PaymentMethod {
-			case "cash":
-				cashData[month] += result.InvoiceTotal
-			case "card":
-				cardData[month] += result.InvoiceTotal
-			case "etransfer":
-				etransferData[month] += result.InvoiceTotal
-			}
-
-			auctionLotTotal[int32(result.AuctionLot)] += result.InvoiceTotal
-		}
-
-		var barData []BarChartData
-		for month, total := range cashData {
-			found := false
-			for _, val := range barData {
-				if val.Month == month {
-					ref := &val
-					ref.Cash += total
-					found = true
-				}
-			}
-			if !found {
-				barData = append(barData, BarChartData{
-					Cash:  total,
-					Month: month,
-				})
-			}
-		}
-
-		for month, total := range cardData {
-			found := false
-			for _, val := range barData {
-				if val.Month == month {
-					ref := &val
-					ref.Card += total
-					found = true
-				}
-			}
+			// convert business month to string
+			month := numberToMonth(int64(result.Time.In(businessLocation).Month()))
+			index, found := monthIndex[month]
 			if !found {
-				barData = append(barData, BarChartData{
-					Card:  total,
-					Month: month,
-				})
+				index = len(barData)
+				monthIndex[month] = index
+				barData = append(barData, BarChartData{Month: month})
 			}
-		}
 
-		for month, total := range etransferData {
-			found := false
-			for _, val := range barData {
-				if val.Month == month {
-					ref := &val
-					ref.Etransfer += total
-					found = true
+			// add every tender to its own total
+			for method, amount := range invoiceTenders(result) {
+				switch method {
+				case TenderCash:
+					barData[index].Cash += amount
+				case TenderCard:
+					barData[index].Card += amount
+				case TenderEtransfer:
+					barData[index].Etransfer += amount
 				}
 			}
-			if !found {
-				barData = append(barData, BarChartData{
-					Etransfer: total,
-					Month:     month,
-				})
-			}
 		}
 
-		fmt.Println(auctionLotTotal)
-		fmt.Println(barData)
+		// totals per lot and other ranges come from GetSalesReport
 		c.JSON(200, barData)
 	}
 }
@@ -1537,63 +1205,6 @@ func VerifyInvoiceNumber(collection *mongo.Collection) gin.HandlerFunc {
 	}
 }
 
-type RefundReq = struct {
-	InvoiceNumber string        `json:"invoiceNumber" bson:"invoiceNumber"`
-	RefundItems   []InvoiceItem `json:"refundItems" bson:"refundItems"`
-}
-
-// takes invoice number and refund item array, add refund invoice event, then
-func RefundInvoice(collection *mongo.Collection) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var req RefundReq
-		err := c.ShouldBindJSON(&req)
-		if err != nil {
-			c.String(400, "Invalid Body")
-		}
-		fmt.Println(req)
-
-		var refundSum float32 = 0
-		for _, item := range req.RefundItems {
-			refundSum += float32(item.Bid)
-			refundSum += float32(item.HandlingFee)
-		}
-
-		fmt.Println(len(req.RefundItems))
-		fmt.Println(refundSum)
-
-		desc := fmt.Sprintf("Refund: %d Items, Total: %f", len(req.RefundItems), refundSum)
-
-		// construct invoice event
-		currentTime := time.Now()
-		var newRefundEvent = InvoiceEvent{
-			Title: "Refund",
-			Desc:  desc,
-			Time:  currentTime.Format(time.RFC3339),
-		}
-		fmt.Println(newRefundEvent)
-
-		// create new field called refundArr on document set it to req.RefundItems
-		// update refund info to database document
-		collection.FindOneAndUpdate(
-			context.Background(),
-			bson.M{
-				"invoiceNumber": req.InvoiceNumber,
-			},
-			bson.M{
-				"$set": bson.M{
-					"":       newRefundEvent,
-					"status": "refund",
-				},
-				"$push": bson.M{"invoiceEvent": newRefundEvent},
-			},
-			options.FindOneAndUpdate().SetProjection(bson.M{
-				"InvoiceNumber": 1,
-				"InvoiceTotal":  1,
-			}),
-		)
-	}
-}
-
 func SearchSignatureByInvoice(storageClient *minio.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
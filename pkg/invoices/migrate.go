@@ -0,0 +1,201 @@
+package invoices
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// money fields of an invoice, a double in any of them marks a document written before cents
+var invoiceMoneyPaths = []string{
+	"invoiceTotal", "remainingBalance", "tax", "totalHandlingFee", "buyersPremium", "refundTotal",
+	"items.msrp", "items.bid", "items.extendedPrice", "items.handlingFee",
+	"payments.amount", "taxBreakdown.amount",
+	"refunds.bid", "refunds.handlingFee", "refunds.buyersPremium", "refunds.tax", "refunds.amount", "refunds.taxes.amount",
+}
+
+var creditNoteMoneyPaths = []string{
+	"subtotal", "totalHandlingFee", "buyersPremium", "total",
+	"items.msrp", "items.bid", "items.extendedPrice", "items.handlingFee",
+	"taxBreakdown.amount",
+}
+
+// time fields, a string in any of them marks a document written before dates
+var invoiceTimePaths = []string{"time", "pickupTime", "returnTime", "invoiceEvent.time", "payments.time", "refunds.time"}
+var creditNoteTimePaths = []string{"time"}
+var importJobTimePaths = []string{"createdAt", "updatedAt"}
+
+// documents with a value of bson type in any of paths
+func typeFilter(paths []string, bsonType string) bson.M {
+	or := bson.A{}
+	for _, path := range paths {
+		or = append(or, bson.M{path: bson.M{"$type": bsonType}})
+	}
+	return bson.M{"$or": or}
+}
+
+// rewrite every document matching filter
+// fields decodes a document, which converts legacy values, and returns the fields to set back
+// and whether every legacy value converted, documents with one that did not still match filter
+// afterwards, they are logged and counted apart so a rerun does not count them as migrated again
+func migrateCollection(ctx context.Context, coll *mongo.Collection, filter bson.M, fields func(*mongo.Cursor) (bson.M, bool, error)) (int, int, error) {
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	migrated, unconverted := 0, 0
+	for cursor.Next(ctx) {
+		set, converted, err := fields(cursor)
+		if err != nil {
+			return migrated, unconverted, err
+		}
+		id := cursor.Current.Lookup("_id")
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+		if err != nil {
+			return migrated, unconverted, err
+		}
+		if converted {
+			migrated++
+		} else {
+			fmt.Println("left unconverted values in", coll.Name(), id)
+			unconverted++
+		}
+	}
+	return migrated, unconverted, cursor.Err()
+}
+
+// true when none of times is a stored string in no known layout
+func timesConverted(times ...Timestamp) bool {
+	for _, t := range times {
+		if t.raw != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// convert stored invoices and credit notes from float dollars to integer cents
+// safe to run again, documents already in cents are skipped
+func MigrateMoney(ctx context.Context, invoices *mongo.Collection, creditNotes *mongo.Collection) (int, int, error) {
+	invoiceCount, _, err := migrateCollection(ctx, invoices, typeFilter(invoiceMoneyPaths, "double"), func(cursor *mongo.Cursor) (bson.M, bool, error) {
+		var invoice Invoice
+		if err := cursor.Decode(&invoice); err != nil {
+			return nil, false, err
+		}
+		set := bson.M{
+			"invoiceTotal":     invoice.InvoiceTotal,
+			"remainingBalance": invoice.RemainingBalance,
+			"tax":              invoice.Tax,
+			"totalHandlingFee": invoice.TotalHandlingFee,
+			"buyersPremium":    invoice.BuyersPremium,
+			"refundTotal":      invoice.RefundTotal,
+			"items":            invoice.Items,
+		}
+		// arrays the invoice does not have stay unset
+		if invoice.Payments != nil {
+			set["payments"] = invoice.Payments
+		}
+		if invoice.TaxBreakdown != nil {
+			set["taxBreakdown"] = invoice.TaxBreakdown
+		}
+		if invoice.Refunds != nil {
+			set["refunds"] = invoice.Refunds
+		}
+		return set, true, nil
+	})
+	if err != nil {
+		return invoiceCount, 0, err
+	}
+
+	noteCount, _, err := migrateCollection(ctx, creditNotes, typeFilter(creditNoteMoneyPaths, "double"), func(cursor *mongo.Cursor) (bson.M, bool, error) {
+		var note CreditNote
+		if err := cursor.Decode(&note); err != nil {
+			return nil, false, err
+		}
+		return bson.M{
+			"subtotal":         note.Subtotal,
+			"totalHandlingFee": note.TotalHandlingFee,
+			"buyersPremium":    note.BuyersPremium,
+			"total":            note.Total,
+			"items":            note.Items,
+			"taxBreakdown":     note.TaxBreakdown,
+		}, true, nil
+	})
+	return invoiceCount, noteCount, err
+}
+
+// documents migrated per collection
+// unconverted counts documents still holding a time string in no known layout, they are left as they are
+type MigrationResult struct {
+	Invoices    int `json:"invoices"`
+	CreditNotes int `json:"creditNotes"`
+	ImportJobs  int `json:"importJobs"`
+	Unconverted int `json:"unconverted"`
+}
+
+// convert stored time strings, whatever layout they were written in, to dates
+// safe to run again, documents already holding dates are skipped
+func MigrateTimes(ctx context.Context, invoices *mongo.Collection, creditNotes *mongo.Collection, importJobs *mongo.Collection) (MigrationResult, error) {
+	var result MigrationResult
+	var unconverted int
+	var err error
+	result.Invoices, unconverted, err = migrateCollection(ctx, invoices, typeFilter(invoiceTimePaths, "string"), func(cursor *mongo.Cursor) (bson.M, bool, error) {
+		var invoice Invoice
+		if err := cursor.Decode(&invoice); err != nil {
+			return nil, false, err
+		}
+		set := bson.M{
+			"time":         invoice.Time,
+			"pickupTime":   invoice.PickupTime,
+			"returnTime":   invoice.ReturnTime,
+			"invoiceEvent": invoice.InvoiceEvent,
+		}
+		times := []Timestamp{invoice.Time, invoice.PickupTime, invoice.ReturnTime}
+		for _, event := range invoice.InvoiceEvent {
+			times = append(times, event.Time)
+		}
+		if invoice.Payments != nil {
+			set["payments"] = invoice.Payments
+			for _, payment := range invoice.Payments {
+				times = append(times, payment.Time)
+			}
+		}
+		if invoice.Refunds != nil {
+			set["refunds"] = invoice.Refunds
+			for _, refund := range invoice.Refunds {
+				times = append(times, refund.Time)
+			}
+		}
+		return set, timesConverted(times...), nil
+	})
+	result.Unconverted += unconverted
+	if err != nil {
+		return result, err
+	}
+
+	result.CreditNotes, unconverted, err = migrateCollection(ctx, creditNotes, typeFilter(creditNoteTimePaths, "string"), func(cursor *mongo.Cursor) (bson.M, bool, error) {
+		var note CreditNote
+		if err := cursor.Decode(&note); err != nil {
+			return nil, false, err
+		}
+		return bson.M{"time": note.Time}, timesConverted(note.Time), nil
+	})
+	result.Unconverted += unconverted
+	if err != nil {
+		return result, err
+	}
+
+	result.ImportJobs, unconverted, err = migrateCollection(ctx, importJobs, typeFilter(importJobTimePaths, "string"), func(cursor *mongo.Cursor) (bson.M, bool, error) {
+		var job ImportJob
+		if err := cursor.Decode(&job); err != nil {
+			return nil, false, err
+		}
+		return bson.M{"createdAt": job.CreatedAt, "updatedAt": job.UpdatedAt}, timesConverted(job.CreatedAt, job.UpdatedAt), nil
+	})
+	result.Unconverted += unconverted
+	return result, err
+}
@@ -0,0 +1,151 @@
+package invoices
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// an amount of money in cents
+// json carries dollars with two decimals, bson stores cents as int64
+// documents written before the migration hold dollars as doubles and still decode
+type Money int64
+
+var ErrInvalidMoney = errors.New("invalid money amount")
+
+// dollars to cents, rounded half away from zero
+func MoneyFromFloat(dollars float64) Money {
+	return Money(math.Round(dollars * 100))
+}
+
+// parse "12.34", "$1,234.5" or "-0.05" exactly, digits past the cent are rounded
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	s = strings.ReplaceAll(s, "$", "")
+	s = strings.ReplaceAll(s, ",", "")
+	s = strings.TrimSpace(s)
+	if strings.ContainsAny(s, "eE") {
+		dollars, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+		}
+		return MoneyFromFloat(dollars), nil
+	}
+
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	whole, fraction, _ := strings.Cut(s, ".")
+	if whole == "" && fraction == "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+	for _, part := range []string{whole, fraction} {
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+			}
+		}
+	}
+
+	var cents int64 = 0
+	if whole != "" {
+		dollars, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+		}
+		cents = dollars * 100
+	}
+	fraction += "000"
+	cents += int64(fraction[0]-'0')*10 + int64(fraction[1]-'0')
+	if fraction[2] >= '5' {
+		cents++
+	}
+	if negative {
+		cents = -cents
+	}
+	return Money(cents), nil
+}
+
+func (m Money) Float() float64 {
+	return float64(m) / 100
+}
+
+// "12.34", "-0.05"
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// m times a factor, e.g. a tax rate, rounded to the cent
+func (m Money) Mul(factor float64) Money {
+	return Money(math.Round(float64(m) * factor))
+}
+
+// m times num/den rounded to the cent, for proportional shares; zero when den is zero
+func (m Money) Scale(num Money, den Money) Money {
+	if den == 0 {
+		return 0
+	}
+	return Money(math.Round(float64(m) * float64(num) / float64(den)))
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// numbers and quoted numbers are accepted, null is zero
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		*m = 0
+		return nil
+	}
+	parsed, err := ParseMoney(strings.Trim(string(data), `"`))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.TypeInt64, bsoncore.AppendInt64(nil, int64(m)), nil
+}
+
+// int64 and int32 are cents, doubles are dollars from before the migration
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bson.TypeInt64:
+		*m = Money(value.Int64())
+	case bson.TypeInt32:
+		*m = Money(value.Int32())
+	case bson.TypeDouble:
+		*m = MoneyFromFloat(value.Double())
+	case bson.TypeNull, bson.TypeUndefined:
+		*m = 0
+	default:
+		return fmt.Errorf("%w: bson %s", ErrInvalidMoney, t)
+	}
+	return nil
+}
+
+// aggregation expression reading a money field as cents, whichever way it is stored
+func centsExpr(field string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{bson.M{"$type": field}, "double"}},
+		bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{field, 100}}, 0}}},
+		bson.M{"$toLong": bson.M{"$ifNull": bson.A{field, 0}}},
+	}}
+}
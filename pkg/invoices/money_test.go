@@ -0,0 +1,96 @@
+package invoices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Money
+	}{
+		{"12.34", 1234},
+		{"$1,234.5", 123450},
+		{" 0.1 ", 10},
+		{"-0.05", -5},
+		{"19.995", 2000},
+		{"7", 700},
+		{".99", 99},
+		{"1e2", 10000},
+	}
+	for _, tc := range cases {
+		got, err := ParseMoney(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseMoney(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"", "$", "1.2.3", "12a"} {
+		if _, err := ParseMoney(in); !errors.Is(err, ErrInvalidMoney) {
+			t.Errorf("ParseMoney(%q) error = %v", in, err)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(TaxLine{Name: "HST", Amount: -1205})
+	if err != nil || string(data) != `{"name":"HST","amount":-12.05}` {
+		t.Errorf("marshal = %s, %v", data, err)
+	}
+
+	var line TaxLine
+	for _, in := range []string{`{"amount":12.05}`, `{"amount":"12.05"}`} {
+		if err := json.Unmarshal([]byte(in), &line); err != nil || line.Amount != 1205 {
+			t.Errorf("unmarshal %s = %d, %v", in, line.Amount, err)
+		}
+	}
+}
+
+func TestMoneyBSON(t *testing.T) {
+	data, err := bson.Marshal(Payment{Amount: 3051})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := bson.Raw(data).Lookup("amount"); value.Type != bson.TypeInt64 || value.Int64() != 3051 {
+		t.Errorf("amount stored as %s %v", value.Type, value)
+	}
+	var payment Payment
+	if err := bson.Unmarshal(data, &payment); err != nil || payment.Amount != 3051 {
+		t.Errorf("round trip = %d, %v", payment.Amount, err)
+	}
+
+	// documents from before the migration hold float dollars
+	legacy, _ := bson.Marshal(bson.M{"invoiceTotal": 30.509999084472656, "tax": nil, "items": bson.A{bson.M{"bid": 12.5}}})
+	var invoice Invoice
+	if err := bson.Unmarshal(legacy, &invoice); err != nil {
+		t.Fatal(err)
+	}
+	if invoice.InvoiceTotal != 3051 || invoice.Tax != 0 || invoice.Items[0].Bid != 1250 {
+		t.Errorf("legacy decode = %d %d %d", invoice.InvoiceTotal, invoice.Tax, invoice.Items[0].Bid)
+	}
+}
+
+// a page of the invoice list read from documents in cents
+func TestInvoiceListJSON(t *testing.T) {
+	doc, _ := bson.Marshal(bson.M{"invoiceNumber": "10234", "invoiceTotal": int64(4972), "tax": int64(572)})
+	cursor, err := mongo.NewCursorFromDocuments([]interface{}{doc}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page []Invoice
+	if err := cursor.All(context.Background(), &page); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(page)
+	for _, want := range []string{`"invoiceTotal":49.72`, `"tax":5.72`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("list json %s missing %s", data, want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package invoices
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// parses the plain text extracted from one auction platform invoice pdf
+type InvoiceParser interface {
+	// unique template name, used by the "template" form field
+	Name() string
+	// reports whether the extracted text looks like this template
+	Detect(text string) bool
+	// turns the extracted text into an invoice, with per-field diagnostics
+	Parse(text string) (ParseResult, error)
+}
+
+// registered parsers, keyed by name and kept in registration order for detection
+var parserRegistry = map[string]InvoiceParser{}
+var parserOrder []string
+var parserMutex sync.RWMutex
+
+// add a parser to the registry, names must be unique
+func RegisterParser(parser InvoiceParser) {
+	parserMutex.Lock()
+	defer parserMutex.Unlock()
+	name := parser.Name()
+	if _, exists := parserRegistry[name]; exists {
+		panic(fmt.Sprintf("invoice parser %q already registered", name))
+	}
+	parserRegistry[name] = parser
+	parserOrder = append(parserOrder, name)
+}
+
+// names of all registered parsers
+func ParserNames() []string {
+	parserMutex.RLock()
+	defer parserMutex.RUnlock()
+	return append([]string(nil), parserOrder...)
+}
+
+// pick the parser by name, or by auto detection when name is empty or "auto"
+func SelectParser(name string, text string) (InvoiceParser, error) {
+	parserMutex.RLock()
+	defer parserMutex.RUnlock()
+
+	if name != "" && name != "auto" {
+		parser, found := parserRegistry[name]
+		if !found {
+			return nil, fmt.Errorf("unknown invoice template %q", name)
+		}
+		return parser, nil
+	}
+
+	for _, key := range parserOrder {
+		parser := parserRegistry[key]
+		if parser.Detect(text) {
+			return parser, nil
+		}
+	}
+	return nil, errors.New("cannot detect invoice template")
+}
+
+// the section of the invoice text a field extractor reads from
+type Section int
+
+const (
+	HeaderSection Section = iota
+	FooterSection
+)
+
+// extracts one or more invoice fields from a section of the text
+type FieldExtractor struct {
+	Field   string
+	Section Section
+	Extract func(text string, invoice *Invoice, diag *Diagnostics)
+}
+
+// where a per-row pattern is searched relative to the row's item match
+type RowAnchor int
+
+const (
+	// between the previous item match and this one, the last match wins
+	BeforeItem RowAnchor = iota
+	// from the start of this item match up to the next one, the first match wins
+	AfterItem
+)
+
+// a value that belongs to one item row, first submatch is the value
+type RowField struct {
+	Pattern *regexp.Regexp
+	Anchor  RowAnchor
+}
+
+// find the raw value of the field for the row of item k
+func (f RowField) find(body string, itemBounds [][]int, k int) (string, bool) {
+	var region string
+	if f.Anchor == BeforeItem {
+		from := 0
+		if k > 0 {
+			from = itemBounds[k-1][1]
+		}
+		region = body[from:itemBounds[k][0]]
+		matches := f.Pattern.FindAllStringSubmatch(region, -1)
+		if len(matches) == 0 || len(matches[len(matches)-1]) < 2 {
+			return "", false
+		}
+		return strings.TrimSpace(matches[len(matches)-1][1]), true
+	}
+
+	to := len(body)
+	if k+1 < len(itemBounds) {
+		to = itemBounds[k+1][0]
+	}
+	region = body[itemBounds[k][0]:to]
+	match := f.Pattern.FindStringSubmatch(region)
+	if len(match) < 2 {
+		return "", false
+	}
+	return strings.TrimSpace(match[1]), true
+}
+
+// raw text of one item row, with the unit count and handling fee found beside it
+type invoiceRow struct {
+	Raw            string
+	Unit           string
+	HasUnit        bool
+	HandlingFee    string
+	HasHandlingFee bool
+}
+
+// invoice text after being cut into header, item rows and footer
+type invoiceSections struct {
+	Header string
+	Rows   []invoiceRow
+	Footer string
+}
+
+// returned when the text cannot be split into sections, nothing was extracted
+var (
+	ErrHeaderNotFound = errors.New("invoice header boundary not found")
+	ErrNoItemRows     = errors.New("no invoice item rows found")
+)
+
+// a declarative invoice layout, implements InvoiceParser
+type InvoiceTemplate struct {
+	TemplateName string
+	// every marker must be present in the raw text for auto detection
+	Markers []string
+	// page decorations removed before splitting
+	Noise []string
+	// header ends after the first match
+	HeaderEnd *regexp.Regexp
+	// footer starts at the first match after the header
+	FooterStart *regexp.Regexp
+	// first submatch is the raw text of one item row
+	ItemPattern *regexp.Regexp
+	// handling fee of one item row
+	HandlingFee RowField
+	// unit count of one item row
+	Unit RowField
+	// run in order, later extractors can read fields set by earlier ones
+	Fields []FieldExtractor
+	// turns a raw item row into an invoice item
+	ParseItem func(raw string, diag *Diagnostics) InvoiceItem
+}
+
+func (t *InvoiceTemplate) Name() string {
+	return t.TemplateName
+}
+
+func (t *InvoiceTemplate) Detect(text string) bool {
+	if len(t.Markers) == 0 {
+		return false
+	}
+	for _, marker := range t.Markers {
+		if !strings.Contains(text, marker) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *InvoiceTemplate) Parse(text string) (result ParseResult, err error) {
+	result.Template = t.TemplateName
+
+	// remove unwanted text
+	for _, val := range t.Noise {
+		text = strings.ReplaceAll(text, val, "")
+	}
+
+	// split invoice text into 3 parts (header, items, footer)
+	sections, err := t.split(text, &result.Diagnostics)
+	if err != nil {
+		return result, err
+	}
+	result.Invoice = t.process(sections, &result.Diagnostics)
+	checkRequiredFields(result.Invoice, &result.Diagnostics)
+	return result, nil
+}
+
+// flag fields every invoice needs before it can be created
+func checkRequiredFields(invoice Invoice, diag *Diagnostics) {
+	if invoice.InvoiceNumber == "" {
+		diag.Error("invoiceNumber", "", "invoice number not found")
+	}
+	if invoice.BuyerName == "" {
+		diag.Error("buyerName", "", "buyer name not found")
+	}
+	if invoice.BuyerEmail == "" {
+		diag.Error("buyerEmail", "", "buyer email not found")
+	}
+	if invoice.Time.IsZero() {
+		diag.Error("time", "", "invoice time not found")
+	}
+	if invoice.AuctionLot == 0 {
+		diag.Error("auctionLot", "", "auction lot not found")
+	}
+}
+
+// split the invoice text into parts
+// header, items rows, footer
+func (t *InvoiceTemplate) split(text string, diag *Diagnostics) (invoiceSections, error) {
+	var sections invoiceSections
+
+	// get index of the header boundary
+	index := t.HeaderEnd.FindStringIndex(text)
+	if index == nil {
+		return sections, fmt.Errorf("%w: %s", ErrHeaderNotFound, t.HeaderEnd.String())
+	}
+	sections.Header = text[:index[1]]
+	body := text[index[1]:]
+
+	// get footer, item rows are only searched before it
+	matchIndex := t.FooterStart.FindStringIndex(body)
+	if matchIndex != nil {
+		sections.Footer = body[matchIndex[0]:]
+		body = body[:matchIndex[0]]
+	} else {
+		diag.Error("footer", body, "cannot find "+t.FooterStart.String())
+	}
+
+	// each item match anchors one row, unit and handling fee are looked up beside it
+	itemBounds := t.ItemPattern.FindAllStringSubmatchIndex(body, -1)
+	for k, bounds := range itemBounds {
+		if len(bounds) < 4 || bounds[2] < 0 {
+			continue
+		}
+		row := invoiceRow{Raw: strings.TrimSpace(body[bounds[2]:bounds[3]])}
+		row.Unit, row.HasUnit = t.Unit.find(body, itemBounds, k)
+		row.HandlingFee, row.HasHandlingFee = t.HandlingFee.find(body, itemBounds, k)
+		sections.Rows = append(sections.Rows, row)
+	}
+	if len(sections.Rows) == 0 {
+		return sections, ErrNoItemRows
+	}
+
+	return sections, nil
+}
+
+// run the field extractors and build the item rows
+func (t *InvoiceTemplate) process(sections invoiceSections, diag *Diagnostics) Invoice {
+	var newInvoice Invoice
+
+	for _, extractor := range t.Fields {
+		switch extractor.Section {
+		case HeaderSection:
+			extractor.Extract(sections.Header, &newInvoice, diag)
+		case FooterSection:
+			extractor.Extract(sections.Footer, &newInvoice, diag)
+		}
+	}
+
+	// build items row by row and calculate total handling fee
+	var totalHandlingFee Money
+	for _, row := range sections.Rows {
+		invoiceItem := t.ParseItem(row.Raw, diag)
+
+		if row.HasUnit {
+			unit, err := parseFloat32(row.Unit)
+			if err != nil {
+				diag.Error("items.unit", row.Raw, err.Error())
+			}
+			invoiceItem.Unit = unit
+		} else {
+			diag.Warn("items.unit", row.Raw, "unit count not found", 0)
+		}
+
+		if row.HasHandlingFee {
+			fee, err := ParseMoney(row.HandlingFee)
+			if err != nil {
+				diag.Error("items.handlingFee", row.Raw, err.Error())
+			}
+			invoiceItem.HandlingFee = fee
+			totalHandlingFee += fee
+		} else {
+			diag.Warn("items.handlingFee", row.Raw, "handling fee not found", 0)
+		}
+
+		newInvoice.Items = append(newInvoice.Items, invoiceItem)
+	}
+
+	newInvoice.TotalHandlingFee = totalHandlingFee
+	return newInvoice
+}
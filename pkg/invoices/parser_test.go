@@ -0,0 +1,183 @@
+package invoices
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// regenerate golden files with: go test ./pkg/invoices -run TestParseGolden -update
+var update = flag.Bool("update", false, "rewrite golden files from current parser output")
+
+// golden file layout for one extracted invoice text
+type goldenResult struct {
+	Template    string      `json:"template"`
+	Status      string      `json:"status"`
+	Error       string      `json:"error,omitempty"`
+	Invoice     Invoice     `json:"invoice"`
+	Diagnostics Diagnostics `json:"diagnostics"`
+}
+
+func TestMain(m *testing.M) {
+	// parsed times are in the business zone, pin it so golden files are stable
+	if err := SetBusinessTimeZone("America/New_York"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func parseGolden(t testing.TB, parser InvoiceParser, text string) goldenResult {
+	result, err := parser.Parse(text)
+	golden := goldenResult{
+		Template:    result.Template,
+		Status:      result.Diagnostics.Status(),
+		Invoice:     result.Invoice,
+		Diagnostics: result.Diagnostics,
+	}
+	if err != nil {
+		golden.Status = ParseStatusError
+		golden.Error = err.Error()
+	}
+	if golden.Diagnostics == nil {
+		golden.Diagnostics = Diagnostics{}
+	}
+	return golden
+}
+
+func TestParseGolden(t *testing.T) {
+	for _, name := range ParserNames() {
+		inputs, err := filepath.Glob(filepath.Join("testdata", name, "*.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inputs) == 0 {
+			t.Errorf("no testdata for template %q", name)
+		}
+
+		for _, input := range inputs {
+			input := input
+			t.Run(name+"/"+strings.TrimSuffix(filepath.Base(input), ".txt"), func(t *testing.T) {
+				text, err := os.ReadFile(input)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				parser, err := SelectParser("", string(text))
+				if err != nil {
+					t.Fatalf("detect: %v", err)
+				}
+				if parser.Name() != name {
+					t.Fatalf("detected template %q, want %q", parser.Name(), name)
+				}
+
+				got, err := json.MarshalIndent(parseGolden(t, parser, string(text)), "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, '\n')
+
+				goldenPath := strings.TrimSuffix(input, ".txt") + ".golden.json"
+				if *update {
+					if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+
+				want, err := os.ReadFile(goldenPath)
+				if err != nil {
+					t.Fatalf("missing golden file, run with -update: %v", err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("parse result differs from %s\n got: %s\nwant: %s", goldenPath, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestSelectParser(t *testing.T) {
+	if _, err := SelectParser("nope", ""); err == nil {
+		t.Error("expected error for unknown template name")
+	}
+	if _, err := SelectParser("", "not an invoice"); err == nil {
+		t.Error("expected error when no template matches")
+	}
+	parser, err := SelectParser("ccpowerdeals", "")
+	if err != nil || parser.Name() != "ccpowerdeals" {
+		t.Errorf("select by name: %v, %v", parser, err)
+	}
+}
+
+// add every testdata text as a seed
+func addCorpus(f *testing.F) {
+	inputs, _ := filepath.Glob(filepath.Join("testdata", "*", "*.txt"))
+	for _, input := range inputs {
+		text, err := os.ReadFile(input)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(text))
+	}
+}
+
+// Parse does not recover, a panic anywhere in a template fails the fuzzer
+// run with: go test ./pkg/invoices -fuzz FuzzParseInvoice -fuzzminimizetime 0
+func FuzzParseInvoice(f *testing.F) {
+	addCorpus(f)
+	f.Add("PRICEEXTENDEDPRICE")
+	f.Add("PRICEEXTENDEDPRICEMSRP:Item handling 1.00Total Extended Price:PAID IN FULL Invoice Total:")
+	f.Fuzz(func(t *testing.T, text string) {
+		for _, name := range ParserNames() {
+			parser, err := SelectParser(name, text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parser.Parse(text)
+		}
+	})
+}
+
+// every field extractor and item parser of every template on text it was not written for
+// run with: go test ./pkg/invoices -fuzz FuzzTemplateExtractors
+func FuzzTemplateExtractors(f *testing.F) {
+	addCorpus(f)
+	f.Add("Invoice #:")
+	f.Add("$ 1.00 A1 1T1")
+	f.Fuzz(func(t *testing.T, text string) {
+		for _, name := range ParserNames() {
+			parser, err := SelectParser(name, text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			template, ok := parser.(*InvoiceTemplate)
+			if !ok {
+				continue
+			}
+			var invoice Invoice
+			var diag Diagnostics
+			for _, field := range template.Fields {
+				field.Extract(text, &invoice, &diag)
+			}
+			if template.ParseItem != nil {
+				template.ParseItem(text, &diag)
+			}
+		}
+	})
+}
+
+// run with: go test ./pkg/invoices -fuzz FuzzParseItem
+func FuzzParseItem(f *testing.F) {
+	f.Add("$ 129.99 A12 118233T1")
+	f.Add("$ 10.98Y17 43430T651")
+	f.Add("$ 27.53 G1043239T563")
+	f.Add("$")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, row string) {
+		var diag Diagnostics
+		ccpdItem(row, &diag)
+	})
+}
@@ -0,0 +1,332 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// accepted tenders
+const (
+	TenderCash      string = "cash"
+	TenderCard      string = "card"
+	TenderEtransfer string = "etransfer"
+)
+
+// one payment received against an invoice, voided payments stay in the ledger
+type Payment struct {
+	PaymentID  string    `json:"paymentId" bson:"paymentId"`
+	Method     string    `json:"method" bson:"method"`
+	Amount     Money     `json:"amount" bson:"amount"`
+	Reference  string    `json:"reference" bson:"reference"`
+	ReceivedBy string    `json:"receivedBy" bson:"receivedBy"`
+	Time       Timestamp `json:"time" bson:"time"`
+	Voided     bool      `json:"voided" bson:"voided"`
+	VoidedBy   string    `json:"voidedBy,omitempty" bson:"voidedBy,omitempty"`
+	VoidReason string    `json:"voidReason,omitempty" bson:"voidReason,omitempty"`
+}
+
+var (
+	ErrOverpayment     = errors.New("payment exceeds remaining balance")
+	ErrNotPayable      = errors.New("invoice is not awaiting payment")
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrUnknownTender   = errors.New("unknown payment method")
+)
+
+func checkTender(method string) error {
+	switch method {
+	case TenderCash, TenderCard, TenderEtransfer:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownTender, method)
+}
+
+// sum of the payments that are not voided
+func (invoice Invoice) PaidAmount() Money {
+	var paid Money = 0
+	for _, payment := range invoice.Payments {
+		if !payment.Voided {
+			paid += payment.Amount
+		}
+	}
+	return paid
+}
+
+// amount received per tender, invoices from before the ledger count their total under the single payment method
+func invoiceTenders(invoice Invoice) map[string]Money {
+	tenders := map[string]Money{}
+	if len(invoice.Payments) == 0 {
+		if invoice.PaymentMethod != "" {
+			tenders[invoice.PaymentMethod] = invoice.InvoiceTotal
+		}
+		return tenders
+	}
+	for _, payment := range invoice.Payments {
+		if !payment.Voided {
+			tenders[payment.Method] += payment.Amount
+		}
+	}
+	return tenders
+}
+
+// remaining balance as the ledger has it
+func ledgerBalance(invoice Invoice) Money {
+	return invoice.InvoiceTotal - invoice.PaidAmount()
+}
+
+// balance to store for an invoice, one settled before the ledger existed or marked paid from the pdf
+// has no payments and keeps the stored balance
+func derivedBalance(invoice Invoice, stored Money) Money {
+	if len(invoice.Payments) == 0 && invoice.Status != StatusUnpaid {
+		return stored
+	}
+	return ledgerBalance(invoice)
+}
+
+// pipeline writing the ledger, deriving the balance from it and moving the invoice between unpaid and paid
+// literals keep "$" in descriptions from being read as field paths
+func ledgerPipeline(payments any, event InvoiceEvent) bson.A {
+	paid := bson.M{"$sum": bson.M{"$map": bson.M{
+		"input": bson.M{"$filter": bson.M{
+			"input": "$payments",
+			"cond":  bson.M{"$ne": bson.A{"$$this.voided", true}},
+		}},
+		"in": centsExpr("$$this.amount"),
+	}}}
+	paidOff := bson.M{"$and": bson.A{
+		bson.M{"$eq": bson.A{"$status", StatusUnpaid}},
+		bson.M{"$lte": bson.A{"$remainingBalance", 0}},
+	}}
+	reopened := bson.M{"$and": bson.A{
+		bson.M{"$eq": bson.A{"$status", StatusPaid}},
+		bson.M{"$gt": bson.A{"$remainingBalance", 0}},
+	}}
+	paidEvent := transitionEvent(StatusUnpaid, StatusPaid, event.Actor, "Balance paid in full")
+	reopenEvent := transitionEvent(StatusPaid, StatusUnpaid, event.Actor, "Balance reopened by voided payment")
+
+	return bson.A{
+		bson.M{"$set": bson.M{"payments": payments}},
+		bson.M{"$set": bson.M{"remainingBalance": bson.M{"$subtract": bson.A{centsExpr("$invoiceTotal"), paid}}}},
+		bson.M{"$set": bson.M{"invoiceEvent": bson.M{"$concatArrays": bson.A{
+			bson.M{"$ifNull": bson.A{"$invoiceEvent", bson.A{}}},
+			bson.M{"$literal": bson.A{event}},
+			bson.M{"$cond": bson.A{paidOff, bson.M{"$literal": bson.A{paidEvent}}, bson.A{}}},
+			bson.M{"$cond": bson.A{reopened, bson.M{"$literal": bson.A{reopenEvent}}, bson.A{}}},
+		}}}},
+		bson.M{"$set": bson.M{"status": bson.M{"$switch": bson.M{
+			"branches": bson.A{
+				bson.M{"case": paidOff, "then": StatusPaid},
+				bson.M{"case": reopened, "then": StatusUnpaid},
+			},
+			"default": "$status",
+		}}}},
+	}
+}
+
+// add a payment to the ledger, the balance cannot be overdrawn by concurrent payments
+func addPayment(ctx context.Context, collection *mongo.Collection, filter bson.M, payment Payment) (Invoice, error) {
+	event := InvoiceEvent{
+		Title: "Payment",
+		Desc:  fmt.Sprintf("Received %s by %s", payment.Amount, payment.Method),
+		Time:  payment.Time,
+		Actor: payment.ReceivedBy,
+	}
+	payments := bson.M{"$concatArrays": bson.A{
+		bson.M{"$ifNull": bson.A{"$payments", bson.A{}}},
+		bson.M{"$literal": bson.A{payment}},
+	}}
+	update := append(bson.A{bson.M{"$set": bson.M{"paymentMethod": payment.Method}}}, ledgerPipeline(payments, event)...)
+
+	payable := bson.M{
+		"status": StatusUnpaid,
+		"$expr":  bson.M{"$gte": bson.A{centsExpr("$remainingBalance"), payment.Amount}},
+	}
+	for key, val := range filter {
+		payable[key] = val
+	}
+
+	var updated Invoice
+	err := collection.FindOneAndUpdate(
+		ctx,
+		payable,
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return updated, err
+	}
+
+	// nothing matched, find out why
+	invoice, err := findInvoice(ctx, collection, filter)
+	if err != nil {
+		return invoice, err
+	}
+	if invoice.Status != StatusUnpaid {
+		return invoice, fmt.Errorf("%w: status is %s", ErrNotPayable, invoice.Status)
+	}
+	return invoice, fmt.Errorf("%w: remaining %s", ErrOverpayment, invoice.RemainingBalance)
+}
+
+// void a payment, only before the goods leave so refunds stay the way to give money back
+func voidPayment(ctx context.Context, collection *mongo.Collection, filter bson.M, paymentID string, actor string, reason string) (Invoice, error) {
+	event := InvoiceEvent{
+		Title: "Payment Voided",
+		Desc:  reason,
+		Time:  eventTime(),
+		Actor: actor,
+	}
+	payments := bson.M{"$map": bson.M{
+		"input": "$payments",
+		"in": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$$this.paymentId", paymentID}},
+			bson.M{"$mergeObjects": bson.A{"$$this", bson.M{"$literal": bson.M{
+				"voided":     true,
+				"voidedBy":   actor,
+				"voidReason": reason,
+			}}}},
+			"$$this",
+		}},
+	}}
+
+	voidable := bson.M{
+		"status":   bson.M{"$in": bson.A{StatusUnpaid, StatusPaid}},
+		"payments": bson.M{"$elemMatch": bson.M{"paymentId": paymentID, "voided": bson.M{"$ne": true}}},
+	}
+	for key, val := range filter {
+		voidable[key] = val
+	}
+
+	var updated Invoice
+	err := collection.FindOneAndUpdate(
+		ctx,
+		voidable,
+		ledgerPipeline(payments, event),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return updated, err
+	}
+
+	invoice, err := findInvoice(ctx, collection, filter)
+	if err != nil {
+		return invoice, err
+	}
+	if invoice.Status != StatusUnpaid && invoice.Status != StatusPaid {
+		return invoice, fmt.Errorf("%w: status is %s", ErrNotPayable, invoice.Status)
+	}
+	return invoice, ErrPaymentNotFound
+}
+
+func findInvoice(ctx context.Context, collection *mongo.Collection, filter bson.M) (Invoice, error) {
+	var invoice Invoice
+	err := collection.FindOne(ctx, filter).Decode(&invoice)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return invoice, ErrInvoiceNotFound
+	}
+	return invoice, err
+}
+
+// http status for a payment error
+func paymentErrorCode(err error) int {
+	switch {
+	case errors.Is(err, ErrOverpayment), errors.Is(err, ErrUnknownTender):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrPaymentNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotPayable):
+		return http.StatusConflict
+	}
+	return transitionErrorCode(err)
+}
+
+type AddPaymentReq struct {
+	InvoiceNumber string `json:"invoiceNumber" binding:"required"`
+	AuctionLot    int    `json:"auctionLot" binding:"required"`
+	Method        string `json:"method" binding:"required"`
+	Amount        Money  `json:"amount" binding:"required,gt=0"`
+	Reference     string `json:"reference"`
+}
+
+// record one tender against an invoice, split payments are several calls
+func AddPayment(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AddPaymentReq
+		bindErr := c.ShouldBindJSON(&req)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+		if err := checkTender(req.Method); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		payment := Payment{
+			PaymentID:  uuid.NewString(),
+			Method:     req.Method,
+			Amount:     req.Amount,
+			Reference:  req.Reference,
+			ReceivedBy: c.GetString("uid"),
+			Time:       eventTime(),
+		}
+		updated, err := addPayment(
+			context.Background(),
+			collection,
+			bson.M{
+				"invoiceNumber": req.InvoiceNumber,
+				"auctionLot":    req.AuctionLot,
+			},
+			payment,
+		)
+		if err != nil {
+			c.String(paymentErrorCode(err), err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, updated)
+	}
+}
+
+type VoidPaymentReq struct {
+	InvoiceNumber string `json:"invoiceNumber" binding:"required"`
+	AuctionLot    int    `json:"auctionLot" binding:"required"`
+	PaymentID     string `json:"paymentId" binding:"required"`
+	Reason        string `json:"reason" binding:"required"`
+}
+
+// void a payment recorded by mistake, the balance is derived again from the ledger
+func VoidPayment(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req VoidPaymentReq
+		bindErr := c.ShouldBindJSON(&req)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+
+		updated, err := voidPayment(
+			context.Background(),
+			collection,
+			bson.M{
+				"invoiceNumber": req.InvoiceNumber,
+				"auctionLot":    req.AuctionLot,
+			},
+			req.PaymentID,
+			c.GetString("uid"),
+			req.Reason,
+		)
+		if err != nil {
+			c.String(paymentErrorCode(err), err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, updated)
+	}
+}
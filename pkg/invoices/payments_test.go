@@ -0,0 +1,38 @@
+package invoices
+
+import "testing"
+
+func TestLedgerBalance(t *testing.T) {
+	invoice := Invoice{
+		InvoiceTotal: 10010,
+		Payments: []Payment{
+			{Method: TenderCash, Amount: 4000},
+			{Method: TenderEtransfer, Amount: 5005},
+			{Method: TenderCard, Amount: 1005, Voided: true},
+		},
+	}
+	if got := ledgerBalance(invoice); got != 1005 {
+		t.Errorf("ledgerBalance = %v, want 10.05", got)
+	}
+
+	tenders := invoiceTenders(invoice)
+	if tenders[TenderCash] != 4000 || tenders[TenderEtransfer] != 5005 || tenders[TenderCard] != 0 {
+		t.Errorf("invoiceTenders = %v", tenders)
+	}
+
+	// invoices from before the ledger count under their payment method
+	legacy := Invoice{InvoiceTotal: 2500, PaymentMethod: TenderCash}
+	if tenders := invoiceTenders(legacy); tenders[TenderCash] != 2500 {
+		t.Errorf("legacy invoiceTenders = %v", tenders)
+	}
+
+	// and keep their stored balance when they were settled without the ledger
+	legacy.Status = StatusPaid
+	if got := derivedBalance(legacy, 0); got != 0 {
+		t.Errorf("legacy derivedBalance = %v, want 0", got)
+	}
+	legacy.Status = StatusUnpaid
+	if got := derivedBalance(legacy, 0); got != 2500 {
+		t.Errorf("unpaid derivedBalance = %v, want 25.00", got)
+	}
+}
@@ -0,0 +1,197 @@
+package invoices
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dslipak/pdf"
+	"github.com/minio/minio-go/v7"
+)
+
+// max size of one uploaded invoice pdf
+const maxInvoicePDFSize = 10 * 1024 * 1024
+
+// an uploaded file that produced no invoice
+type FileError struct {
+	FileName string `json:"fileName"`
+	Error    string `json:"error"`
+}
+
+// reject uploads that are too large or not pdf
+// the form field name is whatever the client chose, the extension comes from the file name
+func checkPDFUpload(header *multipart.FileHeader) error {
+	if header.Size > maxInvoicePDFSize {
+		return errors.New("File Size Must Not Exceed 10 MB")
+	}
+	if !strings.EqualFold(filepath.Ext(header.Filename), ".pdf") {
+		return errors.New("Please Only Upload PDF File")
+	}
+	return nil
+}
+
+// read the plain text of a pdf
+func extractPDFText(r io.ReaderAt, size int64) (text string, err error) {
+	// the pdf reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot read pdf: %v", r)
+		}
+	}()
+
+	pdfObj, err := pdf.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+	reader, err := pdfObj.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+
+	// read plain text into buffer
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// memory ceiling and spill directory for buffered pdf uploads
+var pdfMaxMemory int64 = 8 * 1024 * 1024
+var pdfTempDir string = os.TempDir()
+
+// configure how uploads are buffered, zero or empty keeps the default
+func SetPDFBufferLimits(maxMemory int64, tempDir string) {
+	if maxMemory > 0 {
+		pdfMaxMemory = maxMemory
+	}
+	if tempDir != "" {
+		pdfTempDir = tempDir
+	}
+}
+
+// an upload read once, held in memory or spilled to a temp file above the ceiling
+type pdfBuffer struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// read r fully into a pdfBuffer, the caller must Close it
+func bufferPDF(r io.Reader) (*pdfBuffer, error) {
+	// read one byte past the ceiling to know if it fits
+	var head bytes.Buffer
+	n, err := head.ReadFrom(io.LimitReader(r, pdfMaxMemory+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= pdfMaxMemory {
+		return &pdfBuffer{data: head.Bytes(), size: n}, nil
+	}
+
+	// too large, spill what was read and the rest to disk
+	if err := os.MkdirAll(pdfTempDir, 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(pdfTempDir, "invoice-*.pdf")
+	if err != nil {
+		return nil, err
+	}
+	buf := &pdfBuffer{file: tmp}
+	size, err := io.Copy(tmp, io.MultiReader(&head, r))
+	if err != nil {
+		buf.Close()
+		return nil, err
+	}
+	buf.size = size
+	return buf, nil
+}
+
+func (b *pdfBuffer) ReaderAt() io.ReaderAt {
+	if b.file != nil {
+		return b.file
+	}
+	return bytes.NewReader(b.data)
+}
+
+// a fresh reader from the start, can be called any number of times
+func (b *pdfBuffer) NewReader() io.Reader {
+	return io.NewSectionReader(b.ReaderAt(), 0, b.size)
+}
+
+func (b *pdfBuffer) Size() int64 {
+	return b.size
+}
+
+// release the memory or remove the spilled temp file
+func (b *pdfBuffer) Close() error {
+	b.data = nil
+	if b.file == nil {
+		return nil
+	}
+	closeErr := b.file.Close()
+	removeErr := os.Remove(b.file.Name())
+	b.file = nil
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
+
+// buffer a multipart upload, the multipart file is closed before returning
+func bufferUpload(header *multipart.FileHeader) (*pdfBuffer, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+	defer file.Close()
+	return bufferPDF(file)
+}
+
+// an invoice pdf waiting to be parsed
+type pdfSource struct {
+	FileName    string
+	ContentType string
+	Buffer      *pdfBuffer
+}
+
+// upload (optional), extract and parse one invoice pdf
+// the same buffer feeds both the upload and the parser
+func parseInvoicePDF(
+	ctx context.Context,
+	storageClient *minio.Client,
+	src pdfSource,
+	toUpload bool,
+	templateName string,
+) (ParseResult, error) {
+	var cdnLink string = ""
+	// upload invoice to space object storage if uploadPDF in form is true
+	if toUpload {
+		cdnLink = UploadToSpace(ctx, storageClient, invoiceBucket, src.Buffer.NewReader(), src.FileName, src.Buffer.Size(), src.ContentType)
+	}
+
+	extractedText, err := extractPDFText(src.Buffer.ReaderAt(), src.Buffer.Size())
+	if err != nil {
+		return ParseResult{}, err
+	}
+
+	// pick the invoice template for this pdf
+	parser, err := SelectParser(templateName, extractedText)
+	if err != nil {
+		return ParseResult{}, err
+	}
+
+	// split and extract data with the template
+	result, err := parser.Parse(extractedText)
+	if err != nil {
+		return result, err
+	}
+	result.Invoice.InvoiceCdn = cdnLink
+	return result, nil
+}
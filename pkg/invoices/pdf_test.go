@@ -0,0 +1,63 @@
+package invoices
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBufferPDFSpillsAboveCeiling(t *testing.T) {
+	defaultMemory, defaultDir := pdfMaxMemory, pdfTempDir
+	defer func() { pdfMaxMemory, pdfTempDir = defaultMemory, defaultDir }()
+	SetPDFBufferLimits(8, t.TempDir())
+
+	for _, content := range []string{"small", "larger than eight bytes"} {
+		buf, err := bufferPDF(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		spilled := buf.file != nil
+		if spilled != (len(content) > 8) {
+			t.Errorf("%q spilled = %v", content, spilled)
+		}
+		if buf.Size() != int64(len(content)) {
+			t.Errorf("%q size = %d", content, buf.Size())
+		}
+
+		// the buffer can be read more than once, e.g. upload then parse
+		for i := 0; i < 2; i++ {
+			got, _ := io.ReadAll(buf.NewReader())
+			if !bytes.Equal(got, []byte(content)) {
+				t.Errorf("read %d got %q", i, got)
+			}
+		}
+
+		var name string
+		if spilled {
+			name = buf.file.Name()
+		}
+		if err := buf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if spilled {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("temp file %s not removed", name)
+			}
+		}
+	}
+}
+
+func TestCheckPDFUploadUsesFileName(t *testing.T) {
+	if err := checkPDFUpload(&multipart.FileHeader{Filename: "10240.PDF", Size: 1024}); err != nil {
+		t.Errorf("pdf rejected: %v", err)
+	}
+	if err := checkPDFUpload(&multipart.FileHeader{Filename: "invoice.exe", Size: 1024}); err == nil {
+		t.Error("exe accepted")
+	}
+	if err := checkPDFUpload(&multipart.FileHeader{Filename: "big.pdf", Size: maxInvoicePDFSize + 1}); err == nil {
+		t.Error("oversized pdf accepted")
+	}
+}
@@ -0,0 +1,229 @@
+package invoices
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"strings"
+)
+
+// letter size in points
+const (
+	pageWidth  float64 = 612
+	pageHeight float64 = 792
+)
+
+// minimal pdf writer for generated documents
+// text uses the standard helvetica fonts (WinAnsi), images are embedded as flate compressed rgb with an alpha mask
+// coordinates are in points from the top left corner of the page
+type pdfDoc struct {
+	pages  []*pdfPage
+	images []pdfImage
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+	images  map[int]bool
+}
+
+type pdfImage struct {
+	width  int
+	height int
+	rgb    []byte
+	alpha  []byte
+}
+
+func (d *pdfDoc) addPage() *pdfPage {
+	page := &pdfPage{images: map[int]bool{}}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// helvetica glyph widths per 1000 units for the characters right aligned text is made of
+var helveticaWidths = map[rune]float64{
+	' ': 278, '.': 278, ',': 278, ':': 278, '-': 333, '(': 333, ')': 333, '$': 556, '%': 889, '#': 556, '/': 278,
+}
+
+// approximate rendered width of s, exact for digits and the characters above
+func textWidth(s string, size float64, bold bool) float64 {
+	var width float64 = 0
+	for _, r := range s {
+		w, ok := helveticaWidths[r]
+		switch {
+		case ok:
+		case r >= '0' && r <= '9':
+			w = 556
+		case r >= 'A' && r <= 'Z':
+			w = 667
+		default:
+			w = 556
+		}
+		if bold && (r < '0' || r > '9') {
+			w += 30
+		}
+		width += w
+	}
+	return width * size / 1000
+}
+
+// characters WinAnsi (cp1252) puts where latin-1 has control codes, 0x80 to 0x9f
+var winAnsiExtra = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b,
+	'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+	// no glyph in WinAnsi, the nearest one that has
+	'\u2212': '-', '\u2010': '-', '\u2011': '-', '\u2009': ' ', '\u202f': ' ',
+}
+
+// escape a string for a pdf literal in WinAnsi, characters it has no glyph for become "?"
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteByte(' ')
+		case winAnsiExtra[r] != 0:
+			b.WriteByte(winAnsiExtra[r])
+		case r < 32 || (r >= 0x7f && r < 0xa0) || r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
+
+func (p *pdfPage) text(x float64, y float64, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pageHeight-y, pdfString(s))
+}
+
+func (p *pdfPage) textRight(right float64, y float64, size float64, bold bool, s string) {
+	p.text(right-textWidth(s, size, bold), y, size, bold, s)
+}
+
+func (p *pdfPage) line(x1 float64, y1 float64, x2 float64, y2 float64, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, pageHeight-y1, x2, pageHeight-y2)
+}
+
+// filled rectangle, gray from 0 (black) to 1 (white)
+func (p *pdfPage) fillRect(x float64, y float64, w float64, h float64, gray float64) {
+	fmt.Fprintf(&p.content, "q %.2f g %.2f %.2f %.2f %.2f re f Q\n", gray, x, pageHeight-y-h, w, h)
+}
+
+func (p *pdfPage) strokeRect(x float64, y float64, w float64, h float64, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f %.2f %.2f re S\n", width, x, pageHeight-y-h, w, h)
+}
+
+// add an image to the document, returns its id for pdfPage.image
+func (d *pdfDoc) addImage(img image.Image) int {
+	bounds := img.Bounds()
+	embedded := pdfImage{
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+		rgb:    make([]byte, 0, bounds.Dx()*bounds.Dy()*3),
+		alpha:  make([]byte, 0, bounds.Dx()*bounds.Dy()),
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			// colors are alpha premultiplied, undo it so the mask does the blending
+			if a > 0 {
+				r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
+			}
+			embedded.rgb = append(embedded.rgb, byte(r>>8), byte(g>>8), byte(b>>8))
+			embedded.alpha = append(embedded.alpha, byte(a>>8))
+		}
+	}
+	d.images = append(d.images, embedded)
+	return len(d.images) - 1
+}
+
+// draw an added image scaled into the box
+func (p *pdfPage) image(id int, x float64, y float64, w float64, h float64) {
+	p.images[id] = true
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, x, pageHeight-y-h, id)
+}
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+// serialize the document
+func (d *pdfDoc) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	// objects are numbered from 1 in the order they are written
+	writeObject := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+		out.WriteString("endobj\n")
+	}
+
+	// 1 catalog, 2 page tree, 3 and 4 fonts, then two objects per image, then two per page
+	imageObject := func(id int) int { return 5 + id*2 }
+	pageObject := func(index int) int { return 5 + len(d.images)*2 + index*2 }
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", pageObject(i))
+	}
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)), nil)
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>", nil)
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>", nil)
+
+	for id, img := range d.images {
+		rgb := deflate(img.rgb)
+		writeObject(fmt.Sprintf(
+			"<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode /SMask %d 0 R /Length %d >>",
+			img.width, img.height, imageObject(id)+1, len(rgb),
+		), rgb)
+		alpha := deflate(img.alpha)
+		writeObject(fmt.Sprintf(
+			"<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>",
+			img.width, img.height, len(alpha),
+		), alpha)
+	}
+
+	for i, page := range d.pages {
+		var xobjects []string
+		for id := range d.images {
+			if page.images[id] {
+				xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", id, imageObject(id)))
+			}
+		}
+		writeObject(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> /XObject << %s >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, strings.Join(xobjects, " "), pageObject(i)+1,
+		), nil)
+		content := deflate(page.content.Bytes())
+		writeObject(fmt.Sprintf("<< /Filter /FlateDecode /Length %d >>", len(content)), content)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
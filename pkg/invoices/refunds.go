@@ -0,0 +1,283 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// one refunded quantity of an invoice item, with its share of tax and buyer's premium
+type RefundRecord struct {
+	RefundID      string    `json:"refundId" bson:"refundId"`
+	Sku           int       `json:"sku" bson:"sku"`
+	ItemLot       int       `json:"itemLot" bson:"itemLot"`
+	Desc          string    `json:"desc" bson:"desc"`
+	Quantity      float32   `json:"quantity" bson:"quantity"`
+	Reason        string    `json:"reason" bson:"reason"`
+	Bid           Money     `json:"bid" bson:"bid"`
+	HandlingFee   Money     `json:"handlingFee" bson:"handlingFee"`
+	BuyersPremium Money     `json:"buyersPremium" bson:"buyersPremium"`
+	Tax           Money     `json:"tax" bson:"tax"`
+	Taxes         []TaxLine `json:"taxes" bson:"taxes"`
+	Amount        Money     `json:"amount" bson:"amount"`
+	RefundedBy    string    `json:"refundedBy" bson:"refundedBy"`
+	Time          Timestamp `json:"time" bson:"time"`
+}
+
+// an item to refund, identified by its item lot
+// a sku, when sent, must match the item's, 0 is a valid sku
+type RefundLine struct {
+	ItemLot  int     `json:"itemLot"`
+	Sku      *int    `json:"sku"`
+	Quantity float32 `json:"quantity" binding:"required,gt=0"`
+	Reason   string  `json:"reason" binding:"required"`
+}
+
+type RefundReq struct {
+	InvoiceNumber string       `json:"invoiceNumber" binding:"required"`
+	AuctionLot    int          `json:"auctionLot"`
+	RefundItems   []RefundLine `json:"refundItems" binding:"required,min=1,dive"`
+}
+
+// invoice after a refund with the records it created
+type RefundResult struct {
+	Invoice     Invoice        `json:"invoice"`
+	Refunds     []RefundRecord `json:"refunds"`
+	RefundTotal Money          `json:"refundTotal"`
+	NetTotal    Money          `json:"netTotal"`
+	CreditNote  CreditNote     `json:"creditNote"`
+}
+
+var (
+	ErrRefundItemNotFound = errors.New("refund item not on invoice")
+	ErrRefundQuantity     = errors.New("refund quantity exceeds units left")
+	ErrRefundExceedsPaid  = errors.New("refund exceeds the amount paid")
+)
+
+// units on an item row, rows without a unit count are one unit
+func itemUnits(item InvoiceItem) float32 {
+	if item.Unit <= 0 {
+		return 1
+	}
+	return item.Unit
+}
+
+// units of an item refunded so far
+func refundedUnits(invoice Invoice, itemLot int) float32 {
+	var units float32 = 0
+	for _, refund := range invoice.Refunds {
+		if refund.ItemLot == itemLot {
+			units += refund.Quantity
+		}
+	}
+	return units
+}
+
+// the tax charged on the invoice, prorated to a refunded base
+// by tax line when the breakdown adds up to the charged tax, as one line otherwise
+func refundTaxes(invoice Invoice, base Money) []TaxLine {
+	var invoiceBase Money
+	for _, item := range invoice.Items {
+		invoiceBase += lineBase(invoice, item.Bid.Mul(float64(itemUnits(item))), item.HandlingFee)
+	}
+	if invoice.Tax == 0 || invoiceBase <= 0 {
+		return []TaxLine{}
+	}
+	breakdown := invoice.TaxBreakdown
+	if diff := sumTaxes(breakdown) - invoice.Tax; len(breakdown) == 0 || diff > taxTolerance || diff < -taxTolerance {
+		breakdown = []TaxLine{{Name: "Tax", Amount: invoice.Tax}}
+	}
+	taxes := make([]TaxLine, len(breakdown))
+	for i, tax := range breakdown {
+		taxes[i] = TaxLine{Name: tax.Name, Amount: tax.Amount.Scale(base, invoiceBase)}
+	}
+	return taxes
+}
+
+// most that can still be refunded: what was paid, never more than the invoice total
+// invoices settled before the ledger count as paid in full
+func refundableAmount(invoice Invoice) Money {
+	paid := invoice.PaidAmount()
+	if len(invoice.Payments) == 0 && invoice.Status != StatusUnpaid {
+		paid = invoice.InvoiceTotal
+	}
+	if paid > invoice.InvoiceTotal {
+		paid = invoice.InvoiceTotal
+	}
+	return paid - invoice.RefundTotal
+}
+
+// price the refund lines against the invoice
+// bid and handling fee are refunded per unit, buyer's premium by the bid's share and tax by the base's share of the tax charged
+func buildRefunds(invoice Invoice, lines []RefundLine, actor string) ([]RefundRecord, error) {
+	// rounding each share must not refund more tax than was charged
+	taxLeft := invoice.Tax
+	for _, refund := range invoice.Refunds {
+		taxLeft -= refund.Tax
+	}
+
+	// one request can name an item twice, count both against the units left
+	requested := map[int]float32{}
+	now := eventTime()
+	records := make([]RefundRecord, 0, len(lines))
+	for _, line := range lines {
+		index := -1
+		for i, item := range invoice.Items {
+			if item.ItemLot == line.ItemLot {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("%w: lot %d", ErrRefundItemNotFound, line.ItemLot)
+		}
+		if line.Sku != nil && *line.Sku != invoice.Items[index].Sku {
+			return nil, fmt.Errorf("%w: lot %d is not sku %d", ErrRefundItemNotFound, line.ItemLot, *line.Sku)
+		}
+		item := invoice.Items[index]
+		units := itemUnits(item)
+
+		requested[line.ItemLot] += line.Quantity
+		left := units - refundedUnits(invoice, line.ItemLot)
+		if requested[line.ItemLot] > left {
+			return nil, fmt.Errorf("%w: lot %d has %.0f left", ErrRefundQuantity, line.ItemLot, left)
+		}
+
+		bid := item.Bid.Mul(float64(line.Quantity))
+		fee := item.HandlingFee.Mul(float64(line.Quantity) / float64(units))
+		taxes := refundTaxes(invoice, lineBase(invoice, bid, fee))
+		if over := sumTaxes(taxes) - taxLeft; over > 0 && len(taxes) > 0 {
+			taxes[len(taxes)-1].Amount -= over
+		}
+		taxLeft -= sumTaxes(taxes)
+		record := RefundRecord{
+			RefundID:      uuid.NewString(),
+			Sku:           item.Sku,
+			ItemLot:       item.ItemLot,
+			Desc:          item.Desc,
+			Quantity:      line.Quantity,
+			Reason:        line.Reason,
+			Bid:           bid,
+			HandlingFee:   fee,
+			BuyersPremium: premiumShare(invoice, bid),
+			Tax:           sumTaxes(taxes),
+			Taxes:         taxes,
+			RefundedBy:    actor,
+			Time:          now,
+		}
+		record.Amount = record.Bid + record.HandlingFee + record.BuyersPremium + record.Tax
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// true once every unit of every item has been refunded
+func fullyRefunded(invoice Invoice, records []RefundRecord) bool {
+	invoice.Refunds = append(append([]RefundRecord{}, invoice.Refunds...), records...)
+	for _, item := range invoice.Items {
+		if refundedUnits(invoice, item.ItemLot) < itemUnits(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// http status for a refund error
+func refundErrorCode(err error) int {
+	switch {
+	case errors.Is(err, ErrRefundItemNotFound), errors.Is(err, ErrRefundQuantity), errors.Is(err, ErrRefundExceedsPaid):
+		return http.StatusBadRequest
+	}
+	return transitionErrorCode(err)
+}
+
+// refund items of an invoice, the invoice moves to partially refunded or refunded
+func refundItems(ctx context.Context, collection *mongo.Collection, filter bson.M, lines []RefundLine, actor string) (RefundResult, error) {
+	var result RefundResult
+	invoice, err := findInvoice(ctx, collection, filter)
+	if err != nil {
+		return result, err
+	}
+	records, err := buildRefunds(invoice, lines, actor)
+	if err != nil {
+		return result, err
+	}
+
+	var sum Money = 0
+	for _, record := range records {
+		sum += record.Amount
+	}
+	if left := refundableAmount(invoice); sum > left {
+		return result, fmt.Errorf("%w: %s left", ErrRefundExceedsPaid, left)
+	}
+	next := StatusPartiallyRefunded
+	if fullyRefunded(invoice, records) {
+		next = StatusRefunded
+	}
+	if err := CanTransition(invoice, next); err != nil {
+		return result, err
+	}
+
+	updated, err := applyTransition(ctx, collection, invoice, StatusChange{
+		To:    next,
+		Actor: actor,
+		Desc:  fmt.Sprintf("Refund: %d Items, Total: %s", len(records), sum),
+		Push:  bson.M{"refunds": bson.M{"$each": records}},
+		Set:   bson.M{"refundTotal": invoice.RefundTotal + sum},
+		// a refund recorded meanwhile changes the units left, even when the status stays
+		Match: bson.M{fmt.Sprintf("refunds.%d", len(invoice.Refunds)): bson.M{"$exists": false}},
+	})
+	if err != nil {
+		return result, err
+	}
+
+	result = RefundResult{
+		Invoice:     updated,
+		Refunds:     records,
+		RefundTotal: updated.RefundTotal,
+		NetTotal:    updated.InvoiceTotal - updated.RefundTotal,
+	}
+	return result, nil
+}
+
+// takes invoice number and refund item array, records every refunded item, moves the invoice to (partially) refunded
+// and issues a credit note for the refunded items, all in one transaction
+func RefundInvoice(collection *mongo.Collection, creditNotes *mongo.Collection, counters *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RefundReq
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+
+		filter := bson.M{"invoiceNumber": req.InvoiceNumber}
+		if req.AuctionLot != 0 {
+			filter["auctionLot"] = req.AuctionLot
+		}
+		var result RefundResult
+		ctx := context.Background()
+		err = withTransaction(ctx, collection, func(sessCtx mongo.SessionContext) error {
+			var err error
+			result, err = refundItems(sessCtx, collection, filter, req.RefundItems, c.GetString("uid"))
+			if err != nil {
+				return err
+			}
+			note := creditNoteFromRefunds(result.Invoice, result.Refunds, c.GetString("uid"))
+			result.CreditNote, err = issueCreditNote(sessCtx, creditNotes, counters, note)
+			return err
+		})
+		if err != nil {
+			c.String(refundErrorCode(err), err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,89 @@
+package invoices
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBuildRefunds(t *testing.T) {
+	invoice := Invoice{
+		Tax:           1300,
+		BuyersPremium: 1000,
+		Items: []InvoiceItem{
+			{Sku: 1, ItemLot: 1, Bid: 2000, Unit: 2, HandlingFee: 1000},
+			{Sku: 2, ItemLot: 2, Bid: 5000, Unit: 1},
+		},
+		Refunds: []RefundRecord{{Sku: 2, ItemLot: 2, Quantity: 1}},
+	}
+
+	records, err := buildRefunds(invoice, []RefundLine{{ItemLot: 1, Quantity: 1, Reason: "damaged"}}, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one of two units: bid 20, fee 5, 20 of the 90 bid carries 2.22 premium, 27.22 of the 110 base carries 3.22 of the tax
+	got := records[0]
+	if got.Bid != 2000 || got.HandlingFee != 500 || got.BuyersPremium != 222 || got.Tax != 322 || got.Amount != 3044 {
+		t.Errorf("refund record = %+v", got)
+	}
+	if fullyRefunded(invoice, records) {
+		t.Error("one unit left, invoice should not be fully refunded")
+	}
+
+	// the same item twice in one request counts against the units left
+	_, err = buildRefunds(invoice, []RefundLine{{ItemLot: 1, Quantity: 1}, {ItemLot: 1, Quantity: 2}}, "uid")
+	if !errors.Is(err, ErrRefundQuantity) {
+		t.Errorf("over refund: got %v", err)
+	}
+	_, err = buildRefunds(invoice, []RefundLine{{ItemLot: 2, Quantity: 1}}, "uid")
+	if !errors.Is(err, ErrRefundQuantity) {
+		t.Errorf("refund twice: got %v", err)
+	}
+	_, err = buildRefunds(invoice, []RefundLine{{ItemLot: 3, Quantity: 1}}, "uid")
+	if !errors.Is(err, ErrRefundItemNotFound) {
+		t.Errorf("unknown item: got %v", err)
+	}
+	// lines are keyed on the item lot, a sku sent along has to match and may be 0
+	wrongSku, noSku := 2, 0
+	_, err = buildRefunds(invoice, []RefundLine{{ItemLot: 1, Sku: &wrongSku, Quantity: 1}}, "uid")
+	if !errors.Is(err, ErrRefundItemNotFound) {
+		t.Errorf("sku of another lot: got %v", err)
+	}
+	invoice.Items[0].Sku = 0
+	if _, err = buildRefunds(invoice, []RefundLine{{ItemLot: 1, Sku: &noSku, Quantity: 1}}, "uid"); err != nil {
+		t.Errorf("sku 0: got %v", err)
+	}
+	invoice.Items[0].Sku = 1
+
+	records, _ = buildRefunds(invoice, []RefundLine{{ItemLot: 1, Quantity: 2}}, "uid")
+	if !fullyRefunded(invoice, records) {
+		t.Error("every unit refunded, invoice should be fully refunded")
+	}
+
+	// the breakdown is prorated when it adds up to the tax charged, a tax exempt invoice refunds none
+	invoice.TaxBreakdown = []TaxLine{{Name: "GST", Amount: 500}, {Name: "PST", Amount: 800}}
+	records, _ = buildRefunds(invoice, []RefundLine{{ItemLot: 1, Quantity: 1}}, "uid")
+	if taxes := records[0].Taxes; len(taxes) != 2 || taxes[0].Amount != 124 || taxes[1].Amount != 198 {
+		t.Errorf("prorated breakdown = %+v", taxes)
+	}
+	invoice.Tax, invoice.TaxBreakdown = 0, nil
+	records, _ = buildRefunds(invoice, []RefundLine{{ItemLot: 1, Quantity: 1}}, "uid")
+	if records[0].Tax != 0 {
+		t.Errorf("tax exempt refund tax = %v", records[0].Tax)
+	}
+}
+
+func TestRefundableAmount(t *testing.T) {
+	invoice := Invoice{
+		Status:       StatusPaid,
+		InvoiceTotal: 10000,
+		RefundTotal:  2500,
+		Payments:     []Payment{{Amount: 6000}, {Amount: 4000, Voided: true}},
+	}
+	if got := refundableAmount(invoice); got != 3500 {
+		t.Errorf("refundableAmount = %v, want 35.00", got)
+	}
+	invoice.Payments = nil
+	if got := refundableAmount(invoice); got != 7500 {
+		t.Errorf("legacy refundableAmount = %v, want 75.00", got)
+	}
+}
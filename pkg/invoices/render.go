@@ -0,0 +1,427 @@
+package invoices
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/v7"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// printable documents rendered from an invoice
+const (
+	DocumentInvoice    string = "invoice"
+	DocumentReceipt    string = "receipt"
+	DocumentPickupSlip string = "pickup"
+)
+
+var ErrUnknownDocument = errors.New("unknown document kind")
+
+// business details printed on every document
+const (
+	brandName    string = "CC Power Deals"
+	brandAddress string = "240 Bartor Road, Unit 4, North York, ON, M9M 2W6"
+	brandPhone   string = "+1 416-740-2333"
+)
+
+const (
+	pageMargin   float64 = 40
+	rowHeight    float64 = 16
+	pageBottom   float64 = pageHeight - 60
+	signatureBox float64 = 70
+)
+
+// signature images to embed, nil when the invoice has none or it cannot be loaded
+type renderSignatures struct {
+	Pickup image.Image
+	Return image.Image
+}
+
+// a table column, right aligned columns are anchored on their right edge
+type renderColumn struct {
+	Title string
+	X     float64
+	Right bool
+	// characters kept of longer values
+	Width int
+}
+
+func money(val Money) string {
+	return "$" + val.String()
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if width <= 0 || len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-1]) + "."
+}
+
+// item columns of a document, pickup slips leave prices out and add a check box
+func documentColumns(kind string) []renderColumn {
+	if kind == DocumentPickupSlip {
+		return []renderColumn{
+			{Title: "Lot", X: pageMargin},
+			{Title: "SKU", X: 80},
+			{Title: "Description", X: 140, Width: 52},
+			{Title: "Shelf", X: 430},
+			{Title: "Units", X: 510, Right: true},
+			{Title: "Picked", X: 530},
+		}
+	}
+	return []renderColumn{
+		{Title: "Lot", X: pageMargin},
+		{Title: "SKU", X: 80},
+		{Title: "Description", X: 140, Width: 34},
+		{Title: "Shelf", X: 320},
+		{Title: "Units", X: 395, Right: true},
+		{Title: "Price", X: 450, Right: true},
+		{Title: "Fee", X: 505, Right: true},
+		{Title: "Amount", X: pageWidth - pageMargin, Right: true},
+	}
+}
+
+func itemCells(kind string, item InvoiceItem) []string {
+	units := strconv.FormatFloat(float64(itemUnits(item)), 'f', -1, 32)
+	if kind == DocumentPickupSlip {
+		return []string{strconv.Itoa(item.ItemLot), strconv.Itoa(item.Sku), item.Desc, item.ShelfLocation, units, ""}
+	}
+	amount := item.ExtendedPrice
+	if amount == 0 {
+		amount = item.Bid.Mul(float64(itemUnits(item)))
+	}
+	return []string{
+		strconv.Itoa(item.ItemLot),
+		strconv.Itoa(item.Sku),
+		item.Desc,
+		item.ShelfLocation,
+		units,
+		money(item.Bid),
+		money(item.HandlingFee),
+		money(amount + item.HandlingFee),
+	}
+}
+
+// lays out a document top to bottom and starts new pages as needed
+type documentWriter struct {
+	doc   *pdfDoc
+	page  *pdfPage
+	y     float64
+	title string
+	// invoice number and lot, repeated on every page
+	ref string
+}
+
+func (w *documentWriter) newPage() {
+	w.page = w.doc.addPage()
+	w.page.text(pageMargin, 50, 18, true, brandName)
+	w.page.text(pageMargin, 64, 8, false, brandAddress+"  |  "+brandPhone)
+	w.page.textRight(pageWidth-pageMargin, 50, 16, true, strings.ToUpper(w.title))
+	w.page.textRight(pageWidth-pageMargin, 64, 9, false, w.ref)
+	w.page.line(pageMargin, 74, pageWidth-pageMargin, 74, 1)
+	w.y = 96
+}
+
+// make room for height points, on a new page if this one is full
+func (w *documentWriter) reserve(height float64) {
+	if w.y+height > pageBottom {
+		w.newPage()
+	}
+}
+
+func (w *documentWriter) tableHeader(columns []renderColumn) {
+	w.reserve(rowHeight * 2)
+	w.page.fillRect(pageMargin, w.y-11, pageWidth-pageMargin*2, rowHeight, 0.9)
+	for _, column := range columns {
+		if column.Right {
+			w.page.textRight(column.X, w.y, 9, true, column.Title)
+		} else {
+			w.page.text(column.X, w.y, 9, true, column.Title)
+		}
+	}
+	w.y += rowHeight
+}
+
+func (w *documentWriter) tableRow(columns []renderColumn, cells []string, checkBox bool) {
+	if w.y+rowHeight > pageBottom {
+		w.newPage()
+		w.tableHeader(columns)
+	}
+	for i, column := range columns {
+		if i >= len(cells) {
+			break
+		}
+		value := truncate(cells[i], column.Width)
+		if column.Right {
+			w.page.textRight(column.X, w.y, 9, false, value)
+		} else {
+			w.page.text(column.X, w.y, 9, false, value)
+		}
+	}
+	if checkBox {
+		w.page.strokeRect(columns[len(columns)-1].X+8, w.y-9, 10, 10, 0.8)
+	}
+	w.y += rowHeight
+}
+
+// label and value pair right aligned under the item table
+func (w *documentWriter) total(label string, value string, bold bool) {
+	w.reserve(rowHeight)
+	w.page.textRight(470, w.y, 10, bold, label)
+	w.page.textRight(pageWidth-pageMargin, w.y, 10, bold, value)
+	w.y += rowHeight
+}
+
+func (w *documentWriter) heading(s string) {
+	w.reserve(rowHeight * 3)
+	w.y += 8
+	w.page.text(pageMargin, w.y, 11, true, s)
+	w.y += rowHeight
+}
+
+// render an invoice, receipt or pickup slip as pdf
+func renderInvoicePDF(invoice Invoice, kind string, signatures renderSignatures) ([]byte, error) {
+	titles := map[string]string{
+		DocumentInvoice:    "Invoice",
+		DocumentReceipt:    "Receipt",
+		DocumentPickupSlip: "Pickup Slip",
+	}
+	title, known := titles[kind]
+	if !known {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDocument, kind)
+	}
+
+	w := &documentWriter{
+		doc:   &pdfDoc{},
+		title: title,
+		ref:   fmt.Sprintf("Invoice #%s  |  Auction Lot %d", invoice.InvoiceNumber, invoice.AuctionLot),
+	}
+	w.newPage()
+
+	// buyer and invoice details side by side
+	top := w.y
+	w.page.text(pageMargin, w.y, 9, true, "BILL TO")
+	lines := []string{invoice.BuyerName, invoice.BuyerEmail, invoice.BuyerPhone, invoice.BuyerAddress}
+	if invoice.IsShipping {
+		lines = append(lines, "Ship to: "+invoice.ShippingAddress)
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		w.y += 13
+		w.page.text(pageMargin, w.y, 10, false, truncate(line, 60))
+	}
+	details := [][2]string{
+		{"Invoice Date", invoice.Time.String()},
+		{"Status", string(invoice.Status)},
+		{"Delivery", "Pickup"},
+	}
+	if invoice.IsShipping {
+		details[2][1] = "Shipping"
+	}
+	detailY := top
+	for _, detail := range details {
+		w.page.text(360, detailY, 9, true, detail[0])
+		w.page.text(440, detailY, 9, false, truncate(detail[1], 26))
+		detailY += 13
+	}
+	if detailY > w.y {
+		w.y = detailY
+	}
+	w.y += 24
+
+	// items
+	columns := documentColumns(kind)
+	w.tableHeader(columns)
+	for _, item := range invoice.Items {
+		w.tableRow(columns, itemCells(kind, item), kind == DocumentPickupSlip)
+	}
+	w.reserve(rowHeight)
+	w.page.line(pageMargin, w.y-10, pageWidth-pageMargin, w.y-10, 0.5)
+	w.y += 6
+
+	if kind != DocumentPickupSlip {
+		var subtotal Money = 0
+		for _, item := range invoice.Items {
+			if item.ExtendedPrice != 0 {
+				subtotal += item.ExtendedPrice
+			} else {
+				subtotal += item.Bid.Mul(float64(itemUnits(item)))
+			}
+		}
+		w.total("Subtotal", money(subtotal), false)
+		w.total("Handling Fees", money(invoice.TotalHandlingFee), false)
+		w.total("Buyer's Premium", money(invoice.BuyersPremium), false)
+		if len(invoice.TaxBreakdown) > 0 && sumTaxes(invoice.TaxBreakdown) == invoice.Tax {
+			for _, tax := range invoice.TaxBreakdown {
+				w.total(fmt.Sprintf("%s (%s)", tax.Name, invoice.TaxProvince), money(tax.Amount), false)
+			}
+		} else {
+			w.total("Tax", money(invoice.Tax), false)
+		}
+		w.total("Invoice Total", money(invoice.InvoiceTotal), true)
+		if invoice.RefundTotal > 0 {
+			w.total("Refunded", "-"+money(invoice.RefundTotal), false)
+		}
+		w.total("Paid", money(invoice.PaidAmount()), false)
+		w.total("Balance Due", money(invoice.RemainingBalance), true)
+
+		// payments
+		var payments []Payment
+		for _, payment := range invoice.Payments {
+			if !payment.Voided {
+				payments = append(payments, payment)
+			}
+		}
+		if len(payments) > 0 {
+			w.heading("Payments")
+			for _, payment := range payments {
+				w.reserve(rowHeight)
+				w.page.text(pageMargin, w.y, 9, false, truncate(payment.Time.String(), 32))
+				w.page.text(220, w.y, 9, false, payment.Method)
+				w.page.text(300, w.y, 9, false, truncate(payment.Reference, 30))
+				w.page.textRight(pageWidth-pageMargin, w.y, 9, false, money(payment.Amount))
+				w.y += rowHeight
+			}
+		}
+	}
+
+	// signatures
+	type signatureBlock struct {
+		label string
+		image image.Image
+		time  Timestamp
+	}
+	blocks := []signatureBlock{}
+	if signatures.Pickup != nil || kind == DocumentPickupSlip {
+		blocks = append(blocks, signatureBlock{"Pickup Signature", signatures.Pickup, invoice.PickupTime})
+	}
+	if signatures.Return != nil {
+		blocks = append(blocks, signatureBlock{"Return Signature", signatures.Return, invoice.ReturnTime})
+	}
+	if len(blocks) > 0 {
+		w.reserve(signatureBox + rowHeight*3)
+		w.y += 16
+		for i, block := range blocks {
+			x := pageMargin + float64(i)*270
+			w.page.text(x, w.y, 9, true, block.label)
+			if block.image != nil {
+				bounds := block.image.Bounds()
+				width := signatureBox * float64(bounds.Dx()) / float64(bounds.Dy())
+				if width > 240 {
+					width = 240
+				}
+				w.page.image(w.doc.addImage(block.image), x, w.y+6, width, signatureBox)
+			}
+			w.page.line(x, w.y+signatureBox+10, x+240, w.y+signatureBox+10, 0.5)
+			w.page.text(x, w.y+signatureBox+22, 8, false, block.time.String())
+		}
+		w.y += signatureBox + 30
+	}
+
+	// page numbers once the page count is known
+	for i, page := range w.doc.pages {
+		page.textRight(pageWidth-pageMargin, pageHeight-30, 8, false, fmt.Sprintf("Page %d of %d", i+1, len(w.doc.pages)))
+	}
+	return w.doc.bytes(), nil
+}
+
+// load a signature image from its cdn url, nil if there is none
+func loadSignature(ctx context.Context, storageClient *minio.Client, cdnURL string) image.Image {
+	if cdnURL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(cdnURL)
+	if err != nil {
+		fmt.Println("invalid signature url:", err)
+		return nil
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	object, err := storageClient.GetObject(ctx, signatureBucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		fmt.Println("cannot get signature:", err)
+		return nil
+	}
+	defer object.Close()
+	img, _, err := image.Decode(io.LimitReader(object, 10<<20))
+	if err != nil {
+		fmt.Println("cannot decode signature:", err)
+		return nil
+	}
+	return img
+}
+
+// render an invoice, receipt or pickup slip as pdf
+// query: kind (invoice, receipt or pickup), auctionLot, store
+// with store=true the pdf goes to the invoice bucket and its cdn url is returned instead
+func RenderInvoice(storageClient *minio.Client, collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		kind := c.DefaultQuery("kind", DocumentInvoice)
+		toStore, _ := strconv.ParseBool(c.Query("store"))
+
+		filter := bson.M{"invoiceNumber": c.Param("invoiceNumber")}
+		if lot := c.Query("auctionLot"); lot != "" {
+			auctionLot, err := strconv.Atoi(lot)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Invalid Auction Lot")
+				return
+			}
+			filter["auctionLot"] = auctionLot
+		}
+		invoice, err := findInvoice(ctx, collection, filter)
+		if err != nil {
+			c.String(transitionErrorCode(err), err.Error())
+			return
+		}
+
+		signatures := renderSignatures{
+			Pickup: loadSignature(ctx, storageClient, invoice.SignatureCdn),
+			Return: loadSignature(ctx, storageClient, invoice.ReturnSigCdn),
+		}
+		rendered, err := renderInvoicePDF(invoice, kind, signatures)
+		if errors.Is(err, ErrUnknownDocument) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Render PDF")
+			return
+		}
+
+		fileName := fmt.Sprintf("%s_%d_%s.pdf", invoice.InvoiceNumber, invoice.AuctionLot, kind)
+		if !toStore {
+			c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", fileName))
+			c.Data(http.StatusOK, "application/pdf", rendered)
+			return
+		}
+
+		// generated documents sit next to the auction house originals
+		cdnURL := UploadToSpace(ctx, storageClient, invoiceBucket, bytes.NewReader(rendered), "generated/"+fileName, int64(len(rendered)), "application/pdf")
+		// a stored invoice becomes the invoice's pdf, receipts and slips are only linked in the response
+		if kind == DocumentInvoice {
+			_, err := collection.UpdateOne(ctx, invoiceKey(invoice), bson.M{"$set": bson.M{"invoiceCdn": cdnURL}})
+			if err != nil {
+				fmt.Println(err.Error())
+				c.String(http.StatusInternalServerError, "Cannot Link PDF")
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"cdn": cdnURL})
+	}
+}
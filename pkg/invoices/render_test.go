@@ -0,0 +1,64 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderInvoicePDF(t *testing.T) {
+	invoice := Invoice{
+		InvoiceNumber:    "10240",
+		AuctionLot:       64,
+		BuyerName:        "Maria Rossi (Toronto)",
+		Time:             NewTimestamp(time.Date(2024, 5, 4, 6, 30, 12, 0, businessLocation)),
+		Status:           StatusPickedUp,
+		InvoiceTotal:     3051,
+		Payments:         []Payment{{Method: TenderCash, Amount: 3051}},
+		TotalHandlingFee: 200,
+		PickupTime:       NewTimestamp(time.Date(2024, 5, 5, 10, 0, 0, 0, businessLocation)),
+	}
+	// enough rows to need a second page
+	for i := 0; i < 60; i++ {
+		invoice.Items = append(invoice.Items, InvoiceItem{Sku: 120000 + i, ItemLot: i + 1, Desc: fmt.Sprintf("Item %d", i), Bid: 100, Unit: 1})
+	}
+	signature := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	signature.Set(5, 5, color.NRGBA{A: 255})
+
+	for _, kind := range []string{DocumentInvoice, DocumentReceipt, DocumentPickupSlip} {
+		rendered, err := renderInvoicePDF(invoice, kind, renderSignatures{Pickup: signature})
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		// the renderer's output has to be readable by the same pdf reader the imports use
+		text, err := extractPDFText(bytes.NewReader(rendered), int64(len(rendered)))
+		if err != nil {
+			t.Fatalf("%s: cannot read rendered pdf: %v", kind, err)
+		}
+		for _, want := range []string{"10240", "Maria Rossi (Toronto)", "Item 59", "Page 1 of ", "Pickup Signature"} {
+			if !strings.Contains(text, want) {
+				t.Errorf("%s: rendered text is missing %q", kind, want)
+			}
+		}
+		hasTotal := strings.Contains(text, "$30.51")
+		if hasTotal == (kind == DocumentPickupSlip) {
+			t.Errorf("%s: invoice total shown = %v", kind, hasTotal)
+		}
+	}
+
+	if _, err := renderInvoicePDF(invoice, "label", renderSignatures{}); err == nil {
+		t.Error("expected error for unknown document kind")
+	}
+}
+
+func TestPDFStringWinAnsi(t *testing.T) {
+	got := pdfString("“Drill” – 2 pcs… (€5) Café ★")
+	want := "\x93Drill\x94 \x96 2 pcs\x85 \\(\x805\\) Caf\xe9 ?"
+	if got != want {
+		t.Errorf("pdfString = %q, want %q", got, want)
+	}
+}
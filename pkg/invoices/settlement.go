@@ -0,0 +1,168 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// invoices of a lot by status
+type LotStatusCounts struct {
+	Unpaid   int `json:"unpaid"`
+	Paid     int `json:"paid"`
+	PickedUp int `json:"pickedUp"`
+	Shipped  int `json:"shipped"`
+	Refunded int `json:"refunded"`
+	Void     int `json:"void"`
+}
+
+// what an auction lot brought in and what is left to settle
+// amounts leave out void invoices, refunded counts partial and full refunds
+type LotSettlement struct {
+	AuctionLot       int              `json:"auctionLot"`
+	InvoiceCount     int              `json:"invoiceCount"`
+	StatusCounts     LotStatusCounts  `json:"statusCounts"`
+	InvoiceTotal     Money            `json:"invoiceTotal"`
+	Tenders          map[string]Money `json:"tenders"`
+	Collected        Money            `json:"collected"`
+	RefundTotal      Money            `json:"refundTotal"`
+	Outstanding      Money            `json:"outstanding"`
+	TotalHandlingFee Money            `json:"totalHandlingFee"`
+	BuyersPremium    Money            `json:"buyersPremium"`
+	Tax              Money            `json:"tax"`
+	// sold items of the lot's remaining record, false when the lot has none
+	RemainingRecord bool `json:"remainingRecord"`
+	SoldItemCount   int  `json:"soldItemCount"`
+	// sold items no live invoice carries: never invoiced, on a void invoice or refunded in full
+	UnsoldItems []SoldItem `json:"unsoldItems"`
+	// invoiced item lots missing from the remaining record
+	UnrecordedItems []InvoiceItem `json:"unrecordedItems"`
+}
+
+// settle a lot from its invoices and the sold items of its remaining record
+func settleLot(auctionLot int, invoices []Invoice, soldItems []SoldItem, recorded bool) LotSettlement {
+	settlement := LotSettlement{
+		AuctionLot:      auctionLot,
+		InvoiceCount:    len(invoices),
+		Tenders:         map[string]Money{},
+		RemainingRecord: recorded,
+		SoldItemCount:   len(soldItems),
+		UnsoldItems:     []SoldItem{},
+		UnrecordedItems: []InvoiceItem{},
+	}
+
+	// item lots with units left on a live invoice
+	invoiced := map[int]bool{}
+	for _, invoice := range invoices {
+		switch invoice.Status {
+		case StatusUnpaid:
+			settlement.StatusCounts.Unpaid++
+		case StatusPaid:
+			settlement.StatusCounts.Paid++
+		case StatusPickedUp:
+			settlement.StatusCounts.PickedUp++
+		case StatusShipped:
+			settlement.StatusCounts.Shipped++
+		case StatusPartiallyRefunded, StatusRefunded:
+			settlement.StatusCounts.Refunded++
+		case StatusVoid:
+			settlement.StatusCounts.Void++
+			continue
+		}
+
+		settlement.InvoiceTotal += invoice.InvoiceTotal
+		for method, amount := range invoiceTenders(invoice) {
+			settlement.Tenders[method] += amount
+			settlement.Collected += amount
+		}
+		settlement.RefundTotal += invoice.RefundTotal
+		settlement.Outstanding += invoice.RemainingBalance
+		settlement.TotalHandlingFee += invoice.TotalHandlingFee
+		settlement.BuyersPremium += invoice.BuyersPremium
+		settlement.Tax += invoice.Tax
+		for _, item := range invoice.Items {
+			if itemUnits(item)-refundedUnits(invoice, item.ItemLot) > 0 {
+				invoiced[item.ItemLot] = true
+			}
+		}
+	}
+
+	sold := map[int]bool{}
+	for _, item := range soldItems {
+		sold[item.Lot] = true
+		if !invoiced[item.Lot] {
+			settlement.UnsoldItems = append(settlement.UnsoldItems, item)
+		}
+	}
+	if recorded {
+		for _, invoice := range invoices {
+			if invoice.Status == StatusVoid {
+				continue
+			}
+			for _, item := range invoice.Items {
+				if !sold[item.ItemLot] {
+					settlement.UnrecordedItems = append(settlement.UnrecordedItems, item)
+				}
+			}
+		}
+	}
+	sort.Slice(settlement.UnsoldItems, func(i, j int) bool {
+		return settlement.UnsoldItems[i].Lot < settlement.UnsoldItems[j].Lot
+	})
+	return settlement
+}
+
+// settlement report of one auction lot
+func GetLotSettlement(collection *mongo.Collection, remainingCollection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		auctionLot, err := strconv.Atoi(c.Param("auctionLot"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid Auction Lot")
+			return
+		}
+
+		cursor, err := collection.Find(ctx, bson.M{"auctionLot": auctionLot}, options.Find().SetProjection(bson.M{"_id": 0}))
+		if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Invoices")
+			return
+		}
+		lotInvoices := []Invoice{}
+		if err := cursor.All(ctx, &lotInvoices); err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Invoices")
+			return
+		}
+
+		// same record FillItemDataFromDB reads bids from
+		var remaining struct{ SoldItems []SoldItem }
+		recorded := true
+		err = remainingCollection.FindOne(
+			ctx,
+			bson.M{"lot": auctionLot},
+			options.FindOne().SetProjection(bson.M{"soldItems": 1}),
+		).Decode(&remaining)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			recorded = false
+		} else if err != nil {
+			fmt.Println(err.Error())
+			c.String(http.StatusInternalServerError, "Cannot Get Remaining Record")
+			return
+		}
+
+		if len(lotInvoices) == 0 && !recorded {
+			c.String(http.StatusNotFound, "Auction Lot Not Found")
+			return
+		}
+		c.JSON(http.StatusOK, settleLot(auctionLot, lotInvoices, remaining.SoldItems, recorded))
+	}
+}
@@ -0,0 +1,50 @@
+package invoices
+
+import "testing"
+
+func TestSettleLot(t *testing.T) {
+	lotInvoices := []Invoice{
+		{
+			Status: StatusPickedUp, InvoiceTotal: 5650, TotalHandlingFee: 300, Tax: 650,
+			Payments: []Payment{{Method: TenderCash, Amount: 2000}, {Method: TenderCard, Amount: 3650}},
+			Items:    []InvoiceItem{{ItemLot: 1, Unit: 1}, {ItemLot: 2, Unit: 1}},
+		},
+		{
+			Status: StatusUnpaid, InvoiceTotal: 1130, RemainingBalance: 1130,
+			Items: []InvoiceItem{{ItemLot: 3, Unit: 1}, {ItemLot: 9, Unit: 1}},
+		},
+		{
+			Status: StatusRefunded, InvoiceTotal: 2260, RefundTotal: 2260, PaymentMethod: TenderEtransfer,
+			Items:   []InvoiceItem{{Sku: 4, ItemLot: 4, Unit: 2}},
+			Refunds: []RefundRecord{{Sku: 4, ItemLot: 4, Quantity: 2}},
+		},
+		{Status: StatusVoid, InvoiceTotal: 999, Items: []InvoiceItem{{ItemLot: 5, Unit: 1}}},
+	}
+	soldItems := []SoldItem{{Lot: 5}, {Lot: 4}, {Lot: 3}, {Lot: 2}, {Lot: 1}, {Lot: 6}}
+
+	got := settleLot(64, lotInvoices, soldItems, true)
+	if got.InvoiceCount != 4 || got.StatusCounts != (LotStatusCounts{Unpaid: 1, PickedUp: 1, Refunded: 1, Void: 1}) {
+		t.Errorf("counts = %d %+v", got.InvoiceCount, got.StatusCounts)
+	}
+	if got.InvoiceTotal != 9040 || got.Collected != 7910 || got.RefundTotal != 2260 || got.Outstanding != 1130 {
+		t.Errorf("totals = %+v", got)
+	}
+	if got.Tenders[TenderCash] != 2000 || got.Tenders[TenderCard] != 3650 || got.Tenders[TenderEtransfer] != 2260 {
+		t.Errorf("tenders = %v", got.Tenders)
+	}
+	if got.TotalHandlingFee != 300 || got.Tax != 650 {
+		t.Errorf("fees = %d tax = %d", got.TotalHandlingFee, got.Tax)
+	}
+
+	// refunded lot 4, void lot 5 and never invoiced lot 6 are unsold
+	var unsold []int
+	for _, item := range got.UnsoldItems {
+		unsold = append(unsold, item.Lot)
+	}
+	if len(unsold) != 3 || unsold[0] != 4 || unsold[1] != 5 || unsold[2] != 6 {
+		t.Errorf("unsold = %v", unsold)
+	}
+	if len(got.UnrecordedItems) != 1 || got.UnrecordedItems[0].ItemLot != 9 {
+		t.Errorf("unrecorded = %+v", got.UnrecordedItems)
+	}
+}
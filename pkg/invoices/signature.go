@@ -1,128 +1,482 @@
 package invoices
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sync"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// id is set by the sender, the reply to a message with an id carries it as replyTo
+// seq is set by the server on every message it sends, a reconnecting client passes the last one it got
 type Message struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
-}
-
-type Client struct {
-	conn *websocket.Conn
-	send chan []byte
+	Seq     uint64      `json:"seq,omitempty"`
+	ID      string      `json:"id,omitempty"`
+	ReplyTo string      `json:"replyTo,omitempty"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
 }
 
 // types of message emitted by client
 const (
 	InitSignature   string = "initSignature"
 	SubmitSignature string = "submitSignature"
+	ConfirmSession  string = "confirmSignature"
+	CancelSession   string = "cancelSignature"
+	JoinRoom        string = "joinRoom"
+	LeaveRoom       string = "leaveRoom"
 )
 
+// message types both sides send, an ack answers a message that was handled
+const AckMessage string = "ack"
+
+// message type of the reply to a message that could not be handled
+const WsError string = "error"
+
+// first message on every connection, carries the resume token
+const WsConnected string = "connected"
+
+// message type of a signature session change, sent to the counter and the invoice rooms
+const SignatureStatus string = "signatureStatus"
+
+// largest signature png a pad may submit
+const maxSignatureSize = 2 * 1024 * 1024
+
+// largest message read from a client, a submitted signature is the png in base64 plus the envelope
+var wsReadLimit = int64(base64.StdEncoding.EncodedLen(maxSignatureSize)) + 64*1024
+
 // server object
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin: checkWsOrigin,
 }
 
-// connected clients array
-var clients = make(map[string]*Client)
-var clientsMutex sync.RWMutex
+// open signature sessions behind /ws
+var wsSessions = newSignatureSessions(defaultSignatureTimeouts, notifySignatureStatus)
+
+// what a signature message is about, a pad joins its counter and staff the invoice
+type signatureRoute struct {
+	Counter       string `json:"counter"`
+	InvoiceNumber string `json:"invoiceNumber"`
+	SessionID     string `json:"sessionId"`
+	AuctionLot    string `json:"auctionLot"`
+	// pickup or return
+	Action string `json:"action"`
+	// base64 png of a submitted signature
+	Image  string `json:"image"`
+	Reason string `json:"reason"`
+}
 
 // gorilla websocket
-func WsHandler(c *gin.Context) {
-	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		fmt.Println("upgrade:", err)
-		return
-	}
-	defer ws.Close()
+// the firebase id token comes as an Authorization header or an auth message sent first, never in the query the access log records
+// a signature pad connects with ?counter=, staff may pass ?invoiceNumber= to follow one invoice
+// signatures submitted over the socket are stored through signatures
+func WsHandler(verifier TokenVerifier, signatures SignatureStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		// a token before the upgrade is checked before anything is opened
+		var identity wsIdentity
+		token := c.GetHeader("Authorization")
+		if token != "" {
+			var err error
+			identity, err = verifyWsToken(ctx, verifier, token)
+			if err != nil {
+				c.String(http.StatusUnauthorized, "Invalid Token")
+				return
+			}
+		}
 
-	// create a new client and append it into the array
-	newClient := &Client{
-		conn: ws,
-		send: make(chan []byte),
-	}
-	clientID := uuid.NewString()
-	clientsMutex.Lock()
-	clients[clientID] = newClient
-	clientsMutex.Unlock()
+		ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			fmt.Println("upgrade:", err)
+			return
+		}
+		// a larger message closes the connection before it is buffered
+		ws.SetReadLimit(wsReadLimit)
+		if token == "" {
+			identity, err = readAuthMessage(ctx, verifier, ws)
+			if err != nil {
+				closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+				ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(wsWriteWait))
+				ws.Close()
+				return
+			}
+		}
 
-	// fmt.Println(clients)
+		// a client coming back within the resume window gets its rooms and the messages after lastSeq
+		lastSeq, _ := strconv.ParseUint(c.Query("lastSeq"), 10, 64)
+		client, send, replay, resumed := wsHub.Resume(c.Query("resume"), lastSeq, identity, ws)
+		if !resumed {
+			client = newClient(ws, identity)
+			send = wsHub.Register(client)
+		}
+		// the writer owns all writes to the connection
+		go wsHub.writePump(ws, send, replay)
+		defer wsHub.Detach(client, ws)
+		wsHub.keepAlive(ws)
+		wsHub.Send(client, Message{Type: WsConnected, Data: gin.H{"resumeToken": client.resumeToken, "resumed": resumed}})
 
-	// the read message loop
+		if !resumed {
+			if client.identity.Role == RoleStaff {
+				wsHub.Join(client, staffRoom)
+			}
+			OnJoinRoom(client, Message{}, signatureRoute{Counter: c.Query("counter"), InvoiceNumber: c.Query("invoiceNumber")}, true)
+		}
+		readMessages(client, ws, signatures)
+	}
+}
+
+// the read message loop, until the connection closes
+func readMessages(client *Client, ws *websocket.Conn, signatures SignatureStore) {
+	pongWait := wsHub.Config().PongWait
 	for {
-		// read bytes from client
+		// read bytes from client, any message counts as alive
 		_, msg, err := ws.ReadMessage()
 		if err != nil {
 			fmt.Println("Read Msg Error:", err)
 			break
 		}
-		fmt.Printf("Got Msg: %s\n", msg)
+		ws.SetReadDeadline(time.Now().Add(pongWait))
 
-		// unpack json into msg type
-		var inMsg Message
-		jsonErr := json.Unmarshal(msg, &inMsg)
+		// unpack json into msg type, the route is read from the same data when it is an object
+		inMsg, jsonErr := unmarshalMessage(msg)
+		route := routeOf(msg)
 		if jsonErr != nil {
 			fmt.Println("Cannot Unmarshal JSON")
+			replyError(client.id, inMsg, "invalid message")
+			continue
 		}
 
 		// switch on message type
 		switch inMsg.Type {
+		case JoinRoom:
+			OnJoinRoom(client, inMsg, route, false)
+		case LeaveRoom:
+			OnLeaveRoom(client, inMsg, route)
 		case InitSignature:
-			OnInitSignature(newClient, inMsg)
-		case SubmitSignature:
-			OnSubmitSignature(ws, inMsg)
+			OnInitSignature(client, inMsg, route, signatures)
+		case AckMessage, SubmitSignature, ConfirmSession, CancelSession:
+			runSessionCommand(callerOf(client), inMsg, route, signatures, false)
+		default:
+			replyError(client.id, inMsg, "unknown message type "+inMsg.Type)
 		}
 	}
-	clientsMutex.Lock()
-	clients[clientID].conn.Close()
-	delete(clients, clientID)
-	clientsMutex.Unlock()
 }
 
-// broadcast to all connected clients
-func bcast(msg []byte) {
-	for clientId, client := range clients {
-		if clientId != "" {
-			err := client.conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				fmt.Println("error broadcasting:", err)
-			}
-		}
-		// client.conn.Close()
-	}
+func unmarshalMessage(data []byte) (Message, error) {
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// the route in a message's data, empty when the data is not an object
+func routeOf(data []byte) signatureRoute {
+	var route signatureRoute
+	json.Unmarshal(data, &struct {
+		Data *signatureRoute `json:"data"`
+	}{&route})
+	return route
 }
 
-// data should contain invoice number, date, buyer name
-func OnInitSignature(client *Client, msg Message) {
-	// parse json
+func marshalMessage(msg Message) ([]byte, bool) {
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
 		fmt.Println("error marshaling msg: ", err.Error())
+		return nil, false
+	}
+	return msgBytes, true
+}
+
+// tell the sender what went wrong with its message
+func replyError(clientID string, msg Message, reason string) {
+	wsHub.SendTo(clientID, Message{ReplyTo: msg.ID, Type: WsError, Data: reason})
+}
+
+// tell the sender its message was handled, only messages with an id are acked
+func replyAck(clientID string, msg Message, data interface{}) {
+	if msg.ID == "" {
 		return
 	}
-	fmt.Println("INIT SIG")
-	// broadcast
-	bcast(msgBytes)
+	wsHub.SendTo(clientID, Message{ReplyTo: msg.ID, Type: AckMessage, Data: data})
 }
 
-// submit the signature record
-func OnSubmitSignature(ws *websocket.Conn, msg Message) {
-	fmt.Println("SUBMIT SIG")
-	msgBytes, err := json.Marshal(msg)
+// join the counter and/or invoice room named in data, rooms the client may not hear are refused
+func OnJoinRoom(client *Client, msg Message, route signatureRoute, optional bool) {
+	if route.Counter == "" && route.InvoiceNumber == "" {
+		if !optional {
+			replyError(client.id, msg, "counter or invoiceNumber required")
+		}
+		return
+	}
+	rooms := []string{}
+	if route.Counter != "" {
+		rooms = append(rooms, counterRoom(route.Counter))
+	}
+	if route.InvoiceNumber != "" {
+		rooms = append(rooms, invoiceRoom(route.InvoiceNumber))
+	}
+	for _, room := range rooms {
+		if !canJoin(client.identity, room) {
+			replyError(client.id, msg, ErrWsForbidden.Error()+": "+room)
+			return
+		}
+		wsHub.Join(client, room)
+	}
+	replyAck(client.id, msg, nil)
+}
+
+func OnLeaveRoom(client *Client, msg Message, route signatureRoute) {
+	if route.Counter != "" {
+		wsHub.Leave(client, counterRoom(route.Counter))
+	}
+	if route.InvoiceNumber != "" {
+		wsHub.Leave(client, invoiceRoom(route.InvoiceNumber))
+	}
+	replyAck(client.id, msg, nil)
+}
+
+// data should contain counter, invoice number, auction lot, action, date, buyer name
+// opens a session and sends the request to the pad at the counter, the sender joins the invoice room to follow it
+// an invoice that is missing or cannot be picked up or returned gets no session
+func OnInitSignature(client *Client, msg Message, route signatureRoute, signatures SignatureStore) {
+	if client.identity.Role != RoleStaff {
+		replyError(client.id, msg, "only staff can start a signature")
+		return
+	}
+	if route.Counter == "" || route.InvoiceNumber == "" || route.AuctionLot == "" {
+		replyError(client.id, msg, "counter, invoiceNumber and auctionLot required")
+		return
+	}
+	if route.Action == "" {
+		route.Action = "pickup"
+	}
+	if route.Action != "pickup" && route.Action != "return" {
+		replyError(client.id, msg, "action must be pickup or return")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), signatureStoreWait)
+	defer cancel()
+	err := signatures.CheckSignature(ctx, SignatureUpload{
+		FileName:   route.InvoiceNumber + "_" + route.Action,
+		AuctionLot: route.AuctionLot,
+		Actor:      client.identity.UID,
+	})
 	if err != nil {
-		fmt.Println("error marshaling msg: ", err.Error())
+		replyError(client.id, msg, err.Error())
+		return
+	}
+	wsHub.Join(client, invoiceRoom(route.InvoiceNumber))
+	// the pad may be on another instance, then only the request timeout tells it is not there
+	distributed := wsHub.Distributed()
+	if !distributed && wsHub.RoomSize(counterRoom(route.Counter)) == 0 {
+		replyError(client.id, msg, "no signature pad at counter "+route.Counter)
+		return
+	}
+	session, err := wsSessions.Open(SignatureSession{
+		InvoiceNumber: route.InvoiceNumber,
+		AuctionLot:    route.AuctionLot,
+		Counter:       route.Counter,
+		Action:        route.Action,
+		StartedBy:     client.identity.UID,
+	})
+	if err != nil {
+		replyError(client.id, msg, err.Error())
+		return
 	}
-	// broadcast
-	bcast(msgBytes)
+
+	// the pad gets what staff sent plus the session, and acks the request once it shows it
+	data := map[string]interface{}{}
+	if sent, ok := msg.Data.(map[string]interface{}); ok {
+		for key, val := range sent {
+			data[key] = val
+		}
+	}
+	data["sessionId"] = session.ID
+	data["action"] = session.Action
+	delivered := wsHub.Broadcast(counterRoom(route.Counter), Message{ID: session.requestID, Type: InitSignature, Data: data}, client)
+	if delivered == 0 && !distributed {
+		wsSessions.Transition(session.ID, SignatureCancelled, nil, func(cancelled *SignatureSession) {
+			cancelled.Reason = "no signature pad at counter " + route.Counter
+		})
+		replyError(client.id, msg, "no signature pad at counter "+route.Counter)
+		return
+	}
+	replyAck(client.id, msg, session)
+}
+
+// who sent a message, enough to authorize and answer it on any instance
+type wsCaller struct {
+	ClientID string     `json:"clientId" bson:"clientId"`
+	Identity wsIdentity `json:"identity" bson:"identity"`
+	// counters whose room the caller is in on its instance
+	Counters []string `json:"counters" bson:"counters"`
+}
+
+func callerOf(client *Client) wsCaller {
+	return wsCaller{ClientID: client.id, Identity: client.identity, Counters: wsHub.Counters(client)}
+}
+
+// a session lives on the instance that opened it, a command for a session unknown here is forwarded
+// the other instances stay silent about sessions they do not own either
+func runSessionCommand(caller wsCaller, msg Message, route signatureRoute, signatures SignatureStore, forwarded bool) {
+	var sessionID string
+	if msg.Type == AckMessage {
+		if session, ok := wsSessions.ByRequest(msg.ReplyTo); ok {
+			sessionID = session.ID
+		}
+	} else if route.SessionID != "" {
+		if _, ok := wsSessions.Get(route.SessionID); ok {
+			sessionID = route.SessionID
+		}
+	} else {
+		sessionID = wsSessions.ForInvoice(route.InvoiceNumber, route.AuctionLot)
+	}
+	if sessionID == "" {
+		if forwarded || wsHub.Forward(caller, msg) {
+			return
+		}
+		// acks of anything but a signature request need no answer
+		if msg.Type != AckMessage {
+			replyError(caller.ClientID, msg, ErrSessionNotFound.Error())
+		}
+		return
+	}
+
+	switch msg.Type {
+	case AckMessage:
+		OnAck(caller, msg, sessionID)
+	case SubmitSignature:
+		OnSubmitSignature(caller, msg, sessionID, route, signatures)
+	case ConfirmSession:
+		OnConfirmSession(caller, msg, sessionID)
+	case CancelSession:
+		OnCancelSession(caller, msg, sessionID, route)
+	}
+}
+
+// a pad acks the initSignature request once the signature screen shows
+func OnAck(caller wsCaller, msg Message, sessionID string) {
+	_, err := wsSessions.Transition(sessionID, SignatureDisplayed, padAtCounter(caller), nil)
+	if err != nil {
+		replyError(caller.ClientID, msg, err.Error())
+	}
+}
+
+// the pad sends the signature image, it is stored like /uploadSignature stores it
+// a failed store puts the session back on the signature screen so the pad can submit again
+func OnSubmitSignature(caller wsCaller, msg Message, sessionID string, route signatureRoute, signatures SignatureStore) {
+	imageData, err := base64.StdEncoding.DecodeString(route.Image)
+	if err != nil || len(imageData) == 0 {
+		replyError(caller.ClientID, msg, "image must be a base64 png")
+		return
+	}
+	session, err := wsSessions.Transition(sessionID, SignatureSigned, padAtCounter(caller), nil)
+	if err != nil {
+		replyError(caller.ClientID, msg, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), signatureStoreWait)
+	defer cancel()
+	cdnURL, err := signatures.StoreSignature(ctx, SignatureUpload{
+		FileName:   session.InvoiceNumber + "_" + session.Action,
+		AuctionLot: session.AuctionLot,
+		Image:      imageData,
+		Actor:      session.StartedBy,
+	})
+	if err != nil {
+		fmt.Println("store signature:", err)
+		wsSessions.Transition(session.ID, SignatureDisplayed, nil, func(failed *SignatureSession) {
+			failed.Reason = err.Error()
+		})
+		replyError(caller.ClientID, msg, err.Error())
+		return
+	}
+	session, err = wsSessions.Transition(session.ID, SignatureStored, nil, func(stored *SignatureSession) {
+		stored.CdnURL = cdnURL
+		stored.Reason = ""
+	})
+	if err != nil {
+		replyError(caller.ClientID, msg, err.Error())
+		return
+	}
+	replyAck(caller.ClientID, msg, session)
+}
+
+// staff confirm a stored signature, which closes the session
+func OnConfirmSession(caller wsCaller, msg Message, sessionID string) {
+	session, err := wsSessions.Transition(sessionID, SignatureConfirmed, staffOnly(caller), nil)
+	if err != nil {
+		replyError(caller.ClientID, msg, err.Error())
+		return
+	}
+	replyAck(caller.ClientID, msg, session)
+}
+
+// staff or the session's pad give up on a signature, only until it is stored
+func OnCancelSession(caller wsCaller, msg Message, sessionID string, route signatureRoute) {
+	check := staffOnly(caller)
+	if caller.Identity.Role == RolePad {
+		check = padAtCounter(caller)
+	}
+	session, err := wsSessions.Transition(sessionID, SignatureCancelled, check, func(cancelled *SignatureSession) {
+		cancelled.Reason = route.Reason
+		if cancelled.Reason == "" {
+			cancelled.Reason = "cancelled by " + caller.Identity.Role
+		}
+	})
+	if err != nil {
+		replyError(caller.ClientID, msg, err.Error())
+		return
+	}
+	replyAck(caller.ClientID, msg, session)
+}
+
+// only a pad in the room of the session's counter may drive it
+func padAtCounter(caller wsCaller) func(session SignatureSession) error {
+	return func(session SignatureSession) error {
+		if caller.Identity.Role != RolePad || !slices.Contains(caller.Counters, session.Counter) {
+			return fmt.Errorf("%w: %s", ErrWsForbidden, counterRoom(session.Counter))
+		}
+		return nil
+	}
+}
+
+func staffOnly(caller wsCaller) func(session SignatureSession) error {
+	return func(session SignatureSession) error {
+		if caller.Identity.Role != RoleStaff {
+			return fmt.Errorf("%w: %s", ErrWsForbidden, invoiceRoom(session.InvoiceNumber))
+		}
+		return nil
+	}
+}
+
+// share the /ws hub with the other instances of the server through broker
+// session messages forwarded by them are run here when the session is here, until ctx ends
+func UseWsBroker(ctx context.Context, broker Broker, signatures SignatureStore) {
+	wsHub.UseBroker(ctx, broker, func(forwarded BrokerMessage) {
+		msg, err := unmarshalMessage(forwarded.Payload)
+		if err != nil {
+			return
+		}
+		runSessionCommand(*forwarded.Caller, msg, routeOf(forwarded.Payload), signatures, true)
+	})
+}
+
+// tell the pad and the staff following the invoice where the session is
+func notifySignatureStatus(session SignatureSession) {
+	msg := Message{Type: SignatureStatus, Data: session}
+	wsHub.Broadcast(counterRoom(session.Counter), msg, nil)
+	wsHub.Broadcast(invoiceRoom(session.InvoiceNumber), msg, nil)
+}
+
+// marshal and broadcast a server side event to every staff client
+func broadcastMessage(msg Message) {
+	wsHub.Broadcast(staffRoom, msg, nil)
 }
@@ -0,0 +1,236 @@
+package invoices
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// state of a signature session, driven by the server
+type SignatureState string
+
+const (
+	// staff asked the pad at a counter for a signature
+	SignatureRequested SignatureState = "requested"
+	// the pad acknowledged the request and shows the signature screen
+	SignatureDisplayed SignatureState = "displayed"
+	// the pad sent the image, it is being stored
+	SignatureSigned SignatureState = "signed"
+	// the image is stored and linked on the invoice, the invoice status already changed
+	// so the session can only be confirmed, by staff or by its timeout
+	SignatureStored    SignatureState = "stored"
+	SignatureConfirmed SignatureState = "confirmed"
+	SignatureCancelled SignatureState = "cancelled"
+	SignatureExpired   SignatureState = "expired"
+)
+
+// allowed next states for every state, a failed store goes back to displayed
+var signatureTransitions = map[SignatureState][]SignatureState{
+	SignatureRequested: {SignatureDisplayed, SignatureCancelled, SignatureExpired},
+	SignatureDisplayed: {SignatureSigned, SignatureCancelled, SignatureExpired},
+	SignatureSigned:    {SignatureStored, SignatureDisplayed},
+	SignatureStored:    {SignatureConfirmed},
+	SignatureConfirmed: {},
+	SignatureCancelled: {},
+	SignatureExpired:   {},
+}
+
+// time a session may stay in a state before it times out, states not listed never time out
+// signed is bounded by signatureStoreWait instead, a stored session is confirmed rather than expired
+var defaultSignatureTimeouts = map[SignatureState]time.Duration{
+	SignatureRequested: 15 * time.Second,
+	SignatureDisplayed: 5 * time.Minute,
+	SignatureStored:    15 * time.Minute,
+}
+
+// time allowed to store a submitted signature
+const signatureStoreWait = 30 * time.Second
+
+var (
+	ErrSessionNotFound            = errors.New("signature session not found")
+	ErrSessionOpen                = errors.New("signature session already open for invoice and lot")
+	ErrInvalidSignatureTransition = errors.New("invalid signature session transition")
+)
+
+// one signature of one invoice at one counter
+type SignatureSession struct {
+	ID            string `json:"sessionId"`
+	InvoiceNumber string `json:"invoiceNumber"`
+	AuctionLot    string `json:"auctionLot"`
+	Counter       string `json:"counter"`
+	// pickup or return
+	Action    string         `json:"action"`
+	State     SignatureState `json:"state"`
+	CdnURL    string         `json:"cdnUrl,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	StartedBy string         `json:"startedBy"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	// id of the initSignature message the pad acks
+	requestID string
+	timer     *time.Timer
+}
+
+func (s *SignatureSession) final() bool {
+	return len(signatureTransitions[s.State]) == 0
+}
+
+func canSignatureTransition(from SignatureState, to SignatureState) bool {
+	for _, allowed := range signatureTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// state a session moves to when it stays too long in state
+func timeoutState(state SignatureState) SignatureState {
+	if state == SignatureStored {
+		return SignatureConfirmed
+	}
+	return SignatureExpired
+}
+
+// invoice numbers repeat across auction lots, a session belongs to both
+func sessionKey(invoiceNumber string, auctionLot string) string {
+	return invoiceNumber + "/" + auctionLot
+}
+
+// open signature sessions, a session is forgotten once it reaches a final state
+// notify is called with a copy of the session after every change, outside the lock
+type signatureSessions struct {
+	mu   sync.Mutex
+	byID map[string]*SignatureSession
+	// keyed by sessionKey
+	byInvoice map[string]*SignatureSession
+	timeouts  map[SignatureState]time.Duration
+	notify    func(session SignatureSession)
+}
+
+func newSignatureSessions(timeouts map[SignatureState]time.Duration, notify func(session SignatureSession)) *signatureSessions {
+	return &signatureSessions{
+		byID:      map[string]*SignatureSession{},
+		byInvoice: map[string]*SignatureSession{},
+		timeouts:  timeouts,
+		notify:    notify,
+	}
+}
+
+// open a requested session, one per invoice and lot at a time
+func (s *signatureSessions) Open(session SignatureSession) (SignatureSession, error) {
+	s.mu.Lock()
+	key := sessionKey(session.InvoiceNumber, session.AuctionLot)
+	if _, open := s.byInvoice[key]; open {
+		s.mu.Unlock()
+		return SignatureSession{}, fmt.Errorf("%w %s lot %s", ErrSessionOpen, session.InvoiceNumber, session.AuctionLot)
+	}
+	session.ID = uuid.NewString()
+	session.requestID = uuid.NewString()
+	session.State = SignatureRequested
+	session.UpdatedAt = time.Now()
+	stored := &session
+	s.byID[session.ID] = stored
+	s.byInvoice[key] = stored
+	s.arm(stored)
+	opened := *stored
+	s.mu.Unlock()
+	s.notify(opened)
+	return opened, nil
+}
+
+func (s *signatureSessions) Get(id string) (SignatureSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byID[id]
+	if !ok {
+		return SignatureSession{}, false
+	}
+	return *session, true
+}
+
+// id of the open session of an invoice and lot, empty when there is none
+func (s *signatureSessions) ForInvoice(invoiceNumber string, auctionLot string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.byInvoice[sessionKey(invoiceNumber, auctionLot)]; ok {
+		return session.ID
+	}
+	return ""
+}
+
+// the session whose initSignature message has this id
+func (s *signatureSessions) ByRequest(requestID string) (SignatureSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.byID {
+		if session.requestID == requestID {
+			return *session, true
+		}
+	}
+	return SignatureSession{}, false
+}
+
+// move a session to the next state, check may refuse the move by returning an error
+func (s *signatureSessions) Transition(id string, to SignatureState, check func(session SignatureSession) error, update func(session *SignatureSession)) (SignatureSession, error) {
+	s.mu.Lock()
+	session, ok := s.byID[id]
+	if !ok {
+		s.mu.Unlock()
+		return SignatureSession{}, ErrSessionNotFound
+	}
+	if check != nil {
+		if err := check(*session); err != nil {
+			s.mu.Unlock()
+			return SignatureSession{}, err
+		}
+	}
+	if !canSignatureTransition(session.State, to) {
+		s.mu.Unlock()
+		return SignatureSession{}, fmt.Errorf("%w: %s to %s", ErrInvalidSignatureTransition, session.State, to)
+	}
+	session.State = to
+	session.UpdatedAt = time.Now()
+	if update != nil {
+		update(session)
+	}
+	s.arm(session)
+	changed := *session
+	s.mu.Unlock()
+	s.notify(changed)
+	return changed, nil
+}
+
+// restart the state timer, or forget the session once it is final
+// caller holds the lock
+func (s *signatureSessions) arm(session *SignatureSession) {
+	if session.timer != nil {
+		session.timer.Stop()
+		session.timer = nil
+	}
+	if session.final() {
+		delete(s.byID, session.ID)
+		delete(s.byInvoice, sessionKey(session.InvoiceNumber, session.AuctionLot))
+		return
+	}
+	wait, ok := s.timeouts[session.State]
+	if !ok {
+		return
+	}
+	state := session.State
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		s.Transition(session.ID, timeoutState(state), func(current SignatureSession) error {
+			// the session moved on, or was re-armed, while the timer fired
+			if current.timer != timer {
+				return ErrInvalidSignatureTransition
+			}
+			return nil
+		}, func(timedOut *SignatureSession) {
+			timedOut.Reason = fmt.Sprintf("no answer while %s", state)
+		})
+	})
+	session.timer = timer
+}
@@ -0,0 +1,93 @@
+package invoices
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignatureSessionExpiry(t *testing.T) {
+	changes := make(chan SignatureSession, 10)
+	sessions := newSignatureSessions(map[SignatureState]time.Duration{
+		SignatureRequested: 20 * time.Millisecond,
+		SignatureDisplayed: time.Hour,
+	}, func(session SignatureSession) { changes <- session })
+
+	expiring, err := sessions.Open(SignatureSession{InvoiceNumber: "1001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.Open(SignatureSession{InvoiceNumber: "1001"}); !errors.Is(err, ErrSessionOpen) {
+		t.Errorf("second open: %v", err)
+	}
+	shown, _ := sessions.Open(SignatureSession{InvoiceNumber: "1002"})
+	if _, err := sessions.Transition(shown.ID, SignatureDisplayed, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.Transition(shown.ID, SignatureConfirmed, nil, nil); !errors.Is(err, ErrInvalidSignatureTransition) {
+		t.Errorf("displayed to confirmed: %v", err)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case changed := <-changes:
+			if changed.State != SignatureExpired {
+				continue
+			}
+			if changed.ID != expiring.ID {
+				t.Fatalf("expired %+v", changed)
+			}
+			if sessions.ForInvoice("1001", "") != "" || sessions.ForInvoice("1002", "") != shown.ID {
+				t.Error("expired session still open, or displayed one gone")
+			}
+			if _, err := sessions.Transition(expiring.ID, SignatureDisplayed, nil, nil); !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("ack after expiry: %v", err)
+			}
+			return
+		case <-deadline:
+			t.Fatal("session never expired")
+		}
+	}
+}
+
+func TestSignatureSessionStoredOnlyConfirms(t *testing.T) {
+	changes := make(chan SignatureSession, 10)
+	sessions := newSignatureSessions(map[SignatureState]time.Duration{
+		SignatureStored: 20 * time.Millisecond,
+	}, func(session SignatureSession) { changes <- session })
+
+	// the same invoice number on another lot is another session
+	stored, _ := sessions.Open(SignatureSession{InvoiceNumber: "1001", AuctionLot: "12"})
+	if _, err := sessions.Open(SignatureSession{InvoiceNumber: "1001", AuctionLot: "13"}); err != nil {
+		t.Errorf("open on another lot: %v", err)
+	}
+	for _, state := range []SignatureState{SignatureDisplayed, SignatureSigned, SignatureStored} {
+		if _, err := sessions.Transition(stored.ID, state, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the invoice already changed, a stored signature cannot be cancelled
+	if _, err := sessions.Transition(stored.ID, SignatureCancelled, nil, nil); !errors.Is(err, ErrInvalidSignatureTransition) {
+		t.Errorf("stored to cancelled: %v", err)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case changed := <-changes:
+			if changed.ID != stored.ID || !changed.final() {
+				continue
+			}
+			if changed.State != SignatureConfirmed {
+				t.Fatalf("stored session timed out to %s", changed.State)
+			}
+			if sessions.ForInvoice("1001", "12") != "" || sessions.ForInvoice("1001", "13") == "" {
+				t.Error("confirmed session still open, or the other lot's gone")
+			}
+			return
+		case <-deadline:
+			t.Fatal("stored session never confirmed")
+		}
+	}
+}
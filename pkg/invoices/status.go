@@ -0,0 +1,212 @@
+package invoices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// invoice lifecycle status, stored as a plain string
+type InvoiceStatus string
+
+const (
+	StatusUnpaid            InvoiceStatus = "unpaid"
+	StatusPaid              InvoiceStatus = "paid"
+	StatusPickedUp          InvoiceStatus = "pickedup"
+	StatusShipped           InvoiceStatus = "shipped"
+	StatusPartiallyRefunded InvoiceStatus = "partialrefund"
+	StatusRefunded          InvoiceStatus = "refund"
+	StatusVoid              InvoiceStatus = "void"
+)
+
+// allowed next statuses for every status
+// paid goes back to unpaid only through ledgerPipeline, when a voided payment reopens the balance
+var statusTransitions = map[InvoiceStatus][]InvoiceStatus{
+	StatusUnpaid:            {StatusPaid, StatusVoid},
+	StatusPaid:              {StatusPickedUp, StatusShipped, StatusPartiallyRefunded, StatusRefunded},
+	StatusPickedUp:          {StatusPartiallyRefunded, StatusRefunded},
+	StatusShipped:           {StatusPartiallyRefunded, StatusRefunded},
+	StatusPartiallyRefunded: {StatusPartiallyRefunded, StatusRefunded},
+	StatusRefunded:          {},
+	StatusVoid:              {},
+}
+
+var (
+	ErrUnknownStatus     = errors.New("unknown invoice status")
+	ErrInvalidTransition = errors.New("invalid invoice status transition")
+	ErrShippingOnly      = errors.New("only shipping invoices can be shipped")
+	ErrStatusChanged     = errors.New("invoice status changed concurrently")
+	ErrInvoiceNotFound   = errors.New("invoice not found")
+)
+
+// read a status from a request, empty means unpaid
+func ParseInvoiceStatus(s string) (InvoiceStatus, error) {
+	if s == "" {
+		return StatusUnpaid, nil
+	}
+	status := InvoiceStatus(s)
+	if _, known := statusTransitions[status]; !known {
+		return "", fmt.Errorf("%w: %q", ErrUnknownStatus, s)
+	}
+	return status, nil
+}
+
+// check the move from the invoice's current status to next
+func CanTransition(invoice Invoice, next InvoiceStatus) error {
+	current, err := ParseInvoiceStatus(string(invoice.Status))
+	if err != nil {
+		return err
+	}
+	if next == StatusShipped && !invoice.IsShipping {
+		return ErrShippingOnly
+	}
+	for _, allowed := range statusTransitions[current] {
+		if allowed == next {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, current, next)
+}
+
+// event recorded with every status change
+func transitionEvent(from InvoiceStatus, to InvoiceStatus, actor string, desc string) InvoiceEvent {
+	if desc == "" {
+		desc = fmt.Sprintf("Status changed from %s to %s", from, to)
+	}
+	return InvoiceEvent{
+		Title: "Invoice " + string(to),
+		Desc:  desc,
+		Time:  eventTime(),
+		Actor: actor,
+		From:  from,
+		To:    to,
+	}
+}
+
+// a requested status change with anything else to write alongside it
+type StatusChange struct {
+	To    InvoiceStatus
+	Actor string
+	Desc  string
+	// extra fields set in the same update
+	Set bson.M
+	// extra array pushes in the same update
+	Push bson.M
+	// extra numeric increments in the same update
+	Inc bson.M
+	// extra conditions the stored invoice must still meet
+	Match bson.M
+}
+
+// load the invoice matching filter, check the transition and apply it in one conditional update
+// the update only lands if the stored status is still the one that was checked
+func transitionInvoice(ctx context.Context, collection *mongo.Collection, filter bson.M, change StatusChange) (Invoice, error) {
+	var invoice Invoice
+	err := collection.FindOne(ctx, filter).Decode(&invoice)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return invoice, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return invoice, err
+	}
+	if err := CanTransition(invoice, change.To); err != nil {
+		return invoice, err
+	}
+	return applyTransition(ctx, collection, invoice, change)
+}
+
+// apply an already checked transition to a loaded invoice
+func applyTransition(ctx context.Context, collection *mongo.Collection, invoice Invoice, change StatusChange) (Invoice, error) {
+	set := bson.M{"status": change.To}
+	for key, val := range change.Set {
+		set[key] = val
+	}
+	push := bson.M{"invoiceEvent": transitionEvent(invoice.Status, change.To, change.Actor, change.Desc)}
+	for key, val := range change.Push {
+		push[key] = val
+	}
+	update := bson.M{"$set": set, "$push": push}
+	if len(change.Inc) > 0 {
+		update["$inc"] = change.Inc
+	}
+
+	filter := bson.M{
+		"invoiceNumber": invoice.InvoiceNumber,
+		"buyerName":     invoice.BuyerName,
+		"status":        invoice.Status,
+	}
+	for key, val := range change.Match {
+		filter[key] = val
+	}
+
+	var updated Invoice
+	err := collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return invoice, ErrStatusChanged
+	}
+	return updated, err
+}
+
+// http status for a transition error
+func transitionErrorCode(err error) int {
+	switch {
+	case errors.Is(err, ErrInvoiceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnknownStatus):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrShippingOnly), errors.Is(err, ErrStatusChanged):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+type StatusChangeReq struct {
+	InvoiceNumber string `json:"invoiceNumber" binding:"required"`
+	AuctionLot    int    `json:"auctionLot"`
+	Status        string `json:"status" binding:"required"`
+	Desc          string `json:"desc"`
+}
+
+// move an invoice to a new status, e.g. shipped or void
+func UpdateInvoiceStatus(collection *mongo.Collection) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req StatusChangeReq
+		bindErr := c.ShouldBindJSON(&req)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+		next, err := ParseInvoiceStatus(req.Status)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		filter := bson.M{"invoiceNumber": req.InvoiceNumber}
+		if req.AuctionLot != 0 {
+			filter["auctionLot"] = req.AuctionLot
+		}
+		updated, err := transitionInvoice(context.Background(), collection, filter, StatusChange{
+			To:    next,
+			Actor: c.GetString("uid"),
+			Desc:  req.Desc,
+		})
+		if err != nil {
+			c.String(transitionErrorCode(err), err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, updated)
+	}
+}
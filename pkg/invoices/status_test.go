@@ -0,0 +1,36 @@
+package invoices
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	cases := []struct {
+		from     InvoiceStatus
+		to       InvoiceStatus
+		shipping bool
+		want     error
+	}{
+		{"", StatusPaid, false, nil},
+		{StatusUnpaid, StatusPaid, false, nil},
+		{StatusUnpaid, StatusVoid, false, nil},
+		{StatusUnpaid, StatusPickedUp, false, ErrInvalidTransition},
+		{StatusPaid, StatusPickedUp, false, nil},
+		{StatusPaid, StatusUnpaid, false, ErrInvalidTransition},
+		{StatusPaid, StatusShipped, false, ErrShippingOnly},
+		{StatusPaid, StatusShipped, true, nil},
+		{StatusPickedUp, StatusRefunded, false, nil},
+		{StatusPartiallyRefunded, StatusPartiallyRefunded, false, nil},
+		{StatusRefunded, StatusPaid, false, ErrInvalidTransition},
+		{StatusVoid, StatusPaid, false, ErrInvalidTransition},
+		{"lost", StatusPaid, false, ErrUnknownStatus},
+	}
+	for _, tc := range cases {
+		invoice := Invoice{Status: tc.from, IsShipping: tc.shipping}
+		err := CanTransition(invoice, tc.to)
+		if !errors.Is(err, tc.want) || (tc.want == nil && err != nil) {
+			t.Errorf("%q -> %q (shipping %v): got %v, want %v", tc.from, tc.to, tc.shipping, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package invoices
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// province goods are picked up in
+const storeProvince string = "ON"
+
+// one tax of a province, rate in percent
+type TaxComponent struct {
+	Name string
+	Rate float64
+}
+
+// sales taxes per province and territory
+var provinceTaxes = map[string][]TaxComponent{
+	"AB": {{"GST", 5}},
+	"BC": {{"GST", 5}, {"PST", 7}},
+	"MB": {{"GST", 5}, {"RST", 7}},
+	"NB": {{"HST", 15}},
+	"NL": {{"HST", 15}},
+	"NS": {{"HST", 14}},
+	"NT": {{"GST", 5}},
+	"NU": {{"GST", 5}},
+	"ON": {{"HST", 13}},
+	"PE": {{"HST", 15}},
+	"QC": {{"GST", 5}, {"QST", 9.975}},
+	"SK": {{"GST", 5}, {"PST", 6}},
+	"YT": {{"GST", 5}},
+}
+
+// first letter of a postal code
+var postalProvinces = map[byte]string{
+	'A': "NL", 'B': "NS", 'C': "PE", 'E': "NB", 'G': "QC", 'H': "QC", 'J': "QC",
+	'K': "ON", 'L': "ON", 'M': "ON", 'N': "ON", 'P': "ON", 'R': "MB", 'S': "SK",
+	'T': "AB", 'V': "BC", 'Y': "YT",
+}
+
+var (
+	provincePattern   = regexp.MustCompile(`\b(AB|BC|MB|NB|NL|NS|NT|NU|ON|PE|QC|SK|YT)\b[\s,]*[A-Z]\d[A-Z]\s?\d[A-Z]\d`)
+	postalCodePattern = regexp.MustCompile(`\b([A-Z])\d[A-Z]\s?\d[A-Z]\d\b`)
+)
+
+// one line of a tax breakdown
+type TaxLine struct {
+	Name   string `json:"name" bson:"name"`
+	Amount Money  `json:"amount" bson:"amount"`
+}
+
+// parsed and computed tax may differ by rounding of each line
+const taxTolerance Money = 2
+
+// taxes of one invoice line
+type TaxedLine struct {
+	Sku     int       `json:"sku"`
+	ItemLot int       `json:"itemLot"`
+	Base    Money     `json:"base"`
+	Taxes   []TaxLine `json:"taxes"`
+}
+
+// taxes of a whole invoice
+type TaxCalculation struct {
+	Province string      `json:"province"`
+	Lines    []TaxedLine `json:"lines"`
+	// per component, rounded to the cent
+	Breakdown []TaxLine `json:"breakdown"`
+	Total     Money     `json:"total"`
+}
+
+// province taxes are charged in: the store for pickups, the shipping address otherwise
+// false when the address names no province and the store's is assumed
+func taxProvince(invoice Invoice) (string, bool) {
+	if !invoice.IsShipping {
+		return storeProvince, true
+	}
+	if match := provincePattern.FindStringSubmatch(invoice.ShippingAddress); len(match) > 1 {
+		return match[1], true
+	}
+	if match := postalCodePattern.FindStringSubmatch(invoice.ShippingAddress); len(match) > 1 {
+		if province, ok := postalProvinces[match[1][0]]; ok {
+			return province, true
+		}
+	}
+	return storeProvince, false
+}
+
+// taxes on base, each rounded to the cent
+func taxesOn(province string, base Money) []TaxLine {
+	components, ok := provinceTaxes[province]
+	if !ok {
+		components = provinceTaxes[storeProvince]
+	}
+	taxes := make([]TaxLine, len(components))
+	for i, component := range components {
+		taxes[i] = TaxLine{Name: component.Name, Amount: base.Mul(component.Rate / 100)}
+	}
+	return taxes
+}
+
+// share of the buyer's premium carried by a bid, premium is charged on bids
+func premiumShare(invoice Invoice, bid Money) Money {
+	var bids Money = 0
+	for _, item := range invoice.Items {
+		bids += item.Bid.Mul(float64(itemUnits(item)))
+	}
+	if bids <= 0 {
+		return 0
+	}
+	return invoice.BuyersPremium.Scale(bid, bids)
+}
+
+// taxed base of one line: bid, handling fee and its share of the buyer's premium
+func lineBase(invoice Invoice, bid Money, handlingFee Money) Money {
+	return bid + handlingFee + premiumShare(invoice, bid)
+}
+
+// taxes of one line
+func lineTaxes(invoice Invoice, province string, bid Money, handlingFee Money) (Money, []TaxLine) {
+	base := lineBase(invoice, bid, handlingFee)
+	return base, taxesOn(province, base)
+}
+
+// compute the taxes of an invoice line by line
+// the breakdown taxes the summed bases, so rounding each line does not add up
+func calculateTax(invoice Invoice) TaxCalculation {
+	province, _ := taxProvince(invoice)
+	calc := TaxCalculation{Province: province, Lines: []TaxedLine{}}
+	var bases Money = 0
+	for _, item := range invoice.Items {
+		base, taxes := lineTaxes(invoice, province, item.Bid.Mul(float64(itemUnits(item))), item.HandlingFee)
+		bases += base
+		calc.Lines = append(calc.Lines, TaxedLine{Sku: item.Sku, ItemLot: item.ItemLot, Base: base, Taxes: taxes})
+	}
+
+	// components in the order the province lists them
+	calc.Breakdown = taxesOn(province, bases)
+	calc.Total = sumTaxes(calc.Breakdown)
+	return calc
+}
+
+func sumTaxes(taxes []TaxLine) Money {
+	var total Money = 0
+	for _, tax := range taxes {
+		total += tax.Amount
+	}
+	return total
+}
+
+// record the computed breakdown on a parsed invoice and flag a parsed tax that does not match it
+// needs the item bids, so it runs after the items are filled from the database
+func reconcileTax(invoice *Invoice, diag *Diagnostics) {
+	calc := calculateTax(*invoice)
+	invoice.TaxProvince = calc.Province
+	invoice.TaxBreakdown = calc.Breakdown
+
+	if _, known := taxProvince(*invoice); !known {
+		diag.Warn("taxProvince", invoice.ShippingAddress, "no province in shipping address, "+storeProvince+" taxes assumed", 0.5)
+	}
+	if diff := invoice.Tax - calc.Total; diff > taxTolerance || diff < -taxTolerance {
+		diag.Warn("tax", invoice.Tax.String(), fmt.Sprintf("parsed tax differs from computed %s tax %s", calc.Province, calc.Total), 0.5)
+	}
+}
+
+// fill in taxes of an invoice created by hand, parsed invoices keep the tax printed on them
+func applyCalculatedTax(invoice *Invoice) {
+	calc := calculateTax(*invoice)
+	invoice.TaxProvince = calc.Province
+	invoice.TaxBreakdown = calc.Breakdown
+	if invoice.Tax != 0 || len(invoice.Items) == 0 {
+		return
+	}
+	invoice.Tax = calc.Total
+	if invoice.InvoiceTotal == 0 {
+		total := invoice.BuyersPremium + calc.Total
+		for _, item := range invoice.Items {
+			total += item.Bid.Mul(float64(itemUnits(item))) + item.HandlingFee
+		}
+		invoice.InvoiceTotal = total
+	}
+}
+
+// tax calculation of an invoice, with the difference to its tax when it has one
+func CalculateTax() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var invoice Invoice
+		bindErr := c.ShouldBindJSON(&invoice)
+		if bindErr != nil {
+			fmt.Println(bindErr.Error())
+			c.String(http.StatusBadRequest, "Invalid Body")
+			return
+		}
+
+		calc := calculateTax(invoice)
+		c.JSON(http.StatusOK, gin.H{
+			"data":        calc,
+			"discrepancy": invoice.Tax - calc.Total,
+		})
+	}
+}
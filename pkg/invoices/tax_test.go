@@ -0,0 +1,58 @@
+package invoices
+
+import "testing"
+
+func TestTaxProvince(t *testing.T) {
+	cases := []struct {
+		invoice Invoice
+		want    string
+		known   bool
+	}{
+		{Invoice{BuyerAddress: "9 Elm Ave Vancouver BC V6B 1A1"}, "ON", true},
+		{Invoice{IsShipping: true, ShippingAddress: "55 Bloor St W Toronto ON M4W 1A5"}, "ON", true},
+		{Invoice{IsShipping: true, ShippingAddress: "1 Rue Saint-Paul Montreal QC H2Y 1G6"}, "QC", true},
+		{Invoice{IsShipping: true, ShippingAddress: "12 Main St Halifax B3H 1A1"}, "NS", true},
+		{Invoice{IsShipping: true, ShippingAddress: "somewhere"}, "ON", false},
+	}
+	for _, tc := range cases {
+		got, known := taxProvince(tc.invoice)
+		if got != tc.want || known != tc.known {
+			t.Errorf("taxProvince(%q) = %s %v, want %s %v", tc.invoice.ShippingAddress, got, known, tc.want, tc.known)
+		}
+	}
+}
+
+func TestCalculateTax(t *testing.T) {
+	invoice := Invoice{
+		IsShipping:      true,
+		ShippingAddress: "1 Rue Saint-Paul Montreal QC H2Y 1G6",
+		BuyersPremium:   1000,
+		Items: []InvoiceItem{
+			{Sku: 1, Bid: 6000, Unit: 1, HandlingFee: 200},
+			{Sku: 2, Bid: 2000, Unit: 2, HandlingFee: 300},
+		},
+	}
+	// bases 60+2+6 and 40+3+4, gst 5% and qst 9.975%
+	calc := calculateTax(invoice)
+	if calc.Province != "QC" || len(calc.Lines) != 2 || calc.Lines[0].Base != 6800 || calc.Lines[1].Base != 4700 {
+		t.Fatalf("calculation = %+v", calc)
+	}
+	if len(calc.Breakdown) != 2 || calc.Breakdown[0] != (TaxLine{"GST", 575}) || calc.Breakdown[1] != (TaxLine{"QST", 1147}) {
+		t.Errorf("breakdown = %+v", calc.Breakdown)
+	}
+	if calc.Total != 1722 {
+		t.Errorf("total = %s, want 17.22", calc.Total)
+	}
+
+	var diag Diagnostics
+	invoice.Tax = 1722
+	reconcileTax(&invoice, &diag)
+	if len(diag) != 0 {
+		t.Errorf("matching tax flagged: %+v", diag)
+	}
+	invoice.Tax = 1508
+	reconcileTax(&invoice, &diag)
+	if len(diag) != 1 || diag[0].Field != "tax" {
+		t.Errorf("discrepancy not flagged: %+v", diag)
+	}
+}
@@ -0,0 +1,360 @@
+package invoices
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invoice layout of the CC Power Deals auction platform
+var ccPowerDealsTemplate = &InvoiceTemplate{
+	TemplateName: "ccpowerdeals",
+	Markers:      []string{"PRICEEXTENDEDPRICE", "Invoice Total:"},
+	Noise: []string{
+		"Monday: CloseTuesday - Saturday: 12:00pm - 6:30pm",
+		"CC Power Deals240 Bartor Road, Unit 4, North York, ON, M9M 2W6+1 416-740-2333",
+		"READ NEW TERMS OF USE BEFORE YOU BID!",
+		"READ EMAIL FOR PICK-UP & SHIPPING INSTRUCTIONS",
+		"Sunday: CloseWe Asked All Items Should Check at Our Location",
+		"NO RETURN AND REFUND",
+		"#:Date:Page:UNPAIDLot#DESCRIPTIONUNIT PRICEEXTENDEDPRICE",
+		"Monday & Sunday: CloseTuesday - Saturday: 12:00pm - 6:30pmWe Asked All Items Should Check at Our Location",
+	},
+	HeaderEnd:   regexp.MustCompile(`PRICEEXTENDEDPRICE`),
+	FooterStart: regexp.MustCompile(`\d+\.\d{2}\s*Total Extended Price:`),
+	ItemPattern: regexp.MustCompile(`MSRP:(.*?)Item handling`),
+	HandlingFee: RowField{
+		Pattern: regexp.MustCompile(`Item handling fee\s*-\s*(.*?)\s*T`),
+		Anchor:  AfterItem,
+	},
+	// "2 x 7.50" is printed on the description line before the msrp
+	Unit: RowField{
+		Pattern: regexp.MustCompile(`(\d+)\s*x\s*\d+\.\d{2}`),
+		Anchor:  BeforeItem,
+	},
+	Fields: []FieldExtractor{
+		{Field: "auctionLot", Section: HeaderSection, Extract: ccpdAuctionLot},
+		{Field: "invoiceNumber", Section: HeaderSection, Extract: ccpdInvoiceNumber},
+		{Field: "buyerEmail", Section: HeaderSection, Extract: ccpdBuyerEmail},
+		{Field: "invoiceTotal", Section: FooterSection, Extract: ccpdInvoiceTotal},
+		{Field: "time", Section: HeaderSection, Extract: ccpdTime},
+		{Field: "status", Section: HeaderSection, Extract: ccpdStatusAndAddress},
+		{Field: "buyerPhone", Section: HeaderSection, Extract: ccpdBuyerPhone},
+		{Field: "tax", Section: FooterSection, Extract: ccpdTax},
+		{Field: "buyersPremium", Section: FooterSection, Extract: ccpdBuyersPremium},
+	},
+	ParseItem: ccpdItem,
+}
+
+func init() {
+	RegisterParser(ccPowerDealsTemplate)
+}
+
+var (
+	ccpdAuctionLotPattern      = regexp.MustCompile(`Auction Sale - (\d+)`)
+	ccpdInvoiceNumberPattern   = regexp.MustCompile(`\s+1\s+(\d+)\s*Auction Sale`)
+	ccpdShipEmailPattern       = regexp.MustCompile(`SHIP TO:\s*(.*?)Lot#`)
+	ccpdSoldEmailPattern       = regexp.MustCompile(`SOLD TO:\s*(.*?)Lot#`)
+	ccpdShipNameAddressPattern = regexp.MustCompile(`SOLD TO:\s*(.*?)SHIP TO:`)
+	ccpdUnpaidBalancePattern   = regexp.MustCompile(`Default:\s*(.*?)\s*Invoice Total:`)
+	ccpdPaidBalancePattern     = regexp.MustCompile(`PAID IN FULL\s*(.*?)\s*Invoice Total:`)
+	ccpdTimePattern1           = regexp.MustCompile(`\)\s*(.*?)\s*Invoice #:`)
+	ccpdTimePattern2           = regexp.MustCompile(`(\d{1,2}/\d{1,2}/\d{4} \d{1,2}:\d{2}:\d{2})`)
+	ccpdUnpaidAddressPattern   = regexp.MustCompile(`\*\*\d{4}(.*?)Phone`)
+	ccpdPaidAddressPattern     = regexp.MustCompile(`PAID IN FULL(.*?)Phone`)
+	ccpdPhonePattern           = regexp.MustCompile(`Phone:\s*(.*?)\s*#`)
+	ccpdTaxPattern             = regexp.MustCompile(`Quantity:\s*(.*?)\s*Tax1`)
+	ccpdBuyersPremiumPattern   = regexp.MustCompile(`(.*)Total Extended Price:`)
+	ccpdMsrpPattern            = regexp.MustCompile(`\$(.*?)[A-Za-z]`)
+	firstDigitPattern          = regexp.MustCompile(`\d`)
+)
+
+func parseFloat32(s string) (float32, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+	return float32(f), err
+}
+
+// split "name 123 street" at the first digit into name and address
+func splitNameAddress(s string) (string, string, bool) {
+	firstNumberIndex := firstDigitPattern.FindStringIndex(s)
+	if firstNumberIndex == nil {
+		return "", "", false
+	}
+	return strings.TrimSpace(s[:firstNumberIndex[0]]), strings.TrimSpace(s[firstNumberIndex[0]:]), true
+}
+
+func ccpdAuctionLot(header string, invoice *Invoice, diag *Diagnostics) {
+	auctionLotMatch := ccpdAuctionLotPattern.FindStringSubmatch(header)
+	if len(auctionLotMatch) > 1 {
+		lot, err := strconv.Atoi(auctionLotMatch[1])
+		if err != nil {
+			diag.Error("auctionLot", auctionLotMatch[0], err.Error())
+		}
+		invoice.AuctionLot = lot
+	}
+}
+
+func ccpdInvoiceNumber(header string, invoice *Invoice, diag *Diagnostics) {
+	invoiceNumberMatch := ccpdInvoiceNumberPattern.FindStringSubmatch(header)
+	if len(invoiceNumberMatch) > 1 {
+		invoice.InvoiceNumber = strings.TrimSpace(invoiceNumberMatch[1])
+	}
+}
+
+// get buyer name, shipping address and email
+func ccpdBuyerEmail(header string, invoice *Invoice, diag *Diagnostics) {
+	// check if invoice is shipping
+	if !strings.Contains(header, "SHIP TO:") {
+		// email will be in between "sold to:" and "lot #"
+		buyerEmailMatch := ccpdSoldEmailPattern.FindStringSubmatch(header)
+		if len(buyerEmailMatch) > 1 {
+			invoice.BuyerEmail = strings.TrimSpace(buyerEmailMatch[1])
+		}
+		return
+	}
+
+	invoice.IsShipping = true
+
+	// email will be in between "ship to:" and "lot #"
+	buyerEmailMatch := ccpdShipEmailPattern.FindStringSubmatch(header)
+	if len(buyerEmailMatch) > 1 {
+		invoice.BuyerEmail = strings.TrimSpace(buyerEmailMatch[1])
+	}
+
+	// buyer name and shipping address
+	buyerNameAddressMatch := ccpdShipNameAddressPattern.FindStringSubmatch(header)
+	if len(buyerNameAddressMatch) > 1 {
+		name, address, ok := splitNameAddress(strings.TrimSpace(buyerNameAddressMatch[1]))
+		if ok {
+			invoice.BuyerName = name
+			invoice.ShippingAddress = address
+		} else {
+			diag.Warn("shippingAddress", buyerNameAddressMatch[1], "cannot split buyer name from shipping address", 0)
+		}
+	}
+}
+
+// parse "$ 12.34 $ 5.67" into invoice total and remaining balance
+func ccpdParseBalance(match string) (Money, Money, error) {
+	// repace $ with space and split into array
+	parts := strings.Fields(strings.ReplaceAll(strings.TrimSpace(match), "$", " "))
+	if len(parts) < 2 {
+		return 0, 0, errors.New("expected invoice total and remaining balance")
+	}
+
+	total, totalErr := ParseMoney(parts[0])
+	if totalErr != nil {
+		return 0, 0, totalErr
+	}
+	remaining, remainingErr := ParseMoney(parts[1])
+	if remainingErr != nil {
+		return 0, 0, remainingErr
+	}
+	return total, remaining, nil
+}
+
+// get invoice total and remaining balance
+func ccpdInvoiceTotal(footer string, invoice *Invoice, diag *Diagnostics) {
+	invoiceBalanceMatch := ccpdUnpaidBalancePattern.FindStringSubmatch(footer)
+	if len(invoiceBalanceMatch) > 1 {
+		total, remaining, err := ccpdParseBalance(invoiceBalanceMatch[1])
+		// if they are float set them to invoice
+		if err == nil {
+			invoice.InvoiceTotal = total
+			invoice.RemainingBalance = remaining
+			return
+		}
+	}
+
+	// paid invoice has a different footer
+	invoiceBalanceMatch2 := ccpdPaidBalancePattern.FindStringSubmatch(footer)
+	if len(invoiceBalanceMatch2) < 2 {
+		diag.Error("invoiceTotal", "", "invoice total not found")
+		return
+	}
+	total, remaining, err := ccpdParseBalance(invoiceBalanceMatch2[1])
+	if err != nil {
+		diag.Error("invoiceTotal", invoiceBalanceMatch2[0], err.Error())
+	}
+	invoice.InvoiceTotal = total
+	invoice.RemainingBalance = remaining
+}
+
+// get invoice time
+func ccpdTime(header string, invoice *Invoice, diag *Diagnostics) {
+	var timeStr string = ""
+	if timeMatch1 := ccpdTimePattern1.FindStringSubmatch(header); len(timeMatch1) > 1 {
+		timeStr = strings.TrimSpace(timeMatch1[1])
+	} else if timeMatch2 := ccpdTimePattern2.FindStringSubmatch(header); len(timeMatch2) > 1 {
+		timeStr = strings.TrimSpace(timeMatch2[1])
+	}
+	if timeStr == "" {
+		return
+	}
+
+	// printed in business time without a zone
+	parsedTime, err := time.ParseInLocation("2006-01-02 15:04:05", timeStr, businessLocation)
+	if err != nil {
+		parsedTime, err = time.ParseInLocation("1/2/2006 3:04:05", timeStr, businessLocation)
+		if err != nil {
+			diag.Error("time", timeStr, "cannot parse time")
+			return
+		}
+	}
+	invoice.Time = NewTimestamp(parsedTime)
+}
+
+// get paid status, buyer address and name
+// if paid invoice the buyer address regex is different
+func ccpdStatusAndAddress(header string, invoice *Invoice, diag *Diagnostics) {
+	var buyerAddressPattern *regexp.Regexp
+	if !strings.Contains(header, "PAID IN FULL") {
+		invoice.Status = StatusUnpaid
+		buyerAddressPattern = ccpdUnpaidAddressPattern
+		invoice.InvoiceEvent = append(invoice.InvoiceEvent, InvoiceEvent{
+			Title: "Invoice Unpaid",
+			Desc:  "Invoice unpaid on issue",
+			Time:  invoice.Time,
+		})
+	} else {
+		invoice.Status = StatusPaid
+		invoice.PaymentMethod = TenderCard
+		buyerAddressPattern = ccpdPaidAddressPattern
+		invoice.InvoiceEvent = append(invoice.InvoiceEvent, InvoiceEvent{
+			Title: "Invoice Paid",
+			Desc:  "Invoice paid on issue",
+			Time:  invoice.Time,
+		})
+		// paid online before the pdf was issued, the ledger starts with that payment
+		// runs after the invoice total extractor
+		if invoice.InvoiceTotal > invoice.RemainingBalance {
+			invoice.Payments = append(invoice.Payments, Payment{
+				PaymentID: "online-" + invoice.InvoiceNumber,
+				Method:    TenderCard,
+				Amount:    invoice.InvoiceTotal - invoice.RemainingBalance,
+				Reference: "PAID IN FULL",
+				Time:      invoice.Time,
+			})
+		}
+	}
+
+	buyerAddressMatch := buyerAddressPattern.FindStringSubmatch(header)
+	if len(buyerAddressMatch) > 1 {
+		name, address, ok := splitNameAddress(strings.TrimSpace(buyerAddressMatch[1]))
+		if ok {
+			if invoice.BuyerName == "" {
+				invoice.BuyerName = name
+			}
+			invoice.BuyerAddress = address
+		} else {
+			diag.Warn("buyerAddress", buyerAddressMatch[1], "cannot split buyer name from address", 0)
+		}
+	} else {
+		diag.Warn("buyerAddress", "", "buyer address not found", 0)
+	}
+}
+
+func ccpdBuyerPhone(header string, invoice *Invoice, diag *Diagnostics) {
+	buyerPhoneMatch := ccpdPhonePattern.FindStringSubmatch(header)
+	if len(buyerPhoneMatch) > 1 {
+		buyerPhone := strings.TrimSpace(buyerPhoneMatch[1])
+		buyerPhone = strings.ReplaceAll(buyerPhone, "-", "")
+		buyerPhone = strings.ReplaceAll(buyerPhone, " ", "")
+		invoice.BuyerPhone = buyerPhone
+	}
+}
+
+func ccpdTax(footer string, invoice *Invoice, diag *Diagnostics) {
+	totalTaxMatch := ccpdTaxPattern.FindStringSubmatch(footer)
+	if len(totalTaxMatch) > 1 {
+		tax, parseErr := ParseMoney(totalTaxMatch[1])
+		if parseErr != nil {
+			diag.Error("tax", totalTaxMatch[0], parseErr.Error())
+		}
+		invoice.Tax = tax
+	} else {
+		diag.Warn("tax", "", "tax not found, assuming 0", 0.5)
+	}
+}
+
+// get buyer premium if there is any
+func ccpdBuyersPremium(footer string, invoice *Invoice, diag *Diagnostics) {
+	if !strings.Contains(footer, "Premium:") {
+		invoice.BuyersPremium = 0
+		return
+	}
+	buyersPremiumMatch := ccpdBuyersPremiumPattern.FindStringSubmatch(footer)
+	if len(buyersPremiumMatch) > 1 {
+		premium, parseErr := ParseMoney(buyersPremiumMatch[1])
+		if parseErr != nil {
+			diag.Error("buyersPremium", buyersPremiumMatch[0], parseErr.Error())
+		}
+		invoice.BuyersPremium = premium
+	}
+}
+
+// parse one item row, "$ msrp shelf sku T lot"
+func ccpdItem(value string, diag *Diagnostics) InvoiceItem {
+	var invoiceItem InvoiceItem
+
+	// get rid of dollar sign and T
+	item := strings.ReplaceAll(value, "$", "")
+	item = strings.ReplaceAll(item, "T", " ")
+	item = strings.TrimSpace(item)
+	// split into string array by space
+	datas := strings.Fields(item)
+
+	// if check for error case
+	// example error case $ 10.98Y17 43430T651 => 10.98Y17 43430 651 (len<4)
+	// example error case $ 27.53 G1043239T563 => 27.53 G1043239 563 (len<4)
+	if len(datas) == 4 {
+		msrp, err := ParseMoney(datas[0])
+		if err != nil {
+			diag.Error("items.msrp", value, err.Error())
+		}
+		invoiceItem.Msrp = msrp
+		invoiceItem.ShelfLocation = datas[1]
+		sku, convertErr := strconv.Atoi(datas[2])
+		if convertErr == nil {
+			invoiceItem.Sku = sku
+		} else {
+			diag.Warn("items.sku", value, convertErr.Error(), 0)
+		}
+		itemLot, convertErr2 := strconv.Atoi(datas[3])
+		if convertErr2 == nil {
+			invoiceItem.ItemLot = itemLot
+		} else {
+			diag.Error("items.itemLot", value, convertErr2.Error())
+		}
+		return invoiceItem
+	}
+
+	// shelf location and sku are glued together, only msrp and lot are reliable
+	diag.Warn("items", value, "malformed item row, shelf location and sku skipped", 0.5)
+
+	if len(datas) == 0 {
+		diag.Error("items", value, "empty item row")
+		return invoiceItem
+	}
+
+	// find the msrp by regex
+	msrpMatch := ccpdMsrpPattern.FindStringSubmatch(value)
+	if len(msrpMatch) > 1 {
+		msrp, convertErr := ParseMoney(msrpMatch[1])
+		if convertErr != nil {
+			diag.Error("items.msrp", value, convertErr.Error())
+		}
+		invoiceItem.Msrp = msrp
+	}
+
+	// split it by T and take the lot number
+	itemLot, convertErr := strconv.Atoi(datas[len(datas)-1])
+	if convertErr == nil {
+		invoiceItem.ItemLot = itemLot
+	} else {
+		diag.Error("items.itemLot", value, convertErr.Error())
+	}
+	return invoiceItem
+}
@@ -0,0 +1,185 @@
+package invoices
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	// zone database for images without one
+	_ "time/tzdata"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// time zone invoices are issued and reported in, set with SetBusinessTimeZone
+var businessLocation = time.FixedZone("EST", -5*60*60)
+
+func init() {
+	if location, err := time.LoadLocation("America/New_York"); err == nil {
+		businessLocation = location
+	}
+}
+
+// use a named zone, e.g. "America/Toronto", for new times, day boundaries and display
+// empty keeps the default America/New_York
+func SetBusinessTimeZone(name string) error {
+	if name == "" {
+		return nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	businessLocation = location
+	return nil
+}
+
+// a point in time to the second, bson stores a date and json carries RFC3339 in the business time zone
+// documents written before dates hold strings in one of legacyTimeLayouts and still decode
+type Timestamp struct {
+	time.Time
+	// a stored string no layout matched, written back as it was so saving the document keeps it
+	raw string
+}
+
+var ErrInvalidTimestamp = errors.New("invalid timestamp")
+
+// layouts times were stored in as strings: time.Time.String(), invoiceTimeFormat, RFC3339 and the pdf header
+var legacyTimeLayouts = []string{
+	time.RFC3339,
+	invoiceTimeFormat,
+	"2006-01-02 15:04:05",
+	"1/2/2006 3:04:05",
+	"2006-01-02",
+}
+
+func NewTimestamp(t time.Time) Timestamp {
+	if t.IsZero() {
+		return Timestamp{}
+	}
+	return Timestamp{Time: t.Truncate(time.Second).In(businessLocation)}
+}
+
+// current time in the business time zone, for invoice events
+func eventTime() Timestamp {
+	return NewTimestamp(time.Now())
+}
+
+// parse any layout a time was ever stored or sent in, layouts without a zone are business time
+// empty is the zero timestamp
+func ParseTimestamp(s string) (Timestamp, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Timestamp{}, nil
+	}
+	// monotonic clock reading printed by time.Time.String()
+	s, _, _ = strings.Cut(s, " m=")
+	for _, layout := range legacyTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, businessLocation); err == nil {
+			return NewTimestamp(t), nil
+		}
+	}
+	return Timestamp{}, fmt.Errorf("%w: %q", ErrInvalidTimestamp, s)
+}
+
+// midnight starting the business day of t
+func startOfDay(t Timestamp) Timestamp {
+	local := t.In(businessLocation)
+	return Timestamp{Time: time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, businessLocation)}
+}
+
+// business time in invoiceTimeFormat, empty when zero
+func (t Timestamp) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(businessLocation).Format(invoiceTimeFormat)
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte(`""`), nil
+	}
+	return []byte(`"` + t.In(businessLocation).Format(time.RFC3339) + `"`), nil
+}
+
+// strings in any legacy layout are accepted, null and "" are zero
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		*t = Timestamp{}
+		return nil
+	}
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return fmt.Errorf("%w: %s", ErrInvalidTimestamp, data)
+	}
+	parsed, err := ParseTimestamp(string(data[1 : len(data)-1]))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// zero is stored as null, an unreadable legacy string as it was
+func (t Timestamp) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if t.IsZero() && t.raw != "" {
+		return bson.TypeString, bsoncore.AppendString(nil, t.raw), nil
+	}
+	if t.IsZero() {
+		return bson.TypeNull, nil, nil
+	}
+	return bson.TypeDateTime, bsoncore.AppendDateTime(nil, t.UnixMilli()), nil
+}
+
+// dates are read in the business time zone, strings are from before the migration
+// a string in no known layout reads as zero rather than failing the whole document
+func (t *Timestamp) UnmarshalBSONValue(bt bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: bt, Value: data}
+	switch bt {
+	case bson.TypeDateTime:
+		*t = NewTimestamp(value.Time())
+	case bson.TypeString:
+		parsed, err := ParseTimestamp(value.StringValue())
+		if err != nil {
+			fmt.Println("stored time kept as is:", err)
+			*t = Timestamp{raw: value.StringValue()}
+			return nil
+		}
+		*t = parsed
+	case bson.TypeNull, bson.TypeUndefined:
+		*t = Timestamp{}
+	default:
+		return fmt.Errorf("%w: bson %s", ErrInvalidTimestamp, bt)
+	}
+	return nil
+}
+
+// filter on whole business days from the day of from through the day of to
+// either end may be empty, from alone is that one day
+func timeRangeFilter(from string, to string) (bson.M, error) {
+	filter := bson.M{}
+	fromTime, err := ParseTimestamp(from)
+	if err != nil {
+		return nil, err
+	}
+	toTime, err := ParseTimestamp(to)
+	if err != nil {
+		return nil, err
+	}
+	if toTime.IsZero() {
+		toTime = fromTime
+	}
+	if !fromTime.IsZero() {
+		filter["$gte"] = startOfDay(fromTime)
+	}
+	if !toTime.IsZero() {
+		// midnight ending the day, AddDate keeps daylight saving days whole
+		end := startOfDay(toTime)
+		filter["$lt"] = Timestamp{Time: end.AddDate(0, 0, 1)}
+	}
+	return filter, nil
+}
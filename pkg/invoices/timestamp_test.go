@@ -0,0 +1,142 @@
+package invoices
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 6, 11, 20, 5, 44, 0, businessLocation)
+	// processSplitInvoice, UploadSignature, RefundInvoice and the pdf header wrote these
+	for _, in := range []string{
+		"2024-06-12 00:05:44.123 +0000 UTC m=+0.004",
+		"2024-06-11 20:05:44 -0400 EDT",
+		"2024-06-11T20:05:44-04:00",
+		"2024-06-11 20:05:44",
+	} {
+		got, err := ParseTimestamp(in)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("ParseTimestamp(%q) = %v, %v", in, got, err)
+		}
+	}
+	if got, err := ParseTimestamp(""); err != nil || !got.IsZero() {
+		t.Errorf("empty = %v, %v", got, err)
+	}
+	if _, err := ParseTimestamp("yesterday"); err == nil {
+		t.Error("invalid time parsed")
+	}
+}
+
+func TestTimestampEncoding(t *testing.T) {
+	event := InvoiceEvent{Title: "Invoice paid", Time: NewTimestamp(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))}
+	data, _ := json.Marshal(event)
+	var decoded InvoiceEvent
+	if err := json.Unmarshal(data, &decoded); err != nil || !decoded.Time.Equal(event.Time.Time) {
+		t.Errorf("json round trip %s = %v, %v", data, decoded.Time, err)
+	}
+
+	raw, err := bson.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := bson.Raw(raw).Lookup("time"); value.Type != bson.TypeDateTime {
+		t.Errorf("time stored as %s", value.Type)
+	}
+	decoded = InvoiceEvent{}
+	if err := bson.Unmarshal(raw, &decoded); err != nil || !decoded.Time.Equal(event.Time.Time) {
+		t.Errorf("bson round trip = %v, %v", decoded.Time, err)
+	}
+
+	// documents from before the migration hold strings, empty for no signature yet
+	legacy, _ := bson.Marshal(bson.M{"time": "2024-05-04 06:30:12 -0400 EDT", "pickupTime": ""})
+	var invoice Invoice
+	if err := bson.Unmarshal(legacy, &invoice); err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Time.String() != "2024-05-04 06:30:12 -0400 EDT" || !invoice.PickupTime.IsZero() {
+		t.Errorf("legacy decode = %q %q", invoice.Time, invoice.PickupTime)
+	}
+
+	// a string in no known layout decodes as zero and is written back unchanged
+	legacy, _ = bson.Marshal(bson.M{"time": "last tuesday", "pickupTime": "2024-05-04"})
+	invoice = Invoice{}
+	if err := bson.Unmarshal(legacy, &invoice); err != nil {
+		t.Fatal(err)
+	}
+	if !invoice.Time.IsZero() || invoice.PickupTime.IsZero() {
+		t.Errorf("unknown layout decode = %q %q", invoice.Time, invoice.PickupTime)
+	}
+	raw, _ = bson.Marshal(invoice)
+	if value := bson.Raw(raw).Lookup("time"); value.StringValue() != "last tuesday" {
+		t.Errorf("unknown layout stored as %s", value)
+	}
+}
+
+func TestTimeRangeFilter(t *testing.T) {
+	// the day clocks go back is 25 hours long
+	filter, err := timeRangeFilter("2024-11-03T04:00:00.000Z", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := filter["$gte"].(Timestamp)
+	to := filter["$lt"].(Timestamp)
+	if from.String() != "2024-11-03 00:00:00 -0400 EDT" || to.String() != "2024-11-04 00:00:00 -0500 EST" {
+		t.Errorf("range = %s to %s", from, to)
+	}
+
+	filter, _ = timeRangeFilter("2024-06-01", "2024-06-30")
+	if to := filter["$lt"].(Timestamp); to.String() != "2024-07-01 00:00:00 -0400 EDT" {
+		t.Errorf("to = %s", to)
+	}
+	if _, err := timeRangeFilter("June", ""); err == nil {
+		t.Error("invalid date accepted")
+	}
+}
+
+// the invoice list returns migrated dates in the business time zone
+func TestInvoiceListTimesJSON(t *testing.T) {
+	at := time.Date(2024, 6, 12, 0, 5, 44, 0, time.UTC)
+	doc, _ := bson.Marshal(bson.M{
+		"invoiceNumber": "10234",
+		"invoiceTotal":  int64(4972),
+		"time":          primitive.NewDateTimeFromTime(at),
+		"pickupTime":    primitive.NewDateTimeFromTime(at.Add(time.Hour)),
+		"payments":      bson.A{bson.M{"method": TenderCash, "amount": int64(4972), "time": primitive.NewDateTimeFromTime(at)}},
+	})
+	cursor, err := mongo.NewCursorFromDocuments([]interface{}{doc}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page []Invoice
+	if err := cursor.All(context.Background(), &page); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(page)
+	for _, want := range []string{
+		`"time":"2024-06-11T20:05:44-04:00"`,
+		`"pickupTime":"2024-06-11T21:05:44-04:00"`,
+		`"amount":49.72,"reference":"","receivedBy":"","time":"2024-06-11T20:05:44-04:00"`,
+		`"invoiceTotal":49.72`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("list json %s missing %s", data, want)
+		}
+	}
+}
+
+func TestTimesConverted(t *testing.T) {
+	var invoice Invoice
+	legacy, _ := bson.Marshal(bson.M{"time": "2024-05-04", "pickupTime": "last tuesday"})
+	bson.Unmarshal(legacy, &invoice)
+	// the unreadable pickup time keeps the document from counting as migrated
+	if !timesConverted(invoice.Time) || timesConverted(invoice.Time, invoice.PickupTime) {
+		t.Error("unreadable time counted as converted")
+	}
+}
@@ -0,0 +1,121 @@
+package invoices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/gorilla/websocket"
+)
+
+// websocket roles, read from the "role" custom claim of the firebase token
+// a user without the claim is staff, signature pad accounts carry role "pad" and may carry a "counter" claim
+const (
+	RoleStaff string = "staff"
+	RolePad   string = "pad"
+)
+
+// message type of the first message when the token is not in a header
+const AuthMessage string = "auth"
+
+// time a client has to send its auth message after connecting
+const wsAuthWait = 10 * time.Second
+
+var (
+	ErrWsUnauthenticated = errors.New("invalid or missing token")
+	ErrWsForbidden       = errors.New("not allowed for this room")
+)
+
+// checks firebase id tokens, *auth.Client in production
+type TokenVerifier interface {
+	VerifyIDToken(ctx context.Context, idToken string) (*auth.Token, error)
+}
+
+// who is on the other end of a websocket
+type wsIdentity struct {
+	UID  string
+	Role string
+	// the only counter a pad may serve, empty for any
+	Counter string
+}
+
+func identityFromToken(token *auth.Token) wsIdentity {
+	identity := wsIdentity{UID: token.UID, Role: RoleStaff}
+	if role, _ := token.Claims["role"].(string); role == RolePad {
+		identity.Role = RolePad
+		identity.Counter, _ = token.Claims["counter"].(string)
+	}
+	return identity
+}
+
+func verifyWsToken(ctx context.Context, verifier TokenVerifier, token string) (wsIdentity, error) {
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	if token == "" {
+		return wsIdentity{}, ErrWsUnauthenticated
+	}
+	decoded, err := verifier.VerifyIDToken(ctx, token)
+	if err != nil {
+		return wsIdentity{}, ErrWsUnauthenticated
+	}
+	return identityFromToken(decoded), nil
+}
+
+// read the auth message a client sends first when its token was not in a header
+func readAuthMessage(ctx context.Context, verifier TokenVerifier, ws *websocket.Conn) (wsIdentity, error) {
+	ws.SetReadDeadline(time.Now().Add(wsAuthWait))
+	defer ws.SetReadDeadline(time.Time{})
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		return wsIdentity{}, ErrWsUnauthenticated
+	}
+	var authMsg struct {
+		Type string `json:"type"`
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &authMsg); err != nil || authMsg.Type != AuthMessage {
+		return wsIdentity{}, ErrWsUnauthenticated
+	}
+	return verifyWsToken(ctx, verifier, authMsg.Data.Token)
+}
+
+// pads may only join their counter, staff only invoice rooms
+func canJoin(identity wsIdentity, room string) bool {
+	if counter, ok := strings.CutPrefix(room, "counter:"); ok {
+		return identity.Role == RolePad && (identity.Counter == "" || identity.Counter == counter)
+	}
+	if strings.HasPrefix(room, "invoice:") {
+		return identity.Role == RoleStaff
+	}
+	return false
+}
+
+// origins allowed to open /ws besides the server's own host
+var wsAllowedOrigins = map[string]bool{}
+
+// configure the websocket origin allowlist, e.g. "https://admin.example.com"
+func SetWsAllowedOrigins(origins []string) {
+	allowed := map[string]bool{}
+	for _, origin := range origins {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			allowed[origin] = true
+		}
+	}
+	wsAllowedOrigins = allowed
+}
+
+// browsers always send an origin, clients without one are not browsers and are left to the token
+func checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || wsAllowedOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,56 @@
+package invoices
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/auth"
+)
+
+func TestCanJoin(t *testing.T) {
+	staff := identityFromToken(&auth.Token{UID: "a", Claims: map[string]interface{}{"role": "admin"}})
+	pad := identityFromToken(&auth.Token{UID: "b", Claims: map[string]interface{}{"role": RolePad, "counter": "front"}})
+	anyPad := identityFromToken(&auth.Token{UID: "c", Claims: map[string]interface{}{"role": RolePad}})
+	if staff.Role != RoleStaff || pad.Counter != "front" {
+		t.Fatalf("identities = %+v %+v", staff, pad)
+	}
+
+	cases := []struct {
+		identity wsIdentity
+		room     string
+		want     bool
+	}{
+		{staff, invoiceRoom("1001"), true},
+		{staff, counterRoom("front"), false},
+		{pad, counterRoom("front"), true},
+		{pad, counterRoom("back"), false},
+		{pad, invoiceRoom("1001"), false},
+		{anyPad, counterRoom("back"), true},
+		{pad, staffRoom, false},
+	}
+	for _, tc := range cases {
+		if got := canJoin(tc.identity, tc.room); got != tc.want {
+			t.Errorf("canJoin(%+v, %s) = %v", tc.identity, tc.room, got)
+		}
+	}
+}
+
+func TestCheckWsOrigin(t *testing.T) {
+	SetWsAllowedOrigins([]string{"https://admin.example.com/", ""})
+	defer SetWsAllowedOrigins(nil)
+
+	for origin, want := range map[string]bool{
+		"":                          true,
+		"https://admin.example.com": true,
+		"http://api.example.com":    true,
+		"https://evil.example.com":  false,
+	} {
+		r := httptest.NewRequest("GET", "http://api.example.com/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := checkWsOrigin(r); got != want {
+			t.Errorf("origin %q allowed = %v", origin, got)
+		}
+	}
+}